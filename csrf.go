@@ -3,10 +3,16 @@
 package csrf
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
-	"net/url"
+	"strings"
+	"time"
 
 	"golang.org/x/net/context"
 
@@ -15,17 +21,50 @@ import (
 	"github.com/gorilla/securecookie"
 )
 
-// CSRF token length in bytes.
+// Default CSRF token length in bytes.
 const tokenLength = 32
 
+// Default CSRF cookie MaxAge (12 hours) in seconds.
+const defaultMaxAge = 3600 * 12
+
+// Length in bytes of the issuance timestamp stored with tokens when a TokenTTL
+// is set.
+const timestampLength = 8
+
+// Minimum authentication key length in bytes.
+const minKeyLength = 32
+
+// Minimum CSRF token length in bytes.
+const minTokenLength = 16
+
+// Default maximum number of bytes of a multipart form (including files) held in
+// memory when parsing it for a token - see MultipartMaxMemory. The remainder is
+// stored in temporary files. This matches the default used by net/http.
+const multipartMaxMemory = 32 << 20
+
+// Default maximum size of a JSON body read for a token - see BodyFieldName.
+// Larger bodies are treated as carrying no token. This matches the limit
+// net/http applies to form bodies.
+const jsonMaxBodyBytes = 10 << 20
+
+// Maximum number of used tokens remembered for ReplayWindow. Once it is
+// reached, the oldest are forgotten first.
+const replayCacheSize = 10000
+
 // Context/session keys & prefixes
 const (
-	tokenKey     string = "goji.csrf.Token"
-	formKey      string = "goji.csrf.Form"
-	errorKey     string = "goji.csrf.Error"
-	skipCheckKey string = "goji.csrf.Skip"
-	cookieName   string = "_goji_csrf"
-	errorPrefix  string = "goji/csrf: "
+	tokenKey       string = "goji.csrf.Token"
+	formKey        string = "goji.csrf.Form"
+	errorKey       string = "goji.csrf.Error"
+	skipCheckKey   string = "goji.csrf.Skip"
+	fieldNameKey   string = "goji.csrf.FieldName"
+	cookieName     string = "_goji_csrf"
+	hostPrefix     string = "__Host-"
+	wildcardPrefix string = "*."
+	jsCookieName   string = "XSRF-TOKEN"
+	jsHeaderName   string = "X-XSRF-TOKEN"
+	metaName       string = "csrf-token"
+	errorPrefix    string = "goji/csrf: "
 )
 
 var (
@@ -41,25 +80,141 @@ var (
 // with the TemplateField function.
 var TemplateTag = "csrfField"
 
+// The reasons a request can fail CSRF validation. FailureReason returns one of
+// these (or an error from the store), so a custom ErrorHandler can compare
+// against them with errors.Is.
 var (
-	// ErrNoReferer is returned when a HTTPS request provides an empty Referer
+	// ErrNoReferer was returned when a HTTPS request provided an empty Referer
 	// header.
+	//
+	// Deprecated: requests without an Origin or Referer header now fail with
+	// ErrNoOrigin.
 	ErrNoReferer = errors.New("referer not supplied")
 	// ErrBadReferer is returned when the scheme & host in the URL do not match
 	// the supplied Referer header.
 	ErrBadReferer = errors.New("referer invalid")
-	// ErrNoToken is returned if no CSRF token is supplied in the request.
+	// ErrNoOrigin is returned when a HTTPS request provides neither an Origin
+	// nor a Referer header.
+	ErrNoOrigin = errors.New("origin not supplied")
+	// ErrBadOrigin is returned when a HTTPS request provides an Origin header
+	// that does not match the URL or a trusted origin.
+	ErrBadOrigin = errors.New("origin invalid")
+	// ErrNoToken is returned if no CSRF token is supplied in the request, or
+	// the session has no token to compare it against - e.g. because the
+	// client didn't send the cookie.
 	ErrNoToken = errors.New("CSRF token not found in request")
 	// ErrBadToken is returned if the CSRF token in the request does not match
 	// the token in the session, or is otherwise malformed.
 	ErrBadToken = errors.New("CSRF token invalid")
+	// ErrTokenExpired is returned if the token in the session is older than
+	// the configured TokenTTL.
+	ErrTokenExpired = errors.New("CSRF token expired")
+	// ErrBodyTooLarge is returned if the request body exceeds the configured
+	// MaxBodyBytes while the token is being read from it.
+	ErrBodyTooLarge = errors.New("request body too large")
+	// ErrStoreFailure is returned if the token can't be saved to the
+	// TokenStore - e.g. because the cookie is too large, or a server-side
+	// store is unavailable. It wraps the store's error.
+	ErrStoreFailure = errors.New("CSRF token store failure")
+	// ErrBadContentType is returned if the Content-Type of the request isn't
+	// one of those allowed by RequireContentType.
+	ErrBadContentType = errors.New("content type not allowed")
+	// ErrCrossSite is returned if CheckFetchMetadata is enabled and the
+	// Sec-Fetch-Site header reports a cross-site request from an origin that
+	// isn't trusted.
+	ErrCrossSite = errors.New("cross-site request")
+	// ErrTokenReplayed is returned if ReplayWindow is set and the session's
+	// token was already used by another unsafe request within the window.
+	ErrTokenReplayed = errors.New("CSRF token already used")
+)
+
+// errNotProtected is returned by helpers that require the CSRF middleware to
+// have been applied to the request.
+var errNotProtected = errors.New(errorPrefix + "CSRF middleware not applied to request")
+
+// storeError wraps an error from the TokenStore, so that errors.Is matches both
+// ErrStoreFailure and the store's error. fmt.Errorf can only wrap more than one
+// error from Go 1.20.
+type storeError struct {
+	err error
+}
+
+func (e storeError) Error() string {
+	return ErrStoreFailure.Error() + ": " + e.err.Error()
+}
+
+func (e storeError) Unwrap() error {
+	return e.err
+}
+
+func (e storeError) Is(target error) bool {
+	return target == ErrStoreFailure
+}
+
+// SameSiteMode allows a server to define a cookie attribute making it impossible
+// for the browser to send this cookie along with cross-site requests. It mirrors
+// the http.SameSite type.
+//
+// See https://tools.ietf.org/html/draft-ietf-httpbis-rfc6265bis for details.
+type SameSiteMode int
+
+// SameSite options
+const (
+	// SameSiteDefaultMode sets the 'SameSite' cookie attribute without a value.
+	SameSiteDefaultMode SameSiteMode = iota + 1
+	// SameSiteLaxMode sets 'SameSite=Lax'.
+	SameSiteLaxMode
+	// SameSiteStrictMode sets 'SameSite=Strict'.
+	SameSiteStrictMode
+	// SameSiteNoneMode sets 'SameSite=None'. Browsers require the 'Secure' flag
+	// to be set alongside it.
+	SameSiteNoneMode
+)
+
+// FailurePolicy determines how the middleware handles requests when a new token
+// can't be saved to the TokenStore: see StoreFailurePolicy.
+type FailurePolicy int
+
+// Store failure policies
+const (
+	// FailOpen passes the request to the handler without a token. Unsafe
+	// requests still fail validation, as they have no valid token.
+	FailOpen FailurePolicy = iota + 1
+	// FailClosed fails the request with ErrStoreFailure.
+	FailClosed
+)
+
+// ProtectionState describes how the middleware handled a request: see
+// Protection.
+type ProtectionState int
+
+// Protection states
+const (
+	// Unprotected means the middleware has not been applied to the request.
+	Unprotected ProtectionState = iota
+	// Validated means the request passed the origin and token checks.
+	Validated
+	// Exempt means the checks were skipped, as the request matched an exempt
+	// path or was skipped with UnsafeSkipCheck.
+	Exempt
+	// SafeMethod means the checks were skipped, as the request used a safe
+	// method (see SafeMethods).
+	SafeMethod
 )
 
+// csrf is the middleware. It is shared by every request it handles, so it must
+// not be modified once constructed: requests that need a different
+// configuration work on a copy.
 type csrf struct {
-	h    goji.Handler
-	sc   *securecookie.SecureCookie
-	st   store
-	opts options
+	h  goji.Handler
+	sc *securecookie.SecureCookie
+	st TokenStore
+	// ds is set in DoubleSubmit mode, and is also the store.
+	ds *doubleSubmitStore
+	// replays is set if ReplayWindow is, and is shared by every handler the
+	// middleware wraps.
+	replays *replayCache
+	opts    options
 }
 
 // options contains the optional settings for the CSRF middleware.
@@ -69,12 +224,124 @@ type options struct {
 	Path   string
 	// Note that the function and field names match the case of the associated
 	// http.Cookie field instead of the "correct" HTTPOnly name that golint suggests.
-	HttpOnly      bool
-	Secure        bool
-	RequestHeader string
-	FieldName     string
-	ErrorHandler  goji.Handler
-	CookieName    string
+	HttpOnly       bool
+	Secure         bool
+	RequestHeaders []string
+	FieldName      string
+	ErrorHandler   goji.Handler
+	CookieName     string
+	SameSite       SameSiteMode
+	TokenLength    int
+	BodyFieldName  string
+	QueryFieldName string
+	ExemptPaths    []string
+	ExemptGlobs    []string
+	SkipFuncs      []func(r *http.Request) bool
+	// TrustedOrigins are stored as normalized "scheme://host" strings.
+	TrustedOrigins    []string
+	OnFailure         func(r *http.Request, reason error)
+	TrustProxyHeaders bool
+	SafeMethods       []string
+	TokenTTL          time.Duration
+	JSCookieName      string
+	Name              string
+	VerificationKeys  [][]byte
+	Logger            CSRFLogger
+	FailureStatus     int
+	Partitioned       bool
+	RandReader        io.Reader
+	TokenExtractor    func(r *http.Request) (string, error)
+	ResponseHeader    string
+	DoubleSubmit      bool
+	HostPrefix        bool
+	// NoReissueIfPresent keeps a valid XSRF-TOKEN cookie rather than
+	// replacing it on every request.
+	NoReissueIfPresent bool
+	BindClientIP       bool
+	BindUserAgent      bool
+	ClientIPHeader     string
+	MaskLength         int
+	MultipartMaxMemory int64
+	ReplayWindow       time.Duration
+	MaxBodyBytes       int64
+	EncryptionKey      []byte
+	Codec              CookieCodec
+	HeaderValuePrefix  string
+	MetaName           string
+	DevMode            bool
+	// DisableRefererCheck skips the Origin and Referer checks.
+	DisableRefererCheck bool
+	Encoding            *base64.Encoding
+	FallbackCookieNames []string
+	SingleUse           bool
+	Tracer              CSRFTracer
+	ContentTypes        []string
+	IssuePaths          []string
+	StoreFailurePolicy  FailurePolicy
+	VaryCookie          bool
+	CheckFetchMetadata  bool
+	SlidingExpiry       bool
+	FailureBody         string
+	FailureContentType  string
+	SessionHeader       string
+	KeyedStore          KeyedTokenStore
+}
+
+// CSRFLogger is the interface used to log diagnostics about rejected requests
+// and unreadable session tokens. It is satisfied by *testing.T; use LoggerFunc
+// to adapt a function such as log.Printf.
+type CSRFLogger interface {
+	Logf(format string, args ...interface{})
+}
+
+// LoggerFunc adapts an ordinary Printf-style function to a CSRFLogger.
+type LoggerFunc func(format string, args ...interface{})
+
+// Logf calls f(format, args...).
+func (f LoggerFunc) Logf(format string, args ...interface{}) {
+	f(format, args...)
+}
+
+// CSRFTracer is the interface used to record rejected requests on the trace of
+// the request - e.g. as an OpenTelemetry span event - without this package
+// depending on a tracing library. See Tracer.
+type CSRFTracer interface {
+	// RecordFailure is called with the context of the rejected request, which
+	// carries its span, and the failure reason. The reason never contains
+	// the token.
+	RecordFailure(ctx context.Context, reason error)
+}
+
+// nopLogger is the default CSRFLogger, which discards everything.
+type nopLogger struct{}
+
+func (nopLogger) Logf(format string, args ...interface{}) {}
+
+// discardWriter is an http.ResponseWriter that discards everything written to
+// it, including headers.
+type discardWriter struct{}
+
+func (discardWriter) Header() http.Header         { return http.Header{} }
+func (discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (discardWriter) WriteHeader(int)             {}
+
+// instanceKey is the context key used by a named middleware instance.
+type instanceKey struct {
+	name string
+	key  string
+}
+
+// requestState holds the CSRF token for a request. It is stored in the request
+// context as a pointer so that Regenerate can replace the token for the
+// remainder of the request.
+type requestState struct {
+	cs *csrf
+	// r is the request the token is issued for, which it may be bound to.
+	r         *http.Request
+	realToken []byte
+	// token is the masked token returned by Token.
+	token string
+	state ProtectionState
 }
 
 // Protect is HTTP middleware that provides Cross-Site Request Forgery
@@ -88,6 +355,17 @@ type options struct {
 // Requests that do not provide a matching token are served with a HTTP 403
 // 'Forbidden' error response.
 //
+// The authKey is used to authenticate the session cookie and must be at least
+// 32 bytes long. Protect panics if it is shorter, or if any of the options
+// returns an error - e.g. an invalid CookieName - so that a misconfiguration
+// is caught when the middleware is constructed. Use ProtectE to handle the
+// error instead.
+//
+// Protect returns Goji middleware, which doesn't need to know the handler it
+// wraps: register it with Mux.UseC, or call it on a single handler. For
+// Mux.Use, which takes net/http middleware, use ProtectHTTP instead. Tokens and
+// failure reasons are available to handlers in the same way in each case.
+//
 // Example:
 //	package main
 //
@@ -103,7 +381,7 @@ type options struct {
 //	func main() {
 //	    m := goji.NewMux()
 //	    // Add the middleware to your router.
-//	    m.UseC(csrf.Protect([]byte("32-byte-long-auth-key")))
+//	    m.UseC(csrf.Protect([]byte("32-byte-long-authentication-key!")))
 //	    m.HandleFuncC(pat.Get("/signup"), ShowSignupForm)
 //	    // POST requests without a valid token will return a HTTP 403 Forbidden.
 //	    m.HandleFuncC(pat.Post("/signup/post"), SubmitSignupForm)
@@ -129,63 +407,368 @@ type options struct {
 //	}
 //
 func Protect(authKey []byte, opts ...Option) func(goji.Handler) goji.Handler {
+	protect, err := ProtectE(authKey, opts...)
+	if err != nil {
+		panic(err)
+	}
+
+	return protect
+}
+
+// ProtectE is like Protect, but returns an error - if the authKey is too short,
+// or any of the options returns an error - instead of panicking, for
+// applications that want to report a misconfiguration at startup gracefully.
+//
+// Example:
+//
+//	protect, err := csrf.ProtectE(key, csrf.CookieName(name))
+//	if err != nil {
+//	    log.Fatalf("invalid CSRF configuration: %v", err)
+//	}
+//	m.UseC(protect)
+func ProtectE(authKey []byte, opts ...Option) (func(goji.Handler) goji.Handler, error) {
+	cs, err := newCSRF(authKey, opts...)
+	if err != nil {
+		return nil, err
+	}
+
 	return func(h goji.Handler) goji.Handler {
-		cs := parseOptions(h, opts...)
+		c := *cs
+		c.h = h
+
+		return &c
+	}, nil
+}
+
+// newCSRF returns the middleware configured with the given key and options,
+// without a handler to call. It returns an error if the key is too short or
+// any option is invalid.
+func newCSRF(authKey []byte, opts ...Option) (*csrf, error) {
+	if err := checkKey(authKey); err != nil {
+		return nil, err
+	}
+
+	cs, err := parseOptions(nil, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkStoreOptions(cs.st, cs.opts); err != nil {
+		return nil, err
+	}
+
+	// HeaderOnly keeps the token in the keyed store, and delivers it in a
+	// response header.
+	if cs.opts.SessionHeader != "" {
+		cs.st = &headerStore{
+			header: cs.opts.SessionHeader,
+			keyed:  cs.opts.KeyedStore,
+			secret: authKey,
+		}
+
+		if cs.opts.ResponseHeader == "" {
+			cs.opts.ResponseHeader = headerName
+		}
+	}
 
-		// Set the defaults if no options have been specified
-		if cs.opts.ErrorHandler == nil {
+	// Set the defaults if no options have been specified
+	if cs.opts.ErrorHandler == nil {
+		if cs.opts.FailureContentType != "" {
+			cs.opts.ErrorHandler = bodyHandler(cs.opts.FailureStatus,
+				cs.opts.FailureBody, cs.opts.FailureContentType)
+		} else if cs.opts.FailureStatus != 0 {
+			cs.opts.ErrorHandler = statusHandler(cs.opts.FailureStatus)
+		} else {
 			cs.opts.ErrorHandler = goji.HandlerFunc(unauthorizedHandler)
 		}
+	}
+
+	if cs.opts.FieldName == "" {
+		cs.opts.FieldName = fieldName
+	}
 
-		if cs.opts.MaxAge < 1 {
-			// Default of 12 hours
-			cs.opts.MaxAge = 3600 * 12
+	if cs.opts.CookieName == "" {
+		cs.opts.CookieName = cookieName
+	}
+
+	if cs.opts.HostPrefix {
+		if !strings.HasPrefix(cs.opts.CookieName, hostPrefix) {
+			cs.opts.CookieName = hostPrefix + cs.opts.CookieName
 		}
 
-		if cs.opts.FieldName == "" {
-			cs.opts.FieldName = fieldName
+		if cs.opts.Path == "" {
+			cs.opts.Path = "/"
 		}
+	}
+
+	if err := checkHostPrefix(cs.opts); err != nil {
+		return nil, err
+	}
+
+	if len(cs.opts.RequestHeaders) == 0 {
+		cs.opts.RequestHeaders = []string{headerName}
+	}
+
+	if cs.opts.SafeMethods == nil {
+		cs.opts.SafeMethods = safeMethods
+	}
+
+	if cs.opts.TokenLength == 0 {
+		cs.opts.TokenLength = tokenLength
+	}
+
+	// Warn about insecure configurations. Warnings go to the standard logger
+	// unless a Logger is set, so that they aren't discarded by default.
+	warnf := log.Printf
+	if cs.opts.Logger != nil {
+		warnf = cs.opts.Logger.Logf
+	}
 
-		if cs.opts.CookieName == "" {
-			cs.opts.CookieName = cookieName
+	if cs.opts.DevMode {
+		warnf("%sWARNING: DevMode is enabled. Cookies aren't Secure and localhost "+
+			"origins are trusted. Never use DevMode in production.", errorPrefix)
+	}
+
+	if cs.opts.DisableRefererCheck {
+		warnf("%sWARNING: the Origin/Referer check is disabled. Make sure the origin "+
+			"of HTTPS requests is checked before they reach the application.", errorPrefix)
+	}
+
+	// The session cookie of a server-side store only holds an ID, which
+	// scripts have no use for. DoubleSubmit hasn't set the store yet, and
+	// neither the cookie store nor HeaderOnly use a session ID.
+	switch cs.st.(type) {
+	case nil, *CookieStore, *headerStore:
+	default:
+		if !cs.opts.HttpOnly || !storeHttpOnly(cs.st) {
+			warnf("%sWARNING: HttpOnly is disabled with a server-side Store. Scripts "+
+				"can read the session cookie: use AngularCompat to expose the token "+
+				"to JavaScript instead.", errorPrefix)
 		}
+	}
+
+	if cs.opts.Logger == nil {
+		cs.opts.Logger = nopLogger{}
+	}
+
+	if cs.opts.MetaName == "" {
+		cs.opts.MetaName = metaName
+	}
+
+	if cs.opts.Encoding == nil {
+		cs.opts.Encoding = base64.StdEncoding
+	}
+
+	// Browsers reject 'SameSite=None' and partitioned cookies that aren't
+	// also Secure.
+	if cs.opts.SameSite == SameSiteNoneMode || cs.opts.Partitioned {
+		cs.opts.Secure = true
+	}
 
-		if cs.opts.RequestHeader == "" {
-			cs.opts.RequestHeader = headerName
+	// Create an authenticated securecookie instance.
+	if cs.sc == nil {
+		cs.sc = newSecureCookie(authKey, cs.opts.MaxAge)
+	}
+
+	// Previous keys are only used to verify existing cookies. They don't apply
+	// to a custom codec.
+	codec := cs.opts.Codec
+	var verify []CookieCodec
+	if codec == nil {
+		codec = secureCookieCodec{cs.sc}
+		for _, key := range cs.opts.VerificationKeys {
+			verify = append(verify, secureCookieCodec{newSecureCookie(key, cs.opts.MaxAge)})
 		}
+	}
 
-		// Create an authenticated securecookie instance.
-		if cs.sc == nil {
-			cs.sc = securecookie.New(authKey, nil)
-			// Use JSON serialization (faster than one-off gob encoding)
-			cs.sc.SetSerializer(securecookie.JSONEncoder{})
-			// Set the MaxAge of the underlying securecookie.
-			cs.sc.MaxAge(cs.opts.MaxAge)
+	// DoubleSubmit mode keeps the token in its own cookie, instead of the
+	// store.
+	if cs.opts.DoubleSubmit {
+		cs.opts.TokenTTL = 0
+		cs.ds = &doubleSubmitStore{
+			name:        cs.opts.CookieName,
+			maxAge:      cs.opts.MaxAge,
+			secure:      cs.opts.Secure,
+			path:        cs.opts.Path,
+			domain:      cs.opts.Domain,
+			sameSite:    cs.opts.SameSite,
+			partitioned: cs.opts.Partitioned,
+			key:         authKey,
+			encoding:    cs.opts.Encoding,
+			fallbacks:   cs.opts.FallbackCookieNames,
 		}
+		cs.st = cs.ds
+	}
+
+	if cs.st == nil {
+		// Encrypt the token within the cookie, if configured.
+		var aead cipher.AEAD
+		if cs.opts.EncryptionKey != nil {
+			block, err := aes.NewCipher(cs.opts.EncryptionKey)
+			if err != nil {
+				return nil, err
+			}
 
-		if cs.st == nil {
-			// Default to the cookieStore
-			cs.st = &cookieStore{
-				name:     cs.opts.CookieName,
-				maxAge:   cs.opts.MaxAge,
-				secure:   cs.opts.Secure,
-				httpOnly: cs.opts.HttpOnly,
-				path:     cs.opts.Path,
-				domain:   cs.opts.Domain,
-				sc:       cs.sc,
+			if aead, err = cipher.NewGCM(block); err != nil {
+				return nil, err
 			}
 		}
 
-		return *cs
+		// Default to the CookieStore
+		cs.st = &CookieStore{
+			name:        cs.opts.CookieName,
+			maxAge:      cs.opts.MaxAge,
+			secure:      cs.opts.Secure,
+			httpOnly:    cs.opts.HttpOnly,
+			path:        cs.opts.Path,
+			domain:      cs.opts.Domain,
+			sameSite:    cs.opts.SameSite,
+			partitioned: cs.opts.Partitioned,
+			codec:       codec,
+			verify:      verify,
+			aead:        aead,
+			fallbacks:   cs.opts.FallbackCookieNames,
+		}
+	}
+
+	if cs.opts.ReplayWindow > 0 {
+		cs.replays = newReplayCache(cs.opts.ReplayWindow, replayCacheSize)
+	}
+
+	// Cookie stores can't forget a token: the old cookie still carries it.
+	if cs.opts.SingleUse {
+		switch cs.st.(type) {
+		case *CookieStore, *doubleSubmitStore:
+			return nil, errors.New(errorPrefix + "SingleUse requires a server-side Store")
+		}
+
+		if _, ok := cs.st.(TokenClearer); !ok {
+			return nil, errors.New(errorPrefix + "SingleUse requires a Store that implements TokenClearer")
+		}
+	}
+
+	return cs, nil
+}
+
+// newSecureCookie returns a securecookie instance that authenticates cookies
+// with the given key.
+func newSecureCookie(authKey []byte, maxAge int) *securecookie.SecureCookie {
+	sc := securecookie.New(authKey, nil)
+	// Use JSON serialization (faster than one-off gob encoding)
+	sc.SetSerializer(securecookie.JSONEncoder{})
+	// Set the MaxAge of the underlying securecookie.
+	sc.MaxAge(maxAge)
+	// Leave the size limit to the cookie store, which checks the whole cookie.
+	sc.MaxLength(0)
+
+	return sc
+}
+
+// checkKey returns an error if the authentication key is too short to securely
+// sign cookies.
+func checkKey(authKey []byte) error {
+	if len(authKey) < minKeyLength {
+		return fmt.Errorf("%sauthentication key must be at least %d bytes: got %d",
+			errorPrefix, minKeyLength, len(authKey))
+	}
+
+	return nil
+}
+
+// checkHostPrefix returns an error if the cookie name has the "__Host-" prefix
+// but the cookie wouldn't meet the constraints browsers place on it.
+func checkHostPrefix(o options) error {
+	if !strings.HasPrefix(o.CookieName, hostPrefix) {
+		return nil
+	}
+
+	switch {
+	case !o.Secure:
+		return errors.New(errorPrefix + "__Host- cookies must be Secure")
+	case o.Domain != "":
+		return errors.New(errorPrefix + "__Host- cookies must not set a Domain")
+	case o.Path != "/":
+		return errors.New(errorPrefix + `__Host- cookies must have a Path of "/"`)
+	}
+
+	return nil
+}
+
+// checkStoreOptions returns an error if options that only apply to the default
+// cookie store are combined with another store, or DoubleSubmit or HeaderOnly
+// replace a configured store.
+func checkStoreOptions(st TokenStore, o options) error {
+	other := ""
+	switch {
+	case o.SessionHeader != "" && (st != nil || o.DoubleSubmit):
+		return errors.New(errorPrefix + "HeaderOnly doesn't use the Store or DoubleSubmit: supply one or the other")
+	case o.SessionHeader != "" && o.JSCookieName != "":
+		return errors.New(errorPrefix + "HeaderOnly doesn't use cookies, so can't be combined with AngularCompat")
+	case o.SessionHeader != "":
+		other = "HeaderOnly"
+	case o.DoubleSubmit && st != nil:
+		return errors.New(errorPrefix + "DoubleSubmit doesn't use the Store: supply one or the other")
+	case o.DoubleSubmit:
+		other = "DoubleSubmit"
+	case st != nil:
+		other = "a Store"
+	default:
+		return nil
+	}
+
+	switch {
+	case o.EncryptionKey != nil:
+		return errors.New(errorPrefix + "EncryptCookie only applies to the cookie store, not " + other)
+	case o.Codec != nil:
+		return errors.New(errorPrefix + "Codec only applies to the cookie store, not " + other)
+	}
+
+	return nil
+}
+
+// ProtectHTTP is the net/http equivalent of Protect, for use with the standard
+// library's http.ServeMux or any router built on http.Handler - e.g.
+//
+//	mux := http.NewServeMux()
+//	mux.HandleFunc("/signup", ShowSignupForm)
+//	http.ListenAndServe(":8000", csrf.ProtectHTTP([]byte("32-byte-long-authentication-key!"))(mux))
+//
+// Handlers retrieve the token with TokenFromRequest(r). The options are the
+// same as for Protect. ProtectHTTP can also be registered with a Goji Mux.Use,
+// where Goji handlers retrieve the token with Token(ctx, r) as usual. Note that
+// UnsafeSkipCheck must then be applied to r.Context() rather than the Goji
+// context, as Goji doesn't pass the latter to net/http middleware.
+func ProtectHTTP(authKey []byte, opts ...Option) func(http.Handler) http.Handler {
+	protect := Protect(authKey, opts...)
+
+	return func(h http.Handler) http.Handler {
+		cs := protect(goji.HandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			h.ServeHTTP(w, r.WithContext(ctx))
+		}))
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			cs.ServeHTTPC(r.Context(), w, r)
+		})
 	}
 }
 
 // Implements goji.Handler for the csrf type.
-func (cs csrf) ServeHTTPC(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-	// Skip the check if directed to. This should always be a bool.
+func (cs *csrf) ServeHTTPC(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	// Use the field name set by WithFieldName for this request, if any. The
+	// configuration is shared by all requests, so it is copied first.
+	if name, ok := ctx.Value(fieldNameKey).(string); ok && name != "" {
+		c := *cs
+		c.opts.FieldName = name
+		cs = &c
+	}
+
+	// Skip the check if directed to. This should always be a bool. No token is
+	// issued, but the configuration is made available to EnsureToken.
 	if skip, ok := ctx.Value(skipCheckKey).(bool); ok {
 		if skip {
-			cs.h.ServeHTTPC(ctx, w, r)
+			ctx = cs.withValue(ctx, tokenKey, &requestState{cs: cs, r: r, state: Exempt})
+			ctx = cs.withValue(ctx, formKey, cs.opts.FieldName)
+			cs.h.ServeHTTPC(ctx, w, r.WithContext(ctx))
 			return
 		}
 	}
@@ -193,88 +776,282 @@ func (cs csrf) ServeHTTPC(ctx context.Context, w http.ResponseWriter, r *http.Re
 	// Retrieve the token from the session.
 	// An error represents either a cookie that failed HMAC validation
 	// or that doesn't exist.
-	realToken, err := cs.st.Get(r)
-	if err != nil || len(realToken) != tokenLength {
+	realToken, expired, err := cs.getToken(r)
+	if err != nil && err != http.ErrNoCookie {
+		cs.opts.Logger.Logf("%sdiscarding unreadable session token for %s %s: %v",
+			errorPrefix, r.Method, r.URL.Path, err)
+	}
+	reissued := false
+	missing := missingToken(realToken, err)
+	if err != nil || expired || len(realToken) != cs.opts.TokenLength {
+		realToken = nil
+	}
+	if realToken == nil && cs.issues(r) {
 		// If there was an error retrieving the token, the token doesn't exist
-		// yet, or it's the wrong length, generate a new token.
+		// yet, has expired, or it's the wrong length, generate a new token.
 		// Note that the new token will (correctly) fail validation downstream
 		// as it will no longer match the request token.
-		realToken, err = generateRandomBytes(tokenLength)
+		realToken, err = cs.newToken()
 		if err != nil {
-			ctx = setEnvError(ctx, err)
-			cs.opts.ErrorHandler.ServeHTTPC(ctx, w, r)
+			cs.fail(ctx, w, r, err)
 			return
 		}
 
-		// Save the new (real) token in the session store.
-		err = cs.st.Save(realToken, w)
-		if err != nil {
-			ctx = setEnvError(ctx, err)
-			cs.opts.ErrorHandler.ServeHTTPC(ctx, w, r)
+		// Save the new (real) token in the session store. If the store is
+		// unavailable, the request may continue without a token.
+		if err = cs.saveToken(realToken, w, r); err == nil {
+			reissued = true
+		} else if cs.failOpen(r, err) {
+			cs.opts.Logger.Logf("%scontinuing without a token for %s %s: %v",
+				errorPrefix, r.Method, r.URL.Path, err)
+			realToken = nil
+		} else {
+			cs.fail(ctx, w, r, err)
 			return
 		}
 	}
 
 	// Save the masked token to the request context
-	ctx = context.WithValue(ctx, tokenKey, mask(realToken, r))
+	// The token is masked lazily: see maskedToken.
+	st := &requestState{cs: cs, r: r, realToken: realToken}
+	ctx = cs.withValue(ctx, tokenKey, st)
 	// Save the field name to the request context
-	ctx = context.WithValue(ctx, formKey, cs.opts.FieldName)
+	ctx = cs.withValue(ctx, formKey, cs.opts.FieldName)
+	// Make the context available via r.Context() for net/http handlers.
+	r = r.WithContext(ctx)
 
 	// HTTP methods not defined as idempotent ("safe") under RFC7231 require
-	// inspection.
-	if !contains(safeMethods, r.Method) {
+	// inspection, unless the request path has been exempted.
+	if cs.isExempt(r) {
+		st.state = Exempt
+	} else if contains(cs.opts.SafeMethods, r.Method) {
+		st.state = SafeMethod
+	} else {
+		// Reject cross-site requests reported by the browser, if configured.
+		if cs.opts.CheckFetchMetadata {
+			if err := cs.checkFetchSite(r); err != nil {
+				cs.fail(ctx, w, r, err)
+				return
+			}
+		}
+
 		// Enforce an origin check for HTTPS connections. As per the Django CSRF
 		// implementation (https://goo.gl/vKA7GE) the Referer header is almost
 		// always present for same-domain HTTP requests.
-		if r.URL.Scheme == "https" {
-			// Fetch the Referer value. Call the error handler if it's empty or
-			// otherwise fails to parse.
-			referer, err := url.Parse(r.Referer())
-			if err != nil || referer.String() == "" {
-				ctx = setEnvError(ctx, ErrNoReferer)
-				cs.opts.ErrorHandler.ServeHTTPC(ctx, w, r)
+		if u := cs.requestURL(r); u.Scheme == "https" {
+			if err := cs.checkOrigin(r, u); err != nil {
+				cs.fail(ctx, w, r, err)
 				return
 			}
+		}
 
-			if sameOrigin(r.URL, referer) == false {
-				ctx = setEnvError(ctx, ErrBadReferer)
-				cs.opts.ErrorHandler.ServeHTTPC(ctx, w, r)
-				return
+		// Reject content types that the application doesn't accept, if
+		// configured.
+		if cs.opts.ContentTypes != nil && !cs.allowedContentType(r) {
+			cs.fail(ctx, w, r, ErrBadContentType)
+			return
+		}
+
+		// Tokens older than the TokenTTL have been replaced above, but requests
+		// made with them must still fail.
+		if expired {
+			cs.fail(ctx, w, r, ErrTokenExpired)
+			return
+		}
+
+		// If the session had no token for non-idempotent ("unsafe") methods,
+		// call the error handler. The token generated above is never used to
+		// validate the request, so a request token can't be compared against
+		// a token the client was never issued.
+		if missing {
+			cs.fail(ctx, w, r, ErrNoToken)
+			return
+		}
+
+		// Limit how much of the body can be read to find the token.
+		var body *limitedBody
+		if cs.opts.MaxBodyBytes > 0 && r.Body != nil {
+			body = &limitedBody{
+				ReadCloser: http.MaxBytesReader(w, r.Body, cs.opts.MaxBodyBytes),
+				limit:      cs.opts.MaxBodyBytes,
 			}
+			r.Body = body
 		}
 
-		// If the token returned from the session store is nil for non-idempotent
-		// ("unsafe") methods, call the error handler.
-		if realToken == nil {
-			ctx = setEnvError(ctx, ErrNoToken)
-			cs.opts.ErrorHandler.ServeHTTPC(ctx, w, r)
+		// Retrieve the token (pad + masked token) sent in the request.
+		issued, err := cs.requestToken(r)
+		if body != nil && body.exceeded {
+			cs.fail(ctx, w, r, ErrBodyTooLarge)
+			return
+		}
+		if err != nil {
+			cs.fail(ctx, w, r, err)
 			return
 		}
 
-		// Retrieve the combined token (pad + masked) token and unmask it.
-		requestToken := unmask(cs.requestToken(r))
+		// Compare the request token against the real token.
+		if !cs.verifyToken(issued, realToken, r) {
+			cs.fail(ctx, w, r, ErrBadToken)
+			return
+		}
 
-		// Compare the request token against the real token
-		if !compareTokens(requestToken, realToken) {
-			ctx = setEnvError(ctx, ErrBadToken)
-			cs.opts.ErrorHandler.ServeHTTPC(ctx, w, r)
+		// Reject a second request for the session within the replay window.
+		// The real token is used rather than the token sent, as anyone
+		// holding a masked token can re-mask it.
+		if cs.replays != nil && cs.replays.seen(realToken, time.Now()) {
+			cs.fail(ctx, w, r, ErrTokenReplayed)
 			return
 		}
 
+		st.state = Validated
+
+		// Replace the token once it has been used, so that it can't be
+		// replayed. The session cookie is overwritten by saveToken, so only
+		// the stored token is cleared.
+		if cs.opts.SingleUse {
+			if err := cs.st.(TokenClearer).Clear(discardWriter{}, r); err != nil {
+				cs.fail(ctx, w, r, storeError{err})
+				return
+			}
+
+			realToken, err = cs.newToken()
+			if err != nil {
+				cs.fail(ctx, w, r, err)
+				return
+			}
+
+			if err := cs.saveToken(realToken, w, r); err != nil {
+				cs.fail(ctx, w, r, err)
+				return
+			}
+
+			st.realToken, st.token = realToken, ""
+			reissued = true
+		}
+	}
+
+	// Refresh the cookie's lifetime, if configured. The token is still valid
+	// if this fails, so the request continues.
+	if cs.opts.SlidingExpiry && !reissued && realToken != nil {
+		if err := cs.refreshToken(realToken, w, r); err != nil {
+			cs.opts.Logger.Logf("%scouldn't refresh the session token for %s %s: %v",
+				errorPrefix, r.Method, r.URL.Path, err)
+		} else {
+			reissued = true
+		}
 	}
 
 	// Set the Vary: Cookie header to protect clients from caching the response.
-	w.Header().Add("Vary", "Cookie")
+	if cs.opts.VaryCookie {
+		addVary(w.Header(), "Cookie")
+	}
+
+	// Expose the masked token to JavaScript clients, if configured. The
+	// existing cookie is kept if it is still valid and NoReissueIfPresent is
+	// set.
+	if cs.opts.JSCookieName != "" && realToken != nil {
+		if reissued || !cs.opts.NoReissueIfPresent || !cs.validJSCookie(r, realToken) {
+			cs.setJSCookie(w, Token(ctx, r))
+		}
+	}
+
+	// Send the masked token in a response header on safe requests, so that
+	// clients can bootstrap from the first GET. This must happen before the
+	// handler writes the response.
+	// A replacement SingleUse token is sent on unsafe requests too.
+	if cs.opts.ResponseHeader != "" && realToken != nil && (contains(cs.opts.SafeMethods, r.Method) ||
+		cs.opts.SingleUse && st.state == Validated) {
+		w.Header().Set(cs.opts.ResponseHeader, Token(ctx, r))
+	}
 
 	// Call the wrapped handler/router on success
 	cs.h.ServeHTTPC(ctx, w, r)
 }
 
-// unauthorizedhandler sets a HTTP 403 Forbidden status and writes the
-// CSRF failure reason to the response.
+// withValue returns a request context with the value stored under key. Named
+// instances (see the Name option) also store the value under a key of their
+// own, so that it isn't replaced by a nested instance.
+func (cs *csrf) withValue(ctx context.Context, key string, val interface{}) context.Context {
+	ctx = context.WithValue(ctx, key, val)
+	if cs.opts.Name != "" {
+		ctx = context.WithValue(ctx, instanceKey{cs.opts.Name, key}, val)
+	}
+
+	return ctx
+}
+
+// fail calls the OnFailure callback and Tracer (if set) and then the error
+// handler, with the failure reason stored in the request context.
+func (cs *csrf) fail(ctx context.Context, w http.ResponseWriter, r *http.Request, err error) {
+	cs.opts.Logger.Logf("%srejected %s %s: %v", errorPrefix, r.Method, r.URL.Path, err)
+
+	if cs.opts.OnFailure != nil {
+		cs.opts.OnFailure(r, err)
+	}
+
+	if cs.opts.Tracer != nil {
+		cs.opts.Tracer.RecordFailure(ctx, err)
+	}
+
+	ctx = cs.withValue(ctx, errorKey, err)
+	cs.opts.ErrorHandler.ServeHTTPC(ctx, w, r)
+}
+
+// unauthorizedhandler sets a HTTP 403 Forbidden status (or 413 Request Entity
+// Too Large for ErrBodyTooLarge, 415 Unsupported Media Type for
+// ErrBadContentType, and 500 Internal Server Error for ErrStoreFailure) and
+// writes the CSRF failure reason to the response.
 func unauthorizedHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-	http.Error(w, fmt.Sprintf("%s - %s",
-		http.StatusText(http.StatusForbidden), FailureReason(ctx, r)),
-		http.StatusForbidden)
-	return
+	switch FailureReason(ctx, r) {
+	case ErrBodyTooLarge:
+		statusHandler(http.StatusRequestEntityTooLarge)(ctx, w, r)
+		return
+	case ErrBadContentType:
+		statusHandler(http.StatusUnsupportedMediaType)(ctx, w, r)
+		return
+	}
+
+	statusHandler(http.StatusForbidden)(ctx, w, r)
+}
+
+// statusHandler returns an error handler that sets the given status and writes
+// the CSRF failure reason to the response. Store failures are a server error,
+// so they are always served as a HTTP 500 Internal Server Error.
+func statusHandler(status int) goji.HandlerFunc {
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		reason := FailureReason(ctx, r)
+		// Don't reveal the store's error, which may describe the backend.
+		if errors.Is(reason, ErrStoreFailure) {
+			status, reason = http.StatusInternalServerError, ErrStoreFailure
+		}
+
+		http.Error(w, fmt.Sprintf("%s - %s",
+			http.StatusText(status), reason),
+			status)
+	}
+}
+
+// bodyHandler returns an error handler that writes the given body and content
+// type (see FailureBody). The status is the given one if set, and otherwise
+// chosen as by unauthorizedHandler; store failures are always a HTTP 500.
+func bodyHandler(status int, body, contentType string) goji.HandlerFunc {
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		code := status
+		switch reason := FailureReason(ctx, r); {
+		case errors.Is(reason, ErrStoreFailure):
+			code = http.StatusInternalServerError
+		case code != 0:
+		case reason == ErrBodyTooLarge:
+			code = http.StatusRequestEntityTooLarge
+		case reason == ErrBadContentType:
+			code = http.StatusUnsupportedMediaType
+		default:
+			code = http.StatusForbidden
+		}
+
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(code)
+		io.WriteString(w, body)
+	}
 }
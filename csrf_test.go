@@ -1,10 +1,19 @@
 package csrf
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"goji.io/pat"
 
@@ -41,6 +50,116 @@ func TestProtect(t *testing.T) {
 	}
 }
 
+// TestProtectKey tests that Protect refuses keys that are too short.
+func TestProtectKey(t *testing.T) {
+	var keyTests = []struct {
+		key    []byte
+		panics bool
+	}{
+		{nil, true},
+		{[]byte{}, true},
+		{[]byte("short-key"), true},
+		{testKey[:minKeyLength-1], true},
+		{testKey, false},
+		{append(testKey, "-and-then-some"...), false},
+	}
+
+	for _, v := range keyTests {
+		func() {
+			defer func() {
+				if r := recover(); (r != nil) != v.panics {
+					t.Errorf("Protect with a %d byte key: got panic %v want panic %v",
+						len(v.key), r, v.panics)
+				}
+			}()
+
+			Protect(v.key)
+		}()
+	}
+}
+
+// TestProtectE tests that construction errors are returned rather than
+// panicking, and that a valid configuration returns working middleware.
+func TestProtectE(t *testing.T) {
+	if _, err := ProtectE([]byte("short-key")); err == nil {
+		t.Error("ProtectE accepted a short key")
+	}
+
+	if _, err := ProtectE(testKey, CookieName("bad name")); err == nil {
+		t.Error("ProtectE accepted an invalid option")
+	}
+
+	protect, err := ProtectE(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := http.NewRequest("POST", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	protect(testHandler).ServeHTTPC(context.Background(), rr, r)
+
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("ProtectE middleware did not reject a request without a token: got %v want %v",
+			rr.Code, http.StatusForbidden)
+	}
+}
+
+// TestProtectHTTP tests the net/http middleware with a plain http.Handler.
+func TestProtectHTTP(t *testing.T) {
+	var token string
+	h := ProtectHTTP(testKey)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token = TokenFromRequest(r)
+	}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, r)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("middleware failed to pass to the next handler: got %v want %v",
+			rr.Code, http.StatusOK)
+	}
+
+	if token == "" {
+		t.Fatal("token not available from the request context")
+	}
+
+	// A POST without the token should fail...
+	r, err = http.NewRequest("POST", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setCookie(rr, r)
+
+	rr2 := httptest.NewRecorder()
+	h.ServeHTTP(rr2, r)
+
+	if rr2.Code != http.StatusForbidden {
+		t.Fatalf("middleware accepted a request without a token: got %v want %v",
+			rr2.Code, http.StatusForbidden)
+	}
+
+	// ... and one with the token should pass.
+	r.Header.Set("X-CSRF-Token", token)
+
+	rr2 = httptest.NewRecorder()
+	h.ServeHTTP(rr2, r)
+
+	if rr2.Code != http.StatusOK {
+		t.Fatalf("middleware rejected a valid token: got %v want %v",
+			rr2.Code, http.StatusOK)
+	}
+}
+
 // Test that idempotent methods return a 200 OK status and that non-idempotent
 // methods return a 403 Forbidden status when a CSRF cookie is not present.
 func TestMethods(t *testing.T) {
@@ -91,6 +210,43 @@ func TestMethods(t *testing.T) {
 
 }
 
+// TestSafeMethods tests that a custom set of safe methods replaces the
+// default set.
+func TestSafeMethods(t *testing.T) {
+	m := goji.NewMux()
+	m.UseC(Protect(testKey, SafeMethods("get", "PROPFIND")))
+	m.HandleFuncC(pat.New("/"), testHandler)
+
+	var methodTests = []struct {
+		method   string
+		expected int
+	}{
+		{"GET", http.StatusOK},
+		{"PROPFIND", http.StatusOK},
+		{"TRACE", http.StatusForbidden},
+		{"POST", http.StatusForbidden},
+	}
+
+	for _, v := range methodTests {
+		r, err := http.NewRequest(v.method, "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		m.ServeHTTP(rr, r)
+
+		if rr.Code != v.expected {
+			t.Errorf("safe method check failed for %s: got %v want %v",
+				v.method, rr.Code, v.expected)
+		}
+
+		if rr.Header().Get("Set-Cookie") == "" {
+			t.Errorf("cookie not set for %s", v.method)
+		}
+	}
+}
+
 // TestBadCookie tests for failure when a cookie header is modified (malformed).
 func TestBadCookie(t *testing.T) {
 	m := goji.NewMux()
@@ -153,37 +309,38 @@ func TestErrorHandler(t *testing.T) {
 	}
 }
 
-// Responses should set a "Vary: Cookie" header to protect client/proxy caching.
-func TestVaryHeader(t *testing.T) {
+// TestOnFailure tests that the failure callback receives the failure reason
+// before the error handler is called.
+func TestOnFailure(t *testing.T) {
+	var reasons []error
+	onFailure := func(r *http.Request, reason error) {
+		reasons = append(reasons, reason)
+	}
+
+	errorHandler := goji.HandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		if len(reasons) != 1 {
+			t.Errorf("failure callback not called before the error handler")
+		}
+		http.Error(w, "", http.StatusForbidden)
+	})
+
 	m := goji.NewMux()
-	m.UseC(Protect(testKey))
-	m.HandleFuncC(pat.Get("/"), testHandler)
+	m.UseC(Protect(testKey, OnFailure(onFailure), ErrorHandler(errorHandler)))
+	m.HandleFuncC(pat.New("/"), testHandler)
 
-	r, err := http.NewRequest("HEAD", "https://www.golang.org/", nil)
+	// Safe requests shouldn't trigger the callback.
+	r, err := http.NewRequest("GET", "/", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	rr := httptest.NewRecorder()
-	m.ServeHTTP(rr, r)
-
-	if rr.Code != http.StatusOK {
-		t.Fatalf("middleware failed to pass to the next handler: got %v want %v",
-			rr.Code, http.StatusOK)
-	}
+	m.ServeHTTP(httptest.NewRecorder(), r)
 
-	if rr.Header().Get("Vary") != "Cookie" {
-		t.Fatalf("vary header not set: got %q want %q", rr.Header().Get("Vary"), "Cookie")
+	if len(reasons) != 0 {
+		t.Fatalf("failure callback called for a safe request: got %v", reasons)
 	}
-}
-
-// Requests with no Referer header should fail.
-func TestNoReferer(t *testing.T) {
-	m := goji.NewMux()
-	m.UseC(Protect(testKey))
-	m.HandleFuncC(pat.Get("/"), testHandler)
 
-	r, err := http.NewRequest("POST", "https://golang.org/", nil)
+	r, err = http.NewRequest("POST", "/", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -192,23 +349,31 @@ func TestNoReferer(t *testing.T) {
 	m.ServeHTTP(rr, r)
 
 	if rr.Code != http.StatusForbidden {
-		t.Fatalf("middleware failed to pass to the next handler: got %v want %v",
-			rr.Code, http.StatusForbidden)
+		t.Fatalf("error handler not called: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+
+	if len(reasons) != 1 || reasons[0] != ErrNoToken {
+		t.Fatalf("failure callback got the wrong reason: got %v want %v", reasons, ErrNoToken)
 	}
 }
 
-// TestBadReferer checks that HTTPS requests with a Referer that does not
-// match the request URL correctly fail CSRF validation.
-func TestBadReferer(t *testing.T) {
+// TestFailureReasons tests that each validation failure is reported through
+// FailureReason as the matching error value.
+func TestFailureReasons(t *testing.T) {
+	var reason error
+	errorHandler := goji.HandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		reason = FailureReason(ctx, r)
+		http.Error(w, "", http.StatusForbidden)
+	})
+
 	m := goji.NewMux()
-	m.UseC(Protect(testKey))
+	m.UseC(Protect(testKey, ErrorHandler(errorHandler)))
 
 	var token string
 	m.HandleFuncC(pat.New("/"), func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 		token = Token(ctx, r)
 	})
 
-	// Obtain a CSRF cookie via a GET request.
 	r, err := http.NewRequest("GET", "https://www.gorillatoolkit.org/", nil)
 	if err != nil {
 		t.Fatal(err)
@@ -217,39 +382,248 @@ func TestBadReferer(t *testing.T) {
 	rr := httptest.NewRecorder()
 	m.ServeHTTP(rr, r)
 
-	// POST the token back in the header.
-	r, err = http.NewRequest("POST", "https://www.gorillatoolkit.org/", nil)
+	// A valid token for a different session.
+	cs, err := newCSRF(testKey)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	setCookie(rr, r)
-	r.Header.Set("X-CSRF-Token", token)
+	other, err := generateRandomBytes(tokenLength)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	// Set a non-matching Referer header.
-	r.Header.Set("Referer", "http://goji.io")
+	var reasonTests = []struct {
+		name     string
+		headers  map[string]string
+		expected error
+	}{
+		{"no origin", map[string]string{"X-CSRF-Token": token}, ErrNoOrigin},
+		{"bad origin", map[string]string{"X-CSRF-Token": token, "Origin": "https://goji.io"}, ErrBadOrigin},
+		{"bad referer", map[string]string{"X-CSRF-Token": token, "Referer": "https://goji.io/"}, ErrBadReferer},
+		{"no token", map[string]string{"Referer": "https://www.gorillatoolkit.org/"}, ErrNoToken},
+		{"malformed token", map[string]string{"X-CSRF-Token": "%%%", "Referer": "https://www.gorillatoolkit.org/"}, ErrBadToken},
+		{"wrong token", map[string]string{"X-CSRF-Token": cs.issueToken(other, r), "Referer": "https://www.gorillatoolkit.org/"}, ErrBadToken},
+		{"valid", map[string]string{"X-CSRF-Token": token, "Referer": "https://www.gorillatoolkit.org/"}, nil},
+	}
 
-	rr = httptest.NewRecorder()
-	m.ServeHTTP(rr, r)
+	for _, v := range reasonTests {
+		reason = nil
 
-	if rr.Code != http.StatusForbidden {
-		t.Fatalf("middleware failed to pass to the next handler: got %v want %v",
-			rr.Code, http.StatusForbidden)
+		r, err := http.NewRequest("POST", "https://www.gorillatoolkit.org/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		setCookie(rr, r)
+		for k, val := range v.headers {
+			r.Header.Set(k, val)
+		}
+
+		m.ServeHTTP(httptest.NewRecorder(), r)
+
+		if !errors.Is(reason, v.expected) {
+			t.Errorf("%s: got %v want %v", v.name, reason, v.expected)
+		}
 	}
 }
 
-// Requests with a valid Referer should pass.
-func TestWithReferer(t *testing.T) {
+// TestHeaderTokenWithoutCookie tests that a request with a token in its header
+// but no session cookie - e.g. because cookies are blocked - is rejected with
+// ErrNoToken, rather than validated against a newly generated token.
+func TestHeaderTokenWithoutCookie(t *testing.T) {
+	ms := NewMemoryStore()
+	defer ms.Close()
+
+	for _, opts := range [][]Option{nil, {DoubleSubmit()}, {Store(ms)}} {
+		var reason error
+		var token string
+		s := Protect(testKey, append(opts, ErrorHandler(goji.HandlerFunc(
+			func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+				reason = FailureReason(ctx, r)
+				http.Error(w, "", http.StatusForbidden)
+			})))...)(goji.HandlerFunc(
+			func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+				token = Token(ctx, r)
+			}))
+
+		r, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s.ServeHTTPC(context.Background(), httptest.NewRecorder(), r)
+
+		r, err = http.NewRequest("POST", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("X-CSRF-Token", token)
+
+		rr := httptest.NewRecorder()
+		s.ServeHTTPC(context.Background(), rr, r)
+
+		if rr.Code != http.StatusForbidden || reason != ErrNoToken {
+			t.Errorf("%d options: got %v, %v want %v, %v",
+				len(opts), rr.Code, reason, http.StatusForbidden, ErrNoToken)
+		}
+	}
+}
+
+// TestErrorHandlerHTTP tests that a plain http.Handler can read the failure
+// reason from the request context, and that the last error handler option
+// wins.
+func TestErrorHandlerHTTP(t *testing.T) {
+	var reason error
+	errorHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reason = FailureReasonFromRequest(r)
+		http.Error(w, "", http.StatusTeapot)
+	})
+	other := goji.HandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "", http.StatusConflict)
+	})
+
+	var handlerTests = []struct {
+		opts     []Option
+		expected int
+	}{
+		{[]Option{ErrorHandlerHTTP(errorHandler)}, http.StatusTeapot},
+		{[]Option{ErrorHandler(other), ErrorHandlerHTTP(errorHandler)}, http.StatusTeapot},
+		{[]Option{ErrorHandlerHTTP(errorHandler), ErrorHandler(other)}, http.StatusConflict},
+	}
+
+	for i, v := range handlerTests {
+		reason = nil
+
+		r, err := http.NewRequest("POST", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		Protect(testKey, v.opts...)(testHandler).ServeHTTPC(context.Background(), rr, r)
+
+		if rr.Code != v.expected {
+			t.Errorf("test %d: got %v want %v", i, rr.Code, v.expected)
+		}
+
+		if v.expected == http.StatusTeapot && reason != ErrNoToken {
+			t.Errorf("test %d: reason not available from the request: got %v want %v", i, reason, ErrNoToken)
+		}
+	}
+}
+
+// TestErrorHandlerFunc tests that the failure reason is passed to the error
+// handler function, and that the last error handler option wins.
+func TestErrorHandlerFunc(t *testing.T) {
+	var reason error
+	errorHandlerFunc := func(w http.ResponseWriter, r *http.Request, err error) {
+		reason = err
+		http.Error(w, "", http.StatusTeapot)
+	}
+	errorHandler := goji.HandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "", http.StatusConflict)
+	})
+
+	var handlerTests = []struct {
+		opts     []Option
+		expected int
+	}{
+		{[]Option{ErrorHandlerFunc(errorHandlerFunc)}, http.StatusTeapot},
+		{[]Option{ErrorHandler(errorHandler), ErrorHandlerFunc(errorHandlerFunc)}, http.StatusTeapot},
+		{[]Option{ErrorHandlerFunc(errorHandlerFunc), ErrorHandler(errorHandler)}, http.StatusConflict},
+		{nil, http.StatusForbidden},
+	}
+
+	for i, v := range handlerTests {
+		reason = nil
+
+		m := goji.NewMux()
+		m.UseC(Protect(testKey, v.opts...))
+
+		r, err := http.NewRequest("POST", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		m.ServeHTTP(rr, r)
+
+		if rr.Code != v.expected {
+			t.Errorf("test %d: wrong error handler called: got %v want %v", i, rr.Code, v.expected)
+		}
+
+		if v.expected == http.StatusTeapot && reason != ErrNoToken {
+			t.Errorf("test %d: reason not passed to the handler: got %v want %v", i, reason, ErrNoToken)
+		}
+	}
+}
+
+// Responses should set a "Vary: Cookie" header to protect client/proxy caching.
+func TestVaryHeader(t *testing.T) {
 	m := goji.NewMux()
 	m.UseC(Protect(testKey))
+	m.HandleFuncC(pat.Get("/"), testHandler)
+
+	r, err := http.NewRequest("HEAD", "https://www.golang.org/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	m.ServeHTTP(rr, r)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("middleware failed to pass to the next handler: got %v want %v",
+			rr.Code, http.StatusOK)
+	}
+
+	if rr.Header().Get("Vary") != "Cookie" {
+		t.Fatalf("vary header not set: got %q want %q", rr.Header().Get("Vary"), "Cookie")
+	}
+}
+
+// TestVaryCookie tests that Cookie is added to an existing Vary header without
+// replacing it or being duplicated, and that SetVaryCookie(false) disables it.
+func TestVaryCookie(t *testing.T) {
+	var varyTests = []struct {
+		name     string
+		opts     []Option
+		existing []string
+		expected []string
+	}{
+		{"existing", nil, []string{"Accept-Encoding"}, []string{"Accept-Encoding", "Cookie"}},
+		{"already listed", nil, []string{"Accept-Encoding, cookie"}, []string{"Accept-Encoding, cookie"}},
+		{"wildcard", nil, []string{"*"}, []string{"*"}},
+		{"disabled", []Option{SetVaryCookie(false)}, nil, nil},
+	}
 
+	for _, v := range varyTests {
+		r, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		rr.Header()["Vary"] = v.existing
+		Protect(testKey, v.opts...)(testHandler).ServeHTTPC(context.Background(), rr, r)
+
+		if got := rr.Header()["Vary"]; !reflect.DeepEqual(got, v.expected) {
+			t.Errorf("%s: got %q want %q", v.name, got, v.expected)
+		}
+	}
+}
+
+// HEAD requests should be issued a token, the same as GET.
+func TestHeadRequest(t *testing.T) {
 	var token string
+	m := goji.NewMux()
+	m.UseC(Protect(testKey))
 	m.HandleFuncC(pat.New("/"), func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 		token = Token(ctx, r)
 	})
 
-	// Obtain a CSRF cookie via a GET request.
-	r, err := http.NewRequest("GET", "http://www.gorillatoolkit.org/", nil)
+	r, err := http.NewRequest("HEAD", "https://www.golang.org/", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -257,32 +631,1986 @@ func TestWithReferer(t *testing.T) {
 	rr := httptest.NewRecorder()
 	m.ServeHTTP(rr, r)
 
-	// POST the token back in the header.
-	r, err = http.NewRequest("POST", "http://www.gorillatoolkit.org/", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("middleware failed to pass to the next handler: got %v want %v",
+			rr.Code, http.StatusOK)
+	}
+
+	if rr.Header().Get("Set-Cookie") == "" {
+		t.Fatal("cookie not set on a HEAD request")
+	}
+
+	if token == "" {
+		t.Fatal("token not set in the context on a HEAD request")
+	}
+
+	if rr.Body.Len() != 0 {
+		t.Fatalf("body written in response to a HEAD request: %q", rr.Body.String())
+	}
+
+	// The token issued on HEAD should validate a subsequent request.
+	r, err = http.NewRequest("POST", "https://www.golang.org/", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	setCookie(rr, r)
 	r.Header.Set("X-CSRF-Token", token)
-	r.Header.Set("Referer", "http://www.gorillatoolkit.org/")
+	r.Header.Set("Referer", "https://www.golang.org/")
 
 	rr = httptest.NewRecorder()
 	m.ServeHTTP(rr, r)
 
 	if rr.Code != http.StatusOK {
-		t.Fatalf("middleware failed to pass to the next handler: got %v want %v",
+		t.Fatalf("token issued on HEAD did not validate: got %v want %v",
 			rr.Code, http.StatusOK)
 	}
 }
 
-// TestFormField tests that a token in the form field takes precedence over a
+// Requests with no Referer header should fail.
+func TestNoReferer(t *testing.T) {
+	m := goji.NewMux()
+	m.UseC(Protect(testKey))
+	m.HandleFuncC(pat.Get("/"), testHandler)
+
+	r, err := http.NewRequest("POST", "https://golang.org/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	m.ServeHTTP(rr, r)
+
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("middleware failed to pass to the next handler: got %v want %v",
+			rr.Code, http.StatusForbidden)
+	}
+}
+
+// TestBadReferer checks that HTTPS requests with a Referer that does not
+// match the request URL correctly fail CSRF validation.
+func TestBadReferer(t *testing.T) {
+	m := goji.NewMux()
+	m.UseC(Protect(testKey))
+
+	var token string
+	m.HandleFuncC(pat.New("/"), func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		token = Token(ctx, r)
+	})
+
+	// Obtain a CSRF cookie via a GET request.
+	r, err := http.NewRequest("GET", "https://www.gorillatoolkit.org/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	m.ServeHTTP(rr, r)
+
+	// POST the token back in the header.
+	r, err = http.NewRequest("POST", "https://www.gorillatoolkit.org/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setCookie(rr, r)
+	r.Header.Set("X-CSRF-Token", token)
+
+	// Set a non-matching Referer header.
+	r.Header.Set("Referer", "http://goji.io")
+
+	rr = httptest.NewRecorder()
+	m.ServeHTTP(rr, r)
+
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("middleware failed to pass to the next handler: got %v want %v",
+			rr.Code, http.StatusForbidden)
+	}
+}
+
+// Requests with a non-matching Referer should pass when the check is disabled,
+// but still require a valid token.
+func TestDisableRefererCheck(t *testing.T) {
+	var warnings []string
+	logger := LoggerFunc(func(format string, args ...interface{}) {
+		warnings = append(warnings, fmt.Sprintf(format, args...))
+	})
+
+	var token string
+	s := Protect(testKey, DisableRefererCheck(), Logger(logger))(goji.HandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		token = Token(ctx, r)
+	}))
+
+	if len(warnings) != 1 {
+		t.Fatalf("warning not logged: got %q", warnings)
+	}
+
+	r, err := http.NewRequest("GET", "https://www.gorillatoolkit.org/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTPC(context.Background(), rr, r)
+
+	var refererTests = []struct {
+		token    string
+		expected int
+	}{
+		{token, http.StatusOK},
+		{"", http.StatusForbidden},
+	}
+
+	for _, v := range refererTests {
+		r, err := http.NewRequest("POST", "https://www.gorillatoolkit.org/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		setCookie(rr, r)
+		r.Header.Set("X-CSRF-Token", v.token)
+		r.Header.Set("Referer", "https://evil.example.com/")
+
+		rr2 := httptest.NewRecorder()
+		s.ServeHTTPC(context.Background(), rr2, r)
+
+		if rr2.Code != v.expected {
+			t.Errorf("token %q: got %v want %v", v.token, rr2.Code, v.expected)
+		}
+	}
+}
+
+// Requests with a valid Referer should pass.
+func TestWithReferer(t *testing.T) {
+	m := goji.NewMux()
+	m.UseC(Protect(testKey))
+
+	var token string
+	m.HandleFuncC(pat.New("/"), func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		token = Token(ctx, r)
+	})
+
+	// Obtain a CSRF cookie via a GET request.
+	r, err := http.NewRequest("GET", "http://www.gorillatoolkit.org/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	m.ServeHTTP(rr, r)
+
+	// POST the token back in the header.
+	r, err = http.NewRequest("POST", "http://www.gorillatoolkit.org/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setCookie(rr, r)
+	r.Header.Set("X-CSRF-Token", token)
+	r.Header.Set("Referer", "http://www.gorillatoolkit.org/")
+
+	rr = httptest.NewRecorder()
+	m.ServeHTTP(rr, r)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("middleware failed to pass to the next handler: got %v want %v",
+			rr.Code, http.StatusOK)
+	}
+}
+
+// TestExemptPaths tests that requests to exempt paths skip validation but are
+// still issued a token, and that other paths are still protected.
+func TestExemptPaths(t *testing.T) {
+	m := goji.NewMux()
+	m.UseC(Protect(testKey, ExemptPath("/health"), ExemptGlob("/webhooks/*")))
+	m.HandleFuncC(pat.New("/*"), testHandler)
+
+	var exemptTests = []struct {
+		path     string
+		expected int
+	}{
+		{"/health", http.StatusOK},
+		{"/webhooks/stripe", http.StatusOK},
+		{"/webhooks/stripe/events", http.StatusForbidden},
+		{"/health/db", http.StatusForbidden},
+		{"/signup", http.StatusForbidden},
+	}
+
+	for _, v := range exemptTests {
+		r, err := http.NewRequest("POST", v.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		m.ServeHTTP(rr, r)
+
+		if rr.Code != v.expected {
+			t.Errorf("exempt path check failed for %q: got %v want %v",
+				v.path, rr.Code, v.expected)
+		}
+
+		if rr.Header().Get("Set-Cookie") == "" {
+			t.Errorf("cookie not set for %q", v.path)
+		}
+	}
+}
+
+// TestSkip tests that requests matching a Skip predicate bypass validation but
+// are still issued a token.
+func TestSkip(t *testing.T) {
+	internal := func(r *http.Request) bool {
+		return r.Header.Get("X-Internal-Service") == "billing"
+	}
+
+	m := goji.NewMux()
+	m.UseC(Protect(testKey, Skip(internal)))
+	m.HandleFuncC(pat.New("/"), testHandler)
+
+	var skipTests = []struct {
+		service  string
+		expected int
+	}{
+		{"billing", http.StatusOK},
+		{"other", http.StatusForbidden},
+		{"", http.StatusForbidden},
+	}
+
+	for _, v := range skipTests {
+		r, err := http.NewRequest("POST", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("X-Internal-Service", v.service)
+
+		rr := httptest.NewRecorder()
+		m.ServeHTTP(rr, r)
+
+		if rr.Code != v.expected {
+			t.Errorf("skip check failed for %q: got %v want %v", v.service, rr.Code, v.expected)
+		}
+
+		if rr.Header().Get("Set-Cookie") == "" {
+			t.Errorf("cookie not set for %q", v.service)
+		}
+	}
+}
+
+// TestTokenLength tests that a custom token length is used for the issued
+// token and enforced on validation.
+func TestTokenLength(t *testing.T) {
+	length := 48
+
+	m := goji.NewMux()
+	m.UseC(Protect(testKey, TokenLength(length)))
+
+	var token string
+	m.HandleFuncC(pat.New("/"), func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		token = Token(ctx, r)
+	})
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	m.ServeHTTP(rr, r)
+
+	decoded, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(decoded) != length*2 {
+		t.Fatalf("token length invalid: got %v want %v", len(decoded), length*2)
+	}
+
+	// A valid token should pass.
+	r, err = http.NewRequest("POST", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setCookie(rr, r)
+	r.Header.Set("X-CSRF-Token", token)
+
+	rr2 := httptest.NewRecorder()
+	m.ServeHTTP(rr2, r)
+
+	if rr2.Code != http.StatusOK {
+		t.Fatalf("middleware rejected a valid token: got %v want %v",
+			rr2.Code, http.StatusOK)
+	}
+
+	// A token of the default length should fail.
+	otp, err := generateRandomBytes(tokenLength * 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err = http.NewRequest("POST", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setCookie(rr, r)
+	r.Header.Set("X-CSRF-Token", base64.StdEncoding.EncodeToString(otp))
+
+	rr2 = httptest.NewRecorder()
+	m.ServeHTTP(rr2, r)
+
+	if rr2.Code != http.StatusForbidden {
+		t.Fatalf("middleware accepted a token of the wrong length: got %v want %v",
+			rr2.Code, http.StatusForbidden)
+	}
+}
+
+// TestTrustedOrigins checks that HTTPS requests from a trusted origin pass the
+// origin check, and that unknown origins are still rejected.
+func TestTrustedOrigins(t *testing.T) {
+	m := goji.NewMux()
+	m.UseC(Protect(testKey, TrustedOrigins([]string{"https://app.gorillatoolkit.org"})))
+
+	var token string
+	m.HandleFuncC(pat.New("/"), func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		token = Token(ctx, r)
+	})
+
+	// Obtain a CSRF cookie via a GET request.
+	r, err := http.NewRequest("GET", "https://www.gorillatoolkit.org/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	m.ServeHTTP(rr, r)
+
+	var originTests = []struct {
+		header   string
+		value    string
+		expected int
+	}{
+		{"Origin", "https://app.gorillatoolkit.org", http.StatusOK},
+		{"Referer", "https://app.gorillatoolkit.org/login", http.StatusOK},
+		{"Origin", "https://www.gorillatoolkit.org", http.StatusOK},
+		{"Origin", "http://app.gorillatoolkit.org", http.StatusForbidden},
+		{"Origin", "https://evil.example.com", http.StatusForbidden},
+		{"Referer", "https://evil.example.com/", http.StatusForbidden},
+	}
+
+	for _, v := range originTests {
+		r, err := http.NewRequest("POST", "https://www.gorillatoolkit.org/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		setCookie(rr, r)
+		r.Header.Set("X-CSRF-Token", token)
+		r.Header.Set(v.header, v.value)
+
+		rr2 := httptest.NewRecorder()
+		m.ServeHTTP(rr2, r)
+
+		if rr2.Code != v.expected {
+			t.Errorf("origin check failed for %s %q: got %v want %v",
+				v.header, v.value, rr2.Code, v.expected)
+		}
+	}
+}
+
+// Cross-origin fetch requests send an Origin header but no Referer, which
+// should be enough to pass the origin check for a trusted origin.
+func TestTrustedOriginWithoutReferer(t *testing.T) {
+	var token string
+	var reason error
+	s := Protect(testKey, TrustedOrigins([]string{"https://app.example.com"}),
+		ErrorHandlerFunc(func(w http.ResponseWriter, r *http.Request, err error) {
+			reason = err
+			w.WriteHeader(http.StatusForbidden)
+		}))(goji.HandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		token = Token(ctx, r)
+	}))
+
+	r, err := http.NewRequest("GET", "https://api.example.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTPC(context.Background(), rr, r)
+
+	var originTests = []struct {
+		origin   string
+		expected int
+		reason   error
+	}{
+		{"https://app.example.com", http.StatusOK, nil},
+		{"https://evil.example.com", http.StatusForbidden, ErrBadOrigin},
+		{"null", http.StatusForbidden, ErrBadOrigin},
+	}
+
+	for _, v := range originTests {
+		r, err := http.NewRequest("POST", "https://api.example.com/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		setCookie(rr, r)
+		r.Header.Set("X-CSRF-Token", token)
+		r.Header.Set("Origin", v.origin)
+
+		reason = nil
+		rr2 := httptest.NewRecorder()
+		s.ServeHTTPC(context.Background(), rr2, r)
+
+		if rr2.Code != v.expected || reason != v.reason {
+			t.Errorf("origin %q: got %v (%v) want %v (%v)",
+				v.origin, rr2.Code, reason, v.expected, v.reason)
+		}
+	}
+}
+
+// Wildcard trusted origins should match subdomains only.
+func TestWildcardTrustedOrigins(t *testing.T) {
+	cs, err := newCSRF(testKey, TrustedOrigins([]string{"https://*.example.com"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wildcardTests = []struct {
+		origin  string
+		trusted bool
+	}{
+		{"https://app.example.com", true},
+		{"https://a.b.example.com", true},
+		{"https://APP.Example.com", true},
+		{"https://example.com", false},
+		{"https://evilexample.com", false},
+		{"https://app.example.com.evil.org", false},
+		{"https://.example.com", false},
+		{"http://app.example.com", false},
+		{"https://app.example.com:8443", false},
+	}
+
+	for _, v := range wildcardTests {
+		u, err := url.Parse(v.origin)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := cs.isTrustedOrigin(u); got != v.trusted {
+			t.Errorf("%q: got trusted %v want %v", v.origin, got, v.trusted)
+		}
+	}
+
+	// The apex is only trusted when listed explicitly.
+	cs, err = newCSRF(testKey, TrustedOrigins([]string{"https://*.example.com", "https://example.com"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !cs.isTrustedOrigin(&url.URL{Scheme: "https", Host: "example.com"}) {
+		t.Error("explicitly listed apex not trusted")
+	}
+
+	for _, origin := range []string{"https://app.*.com", "https://*", "https://*.", "https://a*.example.com"} {
+		if _, err := newCSRF(testKey, TrustedOrigins([]string{origin})); err == nil {
+			t.Errorf("invalid wildcard origin %q accepted", origin)
+		}
+	}
+}
+
+// TestOriginHeader checks that the Origin header is preferred over the Referer
+// header, and that the failure reason reflects the header that failed.
+func TestOriginHeader(t *testing.T) {
+	var reason error
+	errorHandler := goji.HandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		reason = FailureReason(ctx, r)
+		http.Error(w, "", http.StatusForbidden)
+	})
+
+	m := goji.NewMux()
+	m.UseC(Protect(testKey, ErrorHandler(errorHandler)))
+
+	var token string
+	m.HandleFuncC(pat.New("/"), func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		token = Token(ctx, r)
+	})
+
+	// Obtain a CSRF cookie via a GET request.
+	r, err := http.NewRequest("GET", "https://www.gorillatoolkit.org/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	m.ServeHTTP(rr, r)
+
+	var originTests = []struct {
+		origin   string
+		referer  string
+		expected error
+	}{
+		{"https://www.gorillatoolkit.org", "", nil},
+		{"", "https://www.gorillatoolkit.org/", nil},
+		// Origin takes precedence over a valid Referer.
+		{"https://goji.io", "https://www.gorillatoolkit.org/", ErrBadOrigin},
+		{"null", "", ErrBadOrigin},
+		{"", "https://goji.io/", ErrBadReferer},
+		{"", "", ErrNoOrigin},
+	}
+
+	for _, v := range originTests {
+		reason = nil
+
+		r, err := http.NewRequest("POST", "https://www.gorillatoolkit.org/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		setCookie(rr, r)
+		r.Header.Set("X-CSRF-Token", token)
+		if v.origin != "" {
+			r.Header.Set("Origin", v.origin)
+		}
+		if v.referer != "" {
+			r.Header.Set("Referer", v.referer)
+		}
+
+		m.ServeHTTP(httptest.NewRecorder(), r)
+
+		if reason != v.expected {
+			t.Errorf("origin check failed for Origin %q, Referer %q: got %v want %v",
+				v.origin, v.referer, reason, v.expected)
+		}
+	}
+}
+
+// TestOriginCheckTLSServer tests that the origin check applies to requests
+// served over TLS, whose URL only carries the path.
+func TestOriginCheckTLSServer(t *testing.T) {
+	ts := httptest.NewTLSServer(ProtectHTTP(testKey, ResponseHeader("X-CSRF-Token"))(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	defer ts.Close()
+
+	client := ts.Client()
+	resp, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	token := resp.Header.Get("X-CSRF-Token")
+	cookies := resp.Cookies()
+	if token == "" || len(cookies) == 0 {
+		t.Fatalf("no token issued: token %q, cookies %v", token, cookies)
+	}
+
+	var originTests = []struct {
+		origin   string
+		expected int
+	}{
+		{ts.URL, http.StatusOK},
+		{"https://evil.example", http.StatusForbidden},
+		{strings.Replace(ts.URL, "https://", "http://", 1), http.StatusForbidden},
+		{"", http.StatusForbidden},
+	}
+
+	for _, v := range originTests {
+		r, err := http.NewRequest("POST", ts.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		r.Header.Set("X-CSRF-Token", token)
+		if v.origin != "" {
+			r.Header.Set("Origin", v.origin)
+		}
+
+		resp, err := client.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != v.expected {
+			t.Errorf("Origin %q: got %v want %v", v.origin, resp.StatusCode, v.expected)
+		}
+	}
+}
+
+// TestTrustProxyHeaders checks that X-Forwarded-Proto enables the origin check
+// for plain HTTP requests, but only when proxy headers are trusted.
+func TestTrustProxyHeaders(t *testing.T) {
+	var proxyTests = []struct {
+		trust    bool
+		referer  string
+		expected int
+	}{
+		{true, "https://www.gorillatoolkit.org/", http.StatusOK},
+		{true, "http://www.gorillatoolkit.org/", http.StatusForbidden},
+		{true, "https://goji.io/", http.StatusForbidden},
+		{false, "https://goji.io/", http.StatusOK},
+	}
+
+	for _, v := range proxyTests {
+		m := goji.NewMux()
+		m.UseC(Protect(testKey, TrustProxyHeaders(v.trust)))
+
+		var token string
+		m.HandleFuncC(pat.New("/"), func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			token = Token(ctx, r)
+		})
+
+		// Requests arrive from the proxy over a plain connection.
+		r, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Host = "www.gorillatoolkit.org"
+		r.Header.Set("X-Forwarded-Proto", "https")
+
+		rr := httptest.NewRecorder()
+		m.ServeHTTP(rr, r)
+
+		r, err = http.NewRequest("POST", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Host = "www.gorillatoolkit.org"
+		r.Header.Set("X-Forwarded-Proto", "https")
+
+		setCookie(rr, r)
+		r.Header.Set("X-CSRF-Token", token)
+		r.Header.Set("Referer", v.referer)
+
+		rr = httptest.NewRecorder()
+		m.ServeHTTP(rr, r)
+
+		if rr.Code != v.expected {
+			t.Errorf("proxy check failed (trust: %v, Referer: %q): got %v want %v",
+				v.trust, v.referer, rr.Code, v.expected)
+		}
+	}
+}
+
+// TestTokenTTL tests that tokens older than the TokenTTL are rejected with
+// ErrTokenExpired and replaced.
+func TestTokenTTL(t *testing.T) {
+	var reason error
+	errorHandler := goji.HandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		reason = FailureReason(ctx, r)
+		http.Error(w, "", http.StatusForbidden)
+	})
+
+	st := &singleTokenStore{}
+	m := goji.NewMux()
+	m.UseC(Protect(testKey, Store(st), TokenTTL(time.Hour), ErrorHandler(errorHandler)))
+
+	var token string
+	m.HandleFuncC(pat.New("/"), func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		token = Token(ctx, r)
+	})
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.ServeHTTP(httptest.NewRecorder(), r)
+
+	if len(st.token) != timestampLength+tokenLength {
+		t.Fatalf("token saved without a timestamp: got %v bytes want %v",
+			len(st.token), timestampLength+tokenLength)
+	}
+
+	post := func() int {
+		r, err := http.NewRequest("POST", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("X-CSRF-Token", token)
+
+		rr := httptest.NewRecorder()
+		m.ServeHTTP(rr, r)
+		return rr.Code
+	}
+
+	// A fresh token should pass.
+	if code := post(); code != http.StatusOK {
+		t.Fatalf("middleware rejected a fresh token: got %v want %v", code, http.StatusOK)
+	}
+
+	// Backdate the stored token beyond the TTL.
+	saved := append([]byte{}, st.token...)
+	binary.BigEndian.PutUint64(st.token, uint64(time.Now().Add(-2*time.Hour).Unix()))
+
+	if code := post(); code != http.StatusForbidden || reason != ErrTokenExpired {
+		t.Fatalf("middleware accepted an expired token: got %v (%v) want %v (%v)",
+			code, reason, http.StatusForbidden, ErrTokenExpired)
+	}
+
+	if bytes.Equal(st.token[timestampLength:], saved[timestampLength:]) {
+		t.Fatal("expired token was not replaced")
+	}
+}
+
+// TestAngularCompat tests that the masked token is exposed in a JavaScript
+// readable cookie, and is accepted in the X-XSRF-TOKEN header.
+func TestAngularCompat(t *testing.T) {
+	m := goji.NewMux()
+	m.UseC(Protect(testKey, AngularCompat()))
+	m.HandleFuncC(pat.New("/"), testHandler)
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	m.ServeHTTP(rr, r)
+
+	var session, js *http.Cookie
+	for _, c := range readSetCookies(rr) {
+		switch c.Name {
+		case cookieName:
+			session = c
+		case jsCookieName:
+			js = c
+		}
+	}
+
+	if session == nil || !session.HttpOnly {
+		t.Fatalf("session cookie not set or not HttpOnly: got %v", session)
+	}
+
+	if js == nil || js.HttpOnly || js.Value == "" {
+		t.Fatalf("XSRF-TOKEN cookie not set or HttpOnly: got %v", js)
+	}
+
+	// Echo the cookie back in the header, as Angular would.
+	r, err = http.NewRequest("POST", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.AddCookie(session)
+	r.AddCookie(js)
+	r.Header.Set("X-XSRF-TOKEN", js.Value)
+
+	rr = httptest.NewRecorder()
+	m.ServeHTTP(rr, r)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("middleware rejected the XSRF-TOKEN cookie value: got %v want %v",
+			rr.Code, http.StatusOK)
+	}
+}
+
+// TestNestedInstances tests that two nested middleware instances issue and
+// validate their own tokens independently.
+func TestNestedInstances(t *testing.T) {
+	var failedBy string
+	errorHandler := func(name string) goji.Handler {
+		return goji.HandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			if FailureReasonFor(ctx, r, name) == nil {
+				t.Errorf("%s: failure reason not set for the instance", name)
+			}
+			failedBy = name
+			http.Error(w, "", http.StatusForbidden)
+		})
+	}
+
+	admin := goji.SubMux()
+	admin.UseC(Protect(testKey, Name("admin"), CookieName("_admin_csrf"),
+		RequestHeader("X-Admin-Token"), ErrorHandler(errorHandler("admin"))))
+
+	var siteToken, adminToken, nearest string
+	admin.HandleFuncC(pat.New("/*"), func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		siteToken = TokenFor(ctx, r, "site")
+		adminToken = TokenFor(ctx, r, "admin")
+		nearest = Token(ctx, r)
+	})
+
+	m := goji.NewMux()
+	m.UseC(Protect(testKey, Name("site"), ErrorHandler(errorHandler("site"))))
+	m.HandleC(pat.New("/admin/*"), admin)
+
+	r, err := http.NewRequest("GET", "/admin/users", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	m.ServeHTTP(rr, r)
+
+	if siteToken == "" || adminToken == "" || siteToken == adminToken {
+		t.Fatalf("instances did not issue separate tokens: got %q and %q", siteToken, adminToken)
+	}
+
+	if nearest != adminToken {
+		t.Fatalf("Token did not return the innermost token: got %q want %q", nearest, adminToken)
+	}
+
+	if c := readSetCookies(rr); len(c) != 2 {
+		t.Fatalf("instances did not issue separate cookies: got %v", c)
+	}
+
+	var nestedTests = []struct {
+		site     string
+		admin    string
+		expected string
+	}{
+		{siteToken, adminToken, ""},
+		{siteToken, siteToken, "admin"},
+		{adminToken, adminToken, "site"},
+		{"", adminToken, "site"},
+	}
+
+	for _, v := range nestedTests {
+		failedBy = ""
+
+		r, err := http.NewRequest("POST", "/admin/users", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, c := range readSetCookies(rr) {
+			r.AddCookie(c)
+		}
+		r.Header.Set("X-CSRF-Token", v.site)
+		r.Header.Set("X-Admin-Token", v.admin)
+
+		m.ServeHTTP(httptest.NewRecorder(), r)
+
+		if failedBy != v.expected {
+			t.Errorf("nested validation failed: got failure from %q want %q", failedBy, v.expected)
+		}
+	}
+}
+
+// TestFormField tests that a token in the form field takes precedence over a
 // token in the HTTP header.
 // TODO(matt): Finish this test.
 func TestFormField(t *testing.T) {
 
 }
 
-func setCookie(rr *httptest.ResponseRecorder, r *http.Request) {
-	r.Header.Set("Cookie", rr.Header().Get("Set-Cookie"))
+func setCookie(rr *httptest.ResponseRecorder, r *http.Request) {
+	r.Header.Set("Cookie", rr.Header().Get("Set-Cookie"))
+}
+
+// readSetCookies returns the cookies set on the recorded response.
+func readSetCookies(rr *httptest.ResponseRecorder) []*http.Cookie {
+	return (&http.Response{Header: rr.Header()}).Cookies()
+}
+
+// TestLogger tests that failures are logged to the configured logger.
+func TestLogger(t *testing.T) {
+	var lines []string
+	logger := LoggerFunc(func(format string, args ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	})
+
+	s := Protect(testKey, Logger(logger))(testHandler)
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.ServeHTTPC(context.Background(), httptest.NewRecorder(), r)
+
+	if len(lines) != 0 {
+		t.Fatalf("safe request logged: got %v", lines)
+	}
+
+	r, err = http.NewRequest("POST", "/submit", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.AddCookie(&http.Cookie{Name: cookieName, Value: "not-a-valid-cookie"})
+
+	s.ServeHTTPC(context.Background(), httptest.NewRecorder(), r)
+
+	if len(lines) != 2 {
+		t.Fatalf("unexpected log lines: got %q", lines)
+	}
+
+	if !strings.Contains(lines[1], "POST /submit") || !strings.Contains(lines[1], ErrNoToken.Error()) {
+		t.Errorf("failure not logged: got %q", lines[1])
+	}
+}
+
+// TestIssueOnPaths tests that tokens are only issued on the given paths, and
+// that unsafe requests are still validated on other paths.
+func TestIssueOnPaths(t *testing.T) {
+	var token string
+	s := Protect(testKey, IssueOnPaths("/form"))(goji.HandlerFunc(
+		func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			token = Token(ctx, r)
+		}))
+
+	r, err := http.NewRequest("GET", "/static/app.js", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTPC(context.Background(), rr, r)
+
+	if c := rr.Header()["Set-Cookie"]; len(c) != 0 || token != "" {
+		t.Fatalf("token issued on a non-matching path: got cookies %q, token %q", c, token)
+	}
+
+	r, err = http.NewRequest("POST", "/api/items", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr = httptest.NewRecorder()
+	s.ServeHTTPC(context.Background(), rr, r)
+
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("unsafe request not validated: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+
+	if c := rr.Header()["Set-Cookie"]; len(c) != 0 {
+		t.Fatalf("token issued on a non-matching path: got cookies %q", c)
+	}
+
+	r, err = http.NewRequest("GET", "/form", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr = httptest.NewRecorder()
+	s.ServeHTTPC(context.Background(), rr, r)
+
+	if len(readSetCookies(rr)) != 1 || token == "" {
+		t.Fatalf("token not issued on a matching path: got %q", rr.Header()["Set-Cookie"])
+	}
+
+	// The issued token is accepted on other paths.
+	for _, v := range []struct {
+		token    string
+		expected int
+	}{
+		{token, http.StatusOK},
+		{"", http.StatusForbidden},
+	} {
+		r, err = http.NewRequest("POST", "/api/items", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		setCookie(rr, r)
+		r.Header.Set("X-CSRF-Token", v.token)
+
+		rr2 := httptest.NewRecorder()
+		s.ServeHTTPC(context.Background(), rr2, r)
+
+		if rr2.Code != v.expected {
+			t.Errorf("POST with token %q: got %v want %v", v.token, rr2.Code, v.expected)
+		}
+	}
+}
+
+// TestCheckFetchMetadata tests that cross-site requests reported by the
+// Sec-Fetch-Site header are rejected, unless their origin is trusted.
+func TestCheckFetchMetadata(t *testing.T) {
+	var token string
+	s := Protect(testKey, CheckFetchMetadata(true), TrustedOrigins([]string{"https://trusted.example.com"}))(goji.HandlerFunc(
+		func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			token = Token(ctx, r)
+		}))
+
+	r, err := http.NewRequest("GET", "https://www.example.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTPC(context.Background(), rr, r)
+
+	var fetchTests = []struct {
+		name     string
+		site     string
+		origin   string
+		expected int
+	}{
+		{"same origin", "same-origin", "https://www.example.com", http.StatusOK},
+		{"missing header", "", "https://www.example.com", http.StatusOK},
+		{"cross site", "cross-site", "https://www.example.com", http.StatusForbidden},
+		{"cross site trusted", "cross-site", "https://trusted.example.com", http.StatusOK},
+	}
+
+	for _, v := range fetchTests {
+		var reason error
+		h := Protect(testKey, CheckFetchMetadata(true), TrustedOrigins([]string{"https://trusted.example.com"}),
+			ErrorHandlerFunc(func(w http.ResponseWriter, r *http.Request, err error) {
+				reason = err
+				http.Error(w, "", http.StatusForbidden)
+			}))(testHandler)
+
+		r, err := http.NewRequest("POST", "https://www.example.com/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		setCookie(rr, r)
+		r.Header.Set("X-CSRF-Token", token)
+		r.Header.Set("Origin", v.origin)
+		if v.site != "" {
+			r.Header.Set("Sec-Fetch-Site", v.site)
+		}
+
+		rr2 := httptest.NewRecorder()
+		h.ServeHTTPC(context.Background(), rr2, r)
+
+		if rr2.Code != v.expected {
+			t.Errorf("%s: got %v want %v", v.name, rr2.Code, v.expected)
+		}
+
+		if v.expected != http.StatusOK && reason != ErrCrossSite {
+			t.Errorf("%s: got reason %v want %v", v.name, reason, ErrCrossSite)
+		}
+	}
+}
+
+// recordingTracer is a CSRFTracer that records the reasons it is given.
+type recordingTracer struct {
+	reasons []error
+}
+
+func (rt *recordingTracer) RecordFailure(ctx context.Context, reason error) {
+	rt.reasons = append(rt.reasons, reason)
+}
+
+// TestTracer tests that the tracer is told the reason a request failed, and
+// isn't called for valid requests.
+func TestTracer(t *testing.T) {
+	rt := &recordingTracer{}
+	s := Protect(testKey, Tracer(rt))(testHandler)
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.ServeHTTPC(context.Background(), httptest.NewRecorder(), r)
+
+	if len(rt.reasons) != 0 {
+		t.Fatalf("tracer called for a safe request: got %v", rt.reasons)
+	}
+
+	r, err = http.NewRequest("POST", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.ServeHTTPC(context.Background(), httptest.NewRecorder(), r)
+
+	if len(rt.reasons) != 1 || rt.reasons[0] != ErrNoToken {
+		t.Fatalf("tracer got the wrong reason: got %v want %v", rt.reasons, ErrNoToken)
+	}
+}
+
+// TestFailureStatus tests that the default error handler uses the configured
+// status code.
+func TestFailureStatus(t *testing.T) {
+	var statusTests = []struct {
+		code     int
+		expected int
+	}{
+		{http.StatusUnprocessableEntity, http.StatusUnprocessableEntity},
+		{http.StatusBadRequest, http.StatusBadRequest},
+		{http.StatusOK, http.StatusForbidden},
+		{999, http.StatusForbidden},
+	}
+
+	for _, v := range statusTests {
+		s := Protect(testKey, FailureStatus(v.code))(testHandler)
+
+		r, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		s.ServeHTTPC(context.Background(), rr, r)
+
+		r, err = http.NewRequest("POST", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		setCookie(rr, r)
+		r.Header.Set("X-CSRF-Token", base64.StdEncoding.EncodeToString(make([]byte, tokenLength*2)))
+
+		rr = httptest.NewRecorder()
+		s.ServeHTTPC(context.Background(), rr, r)
+
+		if rr.Code != v.expected {
+			t.Errorf("FailureStatus(%d) not applied: got %v want %v", v.code, rr.Code, v.expected)
+		}
+
+		if !strings.Contains(rr.Body.String(), ErrBadToken.Error()) {
+			t.Errorf("FailureStatus(%d): reason not written: got %q", v.code, rr.Body.String())
+		}
+	}
+}
+
+// TestFailureBody tests that the default error handler serves a custom body
+// and Content-Type.
+func TestFailureBody(t *testing.T) {
+	body := `{"error":"invalid CSRF token"}`
+	s := Protect(testKey, FailureBody(body, "application/json"))(testHandler)
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTPC(context.Background(), rr, r)
+
+	r, err = http.NewRequest("POST", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setCookie(rr, r)
+	r.Header.Set("X-CSRF-Token", base64.StdEncoding.EncodeToString(make([]byte, tokenLength*2)))
+
+	rr = httptest.NewRecorder()
+	s.ServeHTTPC(context.Background(), rr, r)
+
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("FailureBody changed the status: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+
+	if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("FailureBody content type not set: got %q want %q", ct, "application/json")
+	}
+
+	if rr.Body.String() != body {
+		t.Errorf("FailureBody not written: got %q want %q", rr.Body.String(), body)
+	}
+
+	if _, err := newCSRF(testKey, FailureBody(body, "application/")); err == nil {
+		t.Error("FailureBody accepted an invalid content type")
+	}
+}
+
+// TestHostBinding tests that a token minted for one host fails validation on
+// another, unless the cookie is shared across hosts with the Domain option.
+func TestHostBinding(t *testing.T) {
+	var hostTests = []struct {
+		opts     []Option
+		host     string
+		expected int
+	}{
+		{nil, "a.example.com", http.StatusOK},
+		{nil, "A.EXAMPLE.COM", http.StatusOK},
+		{nil, "b.example.com", http.StatusForbidden},
+		{[]Option{Domain("example.com")}, "b.example.com", http.StatusOK},
+	}
+
+	for _, v := range hostTests {
+		var token string
+		s := Protect(testKey, v.opts...)(goji.HandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			token = Token(ctx, r)
+		}))
+
+		r, err := http.NewRequest("GET", "http://a.example.com/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		s.ServeHTTPC(context.Background(), rr, r)
+
+		r, err = http.NewRequest("POST", "http://a.example.com/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r.Host = v.host
+		setCookie(rr, r)
+		r.Header.Set("X-CSRF-Token", token)
+
+		rr = httptest.NewRecorder()
+		s.ServeHTTPC(context.Background(), rr, r)
+
+		if rr.Code != v.expected {
+			t.Errorf("token minted for a.example.com posted to %s: got %v want %v",
+				v.host, rr.Code, v.expected)
+		}
+	}
+}
+
+// TestMuxUse tests that the middleware behaves the same when registered with
+// Mux.UseC (Protect) and Mux.Use (ProtectHTTP).
+func TestMuxUse(t *testing.T) {
+	var muxTests = []struct {
+		name string
+		use  func(m *goji.Mux, eh goji.Handler)
+	}{
+		{"UseC", func(m *goji.Mux, eh goji.Handler) { m.UseC(Protect(testKey, ErrorHandler(eh))) }},
+		{"Use", func(m *goji.Mux, eh goji.Handler) { m.Use(ProtectHTTP(testKey, ErrorHandler(eh))) }},
+	}
+
+	for _, v := range muxTests {
+		var token string
+		var reason error
+		errorHandler := goji.HandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			reason = FailureReason(ctx, r)
+			http.Error(w, "", http.StatusForbidden)
+		})
+
+		m := goji.NewMux()
+		v.use(m, errorHandler)
+		m.HandleFuncC(pat.New("/"), func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			token = Token(ctx, r)
+		})
+
+		r, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		m.ServeHTTP(rr, r)
+
+		if token == "" {
+			t.Fatalf("%s: token not available to the handler", v.name)
+		}
+
+		r, err = http.NewRequest("POST", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		setCookie(rr, r)
+		r.Header.Set("X-CSRF-Token", token)
+
+		rr2 := httptest.NewRecorder()
+		m.ServeHTTP(rr2, r)
+
+		if rr2.Code != http.StatusOK {
+			t.Fatalf("%s: valid token rejected: got %v want %v", v.name, rr2.Code, http.StatusOK)
+		}
+
+		r, err = http.NewRequest("POST", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		setCookie(rr, r)
+
+		rr2 = httptest.NewRecorder()
+		m.ServeHTTP(rr2, r)
+
+		if rr2.Code != http.StatusForbidden || reason != ErrNoToken {
+			t.Fatalf("%s: missing token not rejected: got %v, %v want %v, %v",
+				v.name, rr2.Code, reason, http.StatusForbidden, ErrNoToken)
+		}
+	}
+}
+
+// TestResponseHeader tests that the masked token is written to the configured
+// response header on safe requests only.
+func TestResponseHeader(t *testing.T) {
+	var token string
+	s := Protect(testKey, ResponseHeader("X-CSRF-Token"))(goji.HandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		token = Token(ctx, r)
+		w.Write([]byte("body"))
+	}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTPC(context.Background(), rr, r)
+
+	if h := rr.Header().Get("X-CSRF-Token"); h == "" || h != token {
+		t.Fatalf("token not in the response header: got %q want %q", h, token)
+	}
+
+	r, err = http.NewRequest("POST", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setCookie(rr, r)
+	r.Header.Set("X-CSRF-Token", token)
+
+	rr = httptest.NewRecorder()
+	s.ServeHTTPC(context.Background(), rr, r)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("token from the response header rejected: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	if h := rr.Header().Get("X-CSRF-Token"); h != "" {
+		t.Fatalf("token written to the response header of an unsafe request: got %q", h)
+	}
+}
+
+// TestDoubleSubmit tests that DoubleSubmit mode accepts the cookie value when
+// echoed back, and rejects mismatched or forged pairs.
+func TestDoubleSubmit(t *testing.T) {
+	s := Protect(testKey, DoubleSubmit())(testHandler)
+
+	// issue returns the double-submit cookie from a fresh GET.
+	issue := func() *http.Cookie {
+		r, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		s.ServeHTTPC(context.Background(), rr, r)
+
+		cookies := readSetCookies(rr)
+		if len(cookies) != 1 || cookies[0].Name != cookieName {
+			t.Fatalf("double-submit cookie not set: got %v", cookies)
+		}
+
+		return cookies[0]
+	}
+
+	cookie, other := issue(), issue()
+	if cookie.HttpOnly {
+		t.Fatal("double-submit cookie is HttpOnly")
+	}
+
+	// A self-consistent cookie/header pair without a valid HMAC.
+	forged := base64.StdEncoding.EncodeToString(make([]byte, tokenLength+32))
+
+	var doubleSubmitTests = []struct {
+		name     string
+		cookie   string
+		header   string
+		expected int
+	}{
+		{"matching", cookie.Value, cookie.Value, http.StatusOK},
+		{"mismatching", cookie.Value, other.Value, http.StatusForbidden},
+		{"no header", cookie.Value, "", http.StatusForbidden},
+		{"forged", forged, forged, http.StatusForbidden},
+	}
+
+	for _, v := range doubleSubmitTests {
+		r, err := http.NewRequest("POST", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r.AddCookie(&http.Cookie{Name: cookieName, Value: v.cookie})
+		r.Header.Set("X-CSRF-Token", v.header)
+
+		rr := httptest.NewRecorder()
+		s.ServeHTTPC(context.Background(), rr, r)
+
+		if rr.Code != v.expected {
+			t.Errorf("%s: got %v want %v", v.name, rr.Code, v.expected)
+		}
+	}
+
+	// Token returns the cookie value.
+	var token string
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.AddCookie(cookie)
+
+	Protect(testKey, DoubleSubmit())(goji.HandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		token = Token(ctx, r)
+	})).ServeHTTPC(context.Background(), httptest.NewRecorder(), r)
+
+	if token != cookie.Value {
+		t.Fatalf("token does not match the cookie value: got %q want %q", token, cookie.Value)
+	}
+}
+
+// TestMalformedTokens tests that malformed cookies and request tokens fail
+// cleanly with ErrBadToken.
+func TestMalformedTokens(t *testing.T) {
+	for _, mode := range [][]Option{nil, {DoubleSubmit()}} {
+		var reason error
+		var token string
+		s := Protect(testKey, append(mode, ErrorHandlerFunc(func(w http.ResponseWriter, r *http.Request, err error) {
+			reason = err
+			http.Error(w, "", http.StatusForbidden)
+		}))...)(goji.HandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			token = Token(ctx, r)
+		}))
+
+		r, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		s.ServeHTTPC(context.Background(), rr, r)
+
+		cookie := readSetCookies(rr)[0]
+
+		var malformedTests = []struct {
+			name   string
+			cookie string
+			header string
+		}{
+			{"invalid base64 cookie", "%%%not-base64", token},
+			{"truncated cookie", cookie.Value[:len(cookie.Value)/2], token},
+			{"invalid base64 token", cookie.Value, "%%%not-base64"},
+			{"truncated token", cookie.Value, token[:len(token)/2]},
+			// Valid base64 that can't be split into a pad and token.
+			{"odd length token", cookie.Value, base64.StdEncoding.EncodeToString(make([]byte, 2*tokenLength-1))},
+			{"overlong token", cookie.Value, base64.StdEncoding.EncodeToString(make([]byte, 2*tokenLength+1))},
+			{"single byte token", cookie.Value, base64.StdEncoding.EncodeToString([]byte{1})},
+		}
+
+		for _, v := range malformedTests {
+			reason = nil
+
+			r, err := http.NewRequest("POST", "/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r.AddCookie(&http.Cookie{Name: cookieName, Value: v.cookie})
+			r.Header.Set("X-CSRF-Token", v.header)
+
+			rr := httptest.NewRecorder()
+			s.ServeHTTPC(context.Background(), rr, r)
+
+			if rr.Code != http.StatusForbidden || reason != ErrBadToken {
+				t.Errorf("%s (%d options): got %v, %v want %v, %v",
+					v.name, len(mode), rr.Code, reason, http.StatusForbidden, ErrBadToken)
+			}
+		}
+	}
+}
+
+// TestNoReissueIfPresent tests that no cookies are written when the client
+// already has valid ones.
+func TestNoReissueIfPresent(t *testing.T) {
+	var reissueTests = []struct {
+		opts    []Option
+		cookies int
+	}{
+		// The session cookie is never reissued.
+		{nil, 0},
+		// ... but the XSRF-TOKEN cookie is, unless NoReissueIfPresent is set.
+		{[]Option{AngularCompat()}, 1},
+		{[]Option{AngularCompat(), NoReissueIfPresent(true)}, 0},
+	}
+
+	for _, v := range reissueTests {
+		s := Protect(testKey, v.opts...)(testHandler)
+
+		r, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		s.ServeHTTPC(context.Background(), rr, r)
+
+		r, err = http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, c := range readSetCookies(rr) {
+			r.AddCookie(c)
+		}
+
+		rr = httptest.NewRecorder()
+		s.ServeHTTPC(context.Background(), rr, r)
+
+		if cookies := rr.Header()["Set-Cookie"]; len(cookies) != v.cookies {
+			t.Errorf("%d options: got %d cookies want %d: %q", len(v.opts), len(cookies), v.cookies, cookies)
+		}
+	}
+
+	// An invalid XSRF-TOKEN cookie is replaced.
+	s := Protect(testKey, AngularCompat(), NoReissueIfPresent(true))(testHandler)
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTPC(context.Background(), rr, r)
+
+	r, err = http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setCookie(rr, r)
+	r.AddCookie(&http.Cookie{Name: jsCookieName, Value: "stale"})
+
+	rr = httptest.NewRecorder()
+	s.ServeHTTPC(context.Background(), rr, r)
+
+	if cookies := readSetCookies(rr); len(cookies) != 1 || cookies[0].Name != jsCookieName {
+		t.Errorf("invalid XSRF-TOKEN cookie not replaced: got %v", cookies)
+	}
+}
+
+// TestProtectOptionError tests that an option returning an error aborts
+// construction, before any handler is wrapped.
+func TestProtectOptionError(t *testing.T) {
+	errOption := errors.New("bad option")
+	failing := func(cs *csrf) error {
+		return errOption
+	}
+
+	var applied bool
+	after := func(cs *csrf) error {
+		applied = true
+		return nil
+	}
+
+	defer func() {
+		if r := recover(); r != errOption {
+			t.Fatalf("Protect did not panic with the option error: got %v want %v", r, errOption)
+		}
+
+		if applied {
+			t.Fatal("options after the failing option were applied")
+		}
+	}()
+
+	Protect(testKey, failing, after)
+	t.Fatal("Protect returned despite an option error")
+}
+
+// TestBindClientIP tests that bound tokens only validate for the client IP they
+// were issued to.
+func TestBindClientIP(t *testing.T) {
+	var ipTests = []struct {
+		name     string
+		opts     []Option
+		remote   string
+		header   string
+		expected int
+	}{
+		{"same IP", []Option{BindClientIP(true)}, "192.0.2.1:4000", "", http.StatusOK},
+		{"same IP, new port", []Option{BindClientIP(true)}, "192.0.2.1:5000", "", http.StatusOK},
+		{"different IP", []Option{BindClientIP(true)}, "198.51.100.7:4000", "", http.StatusForbidden},
+		{"unbound", nil, "198.51.100.7:4000", "", http.StatusOK},
+		{"proxy, same client", []Option{BindClientIP(true), ClientIPHeader("X-Forwarded-For")},
+			"203.0.113.9:80", "192.0.2.1, 203.0.113.9", http.StatusOK},
+		{"proxy, different client", []Option{BindClientIP(true), ClientIPHeader("X-Forwarded-For")},
+			"192.0.2.1:4000", "198.51.100.7", http.StatusForbidden},
+	}
+
+	for _, v := range ipTests {
+		var token string
+		s := Protect(testKey, v.opts...)(goji.HandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			token = Token(ctx, r)
+		}))
+
+		// The token is always issued to 192.0.2.1, directly or via a proxy.
+		r, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if v.header != "" {
+			r.RemoteAddr = "203.0.113.9:80"
+			r.Header.Set("X-Forwarded-For", "192.0.2.1")
+		} else {
+			r.RemoteAddr = "192.0.2.1:4000"
+		}
+
+		rr := httptest.NewRecorder()
+		s.ServeHTTPC(context.Background(), rr, r)
+
+		r, err = http.NewRequest("POST", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r.RemoteAddr = v.remote
+		if v.header != "" {
+			r.Header.Set("X-Forwarded-For", v.header)
+		}
+		setCookie(rr, r)
+		r.Header.Set("X-CSRF-Token", token)
+
+		rr = httptest.NewRecorder()
+		s.ServeHTTPC(context.Background(), rr, r)
+
+		if rr.Code != v.expected {
+			t.Errorf("%s: got %v want %v", v.name, rr.Code, v.expected)
+		}
+	}
+}
+
+// TestBindUserAgent tests that bound tokens only validate for the User-Agent
+// they were issued to.
+func TestBindUserAgent(t *testing.T) {
+	var uaTests = []struct {
+		name      string
+		opts      []Option
+		userAgent string
+		expected  int
+	}{
+		{"same agent", []Option{BindUserAgent(true)}, "Mozilla/5.0 (X11; rv:128.0)", http.StatusOK},
+		{"different agent", []Option{BindUserAgent(true)}, "Mozilla/5.0 (X11; rv:129.0)", http.StatusForbidden},
+		{"no agent", []Option{BindUserAgent(true)}, "", http.StatusForbidden},
+		{"unbound", nil, "curl/8.5.0", http.StatusOK},
+	}
+
+	for _, v := range uaTests {
+		var token string
+		s := Protect(testKey, v.opts...)(goji.HandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			token = Token(ctx, r)
+		}))
+
+		r, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r.Header.Set("User-Agent", "Mozilla/5.0 (X11; rv:128.0)")
+
+		rr := httptest.NewRecorder()
+		s.ServeHTTPC(context.Background(), rr, r)
+
+		r, err = http.NewRequest("POST", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r.Header.Set("User-Agent", v.userAgent)
+		setCookie(rr, r)
+		r.Header.Set("X-CSRF-Token", token)
+
+		rr = httptest.NewRecorder()
+		s.ServeHTTPC(context.Background(), rr, r)
+
+		if rr.Code != v.expected {
+			t.Errorf("%s: got %v want %v", v.name, rr.Code, v.expected)
+		}
+	}
+}
+
+// TestReplayWindow tests that a second unsafe request for a session is rejected
+// within the window - whether the token is resent as is, re-masked by the
+// sender, or freshly issued - and accepted once the window has passed.
+func TestReplayWindow(t *testing.T) {
+	// remask flips a bit in both the pad and the masked token, which unmasks
+	// to the same token.
+	remask := func(token string) string {
+		b, err := base64.StdEncoding.DecodeString(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b[0] ^= 1
+		b[tokenLength] ^= 1
+		return base64.StdEncoding.EncodeToString(b)
+	}
+
+	var replayTests = []struct {
+		name     string
+		window   time.Duration
+		wait     time.Duration
+		expected int
+	}{
+		{"within window", time.Hour, 0, http.StatusForbidden},
+		{"outside window", 10 * time.Millisecond, 50 * time.Millisecond, http.StatusOK},
+		{"disabled", 0, 0, http.StatusOK},
+	}
+
+	for _, v := range replayTests {
+		for _, kind := range []string{"same", "re-masked", "fresh"} {
+			var reason error
+			s := Protect(testKey, ReplayWindow(v.window), ResponseHeader("X-CSRF-Token"),
+				ErrorHandlerFunc(func(w http.ResponseWriter, r *http.Request, err error) {
+					reason = err
+					http.Error(w, "", http.StatusForbidden)
+				}))(testHandler)
+
+			serve := func(method string, cookies *httptest.ResponseRecorder, token string) *httptest.ResponseRecorder {
+				r, err := http.NewRequest(method, "/", nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if cookies != nil {
+					setCookie(cookies, r)
+				}
+				r.Header.Set("X-CSRF-Token", token)
+
+				rr := httptest.NewRecorder()
+				s.ServeHTTPC(context.Background(), rr, r)
+				return rr
+			}
+
+			issued := serve("GET", nil, "")
+			token := issued.Header().Get("X-CSRF-Token")
+			if rr := serve("POST", issued, token); rr.Code != http.StatusOK {
+				t.Fatalf("%s, %s: first use failed: got %v want %v", v.name, kind, rr.Code, http.StatusOK)
+			}
+
+			switch kind {
+			case "re-masked":
+				token = remask(token)
+			case "fresh":
+				token = serve("GET", issued, "").Header().Get("X-CSRF-Token")
+			}
+
+			time.Sleep(v.wait)
+			if rr := serve("POST", issued, token); rr.Code != v.expected {
+				t.Errorf("%s, %s: replay got %v want %v", v.name, kind, rr.Code, v.expected)
+			}
+
+			if v.expected == http.StatusForbidden && reason != ErrTokenReplayed {
+				t.Errorf("%s, %s: got reason %v want %v", v.name, kind, reason, ErrTokenReplayed)
+			}
+		}
+	}
+}
+
+// TestReplayCacheEviction tests that the replay cache forgets tokens once the
+// window has passed, and forgets the oldest first when it is full.
+func TestReplayCacheEviction(t *testing.T) {
+	now := time.Now()
+	rc := newReplayCache(time.Minute, 2)
+
+	if rc.seen([]byte("a"), now) || rc.seen([]byte("b"), now.Add(time.Second)) {
+		t.Fatal("new tokens reported as seen")
+	}
+
+	if !rc.seen([]byte("a"), now.Add(59*time.Second)) {
+		t.Fatal("token not seen within the window")
+	}
+
+	if rc.seen([]byte("a"), now.Add(time.Minute)) {
+		t.Fatal("token seen after the window")
+	}
+
+	// "a" was recorded again above, so "b" is now the oldest.
+	if rc.seen([]byte("c"), now.Add(time.Minute)) || rc.seen([]byte("b"), now.Add(time.Minute)) {
+		t.Fatal("oldest token not evicted from a full cache")
+	}
+}
+
+// BenchmarkSafeMethod measures a GET request from a client that already holds
+// a session cookie, and a handler that doesn't use the token.
+func BenchmarkSafeMethod(b *testing.B) {
+	s := Protect(testKey)(testHandler)
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTPC(context.Background(), rr, r)
+	setCookie(rr, r)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.ServeHTTPC(context.Background(), httptest.NewRecorder(), r)
+	}
+}
+
+// BenchmarkSafeMethodToken is as BenchmarkSafeMethod, but the handler renders
+// the token.
+func BenchmarkSafeMethodToken(b *testing.B) {
+	s := Protect(testKey)(goji.HandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		Token(ctx, r)
+	}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTPC(context.Background(), rr, r)
+	setCookie(rr, r)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.ServeHTTPC(context.Background(), httptest.NewRecorder(), r)
+	}
+}
+
+// BenchmarkSafeMethodNoCookie measures a GET request from a new client, which
+// must be issued a token.
+func BenchmarkSafeMethodNoCookie(b *testing.B) {
+	s := Protect(testKey)(testHandler)
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.ServeHTTPC(context.Background(), httptest.NewRecorder(), r)
+	}
+}
+
+// TestConcurrentRequests tests that one middleware instance can serve many
+// concurrent requests, each with its own session. Run with -race.
+func TestConcurrentRequests(t *testing.T) {
+	s := Protect(testKey, AngularCompat(), ResponseHeader("X-CSRF-Token"))(goji.HandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(UnmaskedToken(ctx, r) + " " + Token(ctx, r)))
+	}))
+
+	const n = 50
+	sessions := make([]string, n)
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			ctx := context.Background()
+			if i%2 == 0 {
+				ctx = WithFieldName(ctx, "alt.csrf")
+			}
+
+			r, err := http.NewRequest("GET", "/", nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			rr := httptest.NewRecorder()
+			s.ServeHTTPC(ctx, rr, r)
+
+			fields := strings.Fields(rr.Body.String())
+			if len(fields) != 2 {
+				t.Errorf("request %d: unexpected body %q", i, rr.Body.String())
+				return
+			}
+			sessions[i] = fields[0]
+
+			r, err = http.NewRequest("POST", "/", nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			setCookie(rr, r)
+			r.Header.Set("X-XSRF-TOKEN", fields[1])
+
+			rr2 := httptest.NewRecorder()
+			s.ServeHTTPC(ctx, rr2, r)
+
+			if rr2.Code != http.StatusOK {
+				t.Errorf("request %d: got %v want %v", i, rr2.Code, http.StatusOK)
+			}
+
+			if !strings.HasPrefix(rr2.Body.String(), fields[0]+" ") {
+				t.Errorf("request %d: session token changed: got %q want %q",
+					i, rr2.Body.String(), fields[0])
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	seen := make(map[string]bool, n)
+	for i, session := range sessions {
+		if seen[session] {
+			t.Errorf("request %d: token shared with another session", i)
+		}
+		seen[session] = true
+	}
+}
+
+// TestDevMode tests that DevMode allows requests from a local development
+// setup, and logs a warning.
+func TestDevMode(t *testing.T) {
+	var devTests = []struct {
+		name   string
+		target string
+		origin string
+	}{
+		{"plain HTTP", "http://localhost:8080/", ""},
+		{"dev server origin", "https://localhost:8443/", "http://localhost:3000"},
+		{"no origin", "https://127.0.0.1:8443/", ""},
+	}
+
+	for _, v := range devTests {
+		for _, dev := range []bool{true, false} {
+			var warnings []string
+			opts := []Option{Logger(LoggerFunc(func(format string, args ...interface{}) {
+				warnings = append(warnings, fmt.Sprintf(format, args...))
+			}))}
+			if dev {
+				opts = append(opts, DevMode())
+			}
+
+			var token string
+			s := Protect(testKey, opts...)(goji.HandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+				token = Token(ctx, r)
+			}))
+
+			if dev != (len(warnings) == 1 && strings.Contains(warnings[0], "DevMode")) {
+				t.Errorf("%s: unexpected warnings with DevMode %v: %q", v.name, dev, warnings)
+			}
+
+			r, err := http.NewRequest("GET", v.target, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+			s.ServeHTTPC(context.Background(), rr, r)
+
+			r, err = http.NewRequest("POST", v.target, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// As a browser would, only send Secure cookies over HTTPS.
+			for _, c := range readSetCookies(rr) {
+				if !c.Secure || strings.HasPrefix(v.target, "https:") {
+					r.AddCookie(c)
+				}
+			}
+			r.Header.Set("X-CSRF-Token", token)
+			if v.origin != "" {
+				r.Header.Set("Origin", v.origin)
+			}
+
+			rr = httptest.NewRecorder()
+			s.ServeHTTPC(context.Background(), rr, r)
+
+			expected := http.StatusForbidden
+			if dev {
+				expected = http.StatusOK
+			}
+
+			if rr.Code != expected {
+				t.Errorf("%s: got %v want %v with DevMode %v", v.name, rr.Code, expected, dev)
+			}
+		}
+	}
 }
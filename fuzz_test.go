@@ -0,0 +1,89 @@
+//go:build go1.18
+// +build go1.18
+
+package csrf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"goji.io"
+)
+
+// fuzzTimeLimit bounds the time taken to verify a single fuzzed input, so that
+// a pathological input - e.g. one that makes decoding quadratic - is reported.
+// It is generous, to allow for slow or race-enabled builds.
+const fuzzTimeLimit = time.Second
+
+// FuzzVerify tests that arbitrary sent tokens and session cookies are rejected
+// (or accepted) without panicking, both by Verify and by the middleware in each
+// of the token formats.
+func FuzzVerify(f *testing.F) {
+	var token, realToken string
+	handler := goji.HandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		token = Token(ctx, r)
+		realToken = UnmaskedToken(ctx, r)
+	})
+
+	var handlers []goji.Handler
+	for _, opts := range [][]Option{
+		nil,
+		{DoubleSubmit()},
+		{TokenTTL(time.Hour)},
+		{MaskLength(8)},
+		{EncryptCookie(testKey)},
+	} {
+		handlers = append(handlers, Protect(testKey, opts...)(handler))
+	}
+
+	for _, s := range handlers {
+		r, err := http.NewRequest("GET", "http://www.example.com/", nil)
+		if err != nil {
+			f.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		s.ServeHTTPC(context.Background(), rr, r)
+		cookie := readSetCookies(rr)[0].Value
+
+		f.Add(token, realToken, cookie)
+		f.Add(token[:len(token)/2], realToken, cookie[:len(cookie)/2])
+	}
+
+	f.Add("", "", "")
+	f.Add("%%%", "====", "not|a|cookie")
+
+	f.Fuzz(func(t *testing.T, sentToken, realToken, cookie string) {
+		start := time.Now()
+		Verify(realToken, sentToken, "www.example.com")
+		if d := time.Since(start); d > fuzzTimeLimit {
+			t.Fatalf("Verify took %v for a %d byte token", d, len(sentToken))
+		}
+
+		for _, s := range handlers {
+			r, err := http.NewRequest("POST", "http://www.example.com/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r.AddCookie(&http.Cookie{Name: cookieName, Value: cookie})
+			r.Header.Set("X-CSRF-Token", sentToken)
+
+			rr := httptest.NewRecorder()
+			start := time.Now()
+			s.ServeHTTPC(context.Background(), rr, r)
+			if d := time.Since(start); d > fuzzTimeLimit {
+				t.Fatalf("middleware took %v for a %d byte token and %d byte cookie",
+					d, len(sentToken), len(cookie))
+			}
+
+			if rr.Code != http.StatusOK && rr.Code != http.StatusForbidden {
+				t.Fatalf("unexpected status: got %v", rr.Code)
+			}
+		}
+	})
+}
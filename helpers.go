@@ -1,37 +1,508 @@
 package csrf
 
 import (
+	"bytes"
+	"container/list"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/subtle"
 	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
 	"net/http"
 	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"golang.org/x/net/context"
+
+	"goji.io"
 )
 
+// value returns the value stored under key in ctx or, failing that, in
+// r.Context(). Goji's bridge for net/http middleware (Mux.Use) passes handlers
+// its own context rather than r.Context(), so values set by ProtectHTTP are only
+// found in the latter.
+func value(ctx context.Context, r *http.Request, key interface{}) interface{} {
+	if v := ctx.Value(key); v != nil {
+		return v
+	}
+
+	if r != nil {
+		return r.Context().Value(key)
+	}
+
+	return nil
+}
+
 // Token returns a masked CSRF token ready for passing into HTML template or
 // a JSON response body. An empty token will be returned if the middleware
-// has not been applied (which will fail subsequent validation).
+// has not been applied (which will fail subsequent validation), or the request
+// was skipped with UnsafeSkipCheck: see EnsureToken.
+//
+// The real token is masked with a fresh one-time pad for every request, so the
+// token differs on every response even though the session's real token
+// doesn't. Repeated calls within a request return the same token.
 func Token(ctx context.Context, r *http.Request) string {
-	if maskedToken, ok := ctx.Value(tokenKey).(string); ok {
-		return maskedToken
+	if st, ok := value(ctx, r, tokenKey).(*requestState); ok {
+		return st.maskedToken()
 	}
 
 	return ""
 }
 
+// TokenFromContext is like Token, for code that has the request context but
+// not the request - e.g. template rendering in some frameworks. An empty token
+// is returned if the middleware has not been applied to the request the context
+// belongs to.
+func TokenFromContext(ctx context.Context) string {
+	return Token(ctx, nil)
+}
+
+// UnmaskedToken returns the real (unmasked) CSRF token for the session,
+// base64 encoded. This is a lower-level accessor for advanced use - e.g. a
+// front-end implementing its own double-submit cookie pattern. An empty string
+// is returned if the middleware has not been applied; a token is never
+// generated by this function.
+//
+// Warning: the real token is the same on every response, so exposing it in a
+// response body removes the BREACH mitigation that masking provides. The
+// middleware also only accepts masked tokens in requests: use Token for
+// values that will be submitted back. Only use this deliberately.
+func UnmaskedToken(ctx context.Context, r *http.Request) string {
+	st, ok := value(ctx, r, tokenKey).(*requestState)
+	if !ok || len(st.realToken) == 0 {
+		return ""
+	}
+
+	return st.cs.opts.Encoding.EncodeToString(st.realToken)
+}
+
+// Verify reports whether sentToken - a masked token, as returned by Token - was
+// issued for realToken, as returned by UnmaskedToken, using the same
+// constant-time comparison as the middleware. This allows tokens carried
+// outside of HTTP requests (e.g. in RPC or queue messages) to be checked.
+//
+// Tokens are bound to the host they were issued for, so host must be the Host
+// of the request the token was issued to, or the cookie Domain if one is set.
+// Tokens issued with DoubleSubmit, BindClientIP, BindUserAgent or a custom
+// Encoding can't be verified by Verify. It returns false if either token is
+// malformed.
+func Verify(realToken, sentToken, host string) bool {
+	real, err := decodeToken(realToken, base64.StdEncoding)
+	if err != nil {
+		return false
+	}
+
+	issued, err := decodeToken(sentToken, base64.StdEncoding)
+	if err != nil || len(issued) <= len(real) {
+		return false
+	}
+
+	token := unmaskToken(issued, len(real), len(issued)-len(real))
+	binding := strings.ToLower(strings.TrimPrefix(host, "."))
+
+	return compareTokens(token, bindToken(real, binding))
+}
+
+// Regenerate replaces the CSRF token for the current session with a freshly
+// generated one, saves it to the store and returns the new masked token.
+// Subsequent calls to Token(ctx, r) for the same request return the new token.
+//
+// Call Regenerate at privilege boundaries - e.g. right after a user has
+// successfully logged in - so that a token obtained before authentication
+// can't be reused after it. As it writes a new cookie, it must be called
+// before the response headers are written.
+//
+// Stores that implement TokenClearer, such as MemoryStore and redisstore.Store,
+// delete the previous token, so tokens issued prior to calling Regenerate
+// will fail validation. The cookie stores can't revoke a token: the client's
+// cookie is replaced, but a copy of the previous cookie remains valid (with
+// its tokens) until it expires.
+func Regenerate(ctx context.Context, w http.ResponseWriter, r *http.Request) (string, error) {
+	st, ok := value(ctx, r, tokenKey).(*requestState)
+	if !ok {
+		return "", errNotProtected
+	}
+
+	// Delete the previous token from the store. The session cookie is
+	// overwritten by saveToken, so the cleared cookie isn't written.
+	if tc, ok := st.cs.st.(TokenClearer); ok {
+		if err := tc.Clear(discardWriter{}, r); err != nil {
+			return "", storeError{err}
+		}
+	}
+
+	realToken, err := st.cs.newToken()
+	if err != nil {
+		return "", err
+	}
+
+	if err := st.cs.saveToken(realToken, w, r); err != nil {
+		return "", err
+	}
+
+	st.setToken(realToken, w, r)
+
+	return st.token, nil
+}
+
+// EnsureToken is like Token, but guarantees that a usable token exists: if
+// none has been issued for the request, it issues one - reusing the session's
+// real token if it has one, or generating and saving a new one - and writes
+// it to the response. Requests skipped with UnsafeSkipCheck aren't issued a
+// token by the middleware, so this is useful for API-first flows where such a
+// request bootstraps the client. As it may write a cookie, it must be called
+// before the response headers are written.
+//
+// An error is returned if the middleware has not been applied, or a new token
+// can't be generated or saved.
+func EnsureToken(ctx context.Context, r *http.Request, w http.ResponseWriter) (string, error) {
+	st, ok := value(ctx, r, tokenKey).(*requestState)
+	if !ok {
+		return "", errNotProtected
+	}
+
+	if st.realToken != nil {
+		return st.maskedToken(), nil
+	}
+
+	realToken, expired, err := st.cs.getToken(r)
+	if err != nil || expired || len(realToken) != st.cs.opts.TokenLength {
+		if realToken, err = st.cs.newToken(); err != nil {
+			return "", err
+		}
+
+		if err := st.cs.saveToken(realToken, w, r); err != nil {
+			return "", err
+		}
+	}
+
+	st.setToken(realToken, w, r)
+
+	return st.token, nil
+}
+
+// Clear invalidates the CSRF token for the current session - e.g. on logout -
+// so that it can't be reused. The token is deleted from the store if it
+// implements TokenClearer (all of the stores in this package do), and the
+// session cookie (and the JavaScript-readable cookie, if configured) is
+// expired. Subsequent calls to Token(ctx, r) for the same request return an
+// empty token, and the next request is issued a new one. As it writes a
+// cookie, it must be called before the response headers are written.
+//
+// An error is returned if the middleware has not been applied, or the store
+// fails to delete the token (wrapping ErrStoreFailure).
+func Clear(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	st, ok := value(ctx, r, tokenKey).(*requestState)
+	if !ok {
+		return errNotProtected
+	}
+
+	cs := st.cs
+	if tc, ok := cs.st.(TokenClearer); ok {
+		if err := tc.Clear(w, r); err != nil {
+			return storeError{err}
+		}
+	} else {
+		expireCookie(w, &http.Cookie{
+			Name:     cs.opts.CookieName,
+			HttpOnly: cs.opts.HttpOnly,
+			Secure:   cs.opts.Secure,
+			Path:     cs.opts.Path,
+			Domain:   cs.opts.Domain,
+			SameSite: http.SameSite(cs.opts.SameSite),
+		}, cs.opts.Partitioned)
+	}
+
+	if cs.opts.JSCookieName != "" {
+		expireCookie(w, &http.Cookie{
+			Name:     cs.opts.JSCookieName,
+			Secure:   cs.opts.Secure,
+			Path:     cs.opts.Path,
+			Domain:   cs.opts.Domain,
+			SameSite: http.SameSite(cs.opts.SameSite),
+		}, false)
+	}
+
+	st.realToken = nil
+	st.token = ""
+
+	return nil
+}
+
+// maskedToken returns the masked token for the request. The real token is only
+// masked when first needed, as requests that never render the token - e.g.
+// most GET requests to an API - would otherwise pay for it regardless.
+func (st *requestState) maskedToken() string {
+	if st.token == "" && st.realToken != nil {
+		st.token = st.cs.issueToken(st.realToken, st.r)
+	}
+
+	return st.token
+}
+
+// setToken replaces the token for the remainder of the request, and exposes
+// the new token in the JavaScript-readable cookie and response header, if
+// configured.
+func (st *requestState) setToken(realToken []byte, w http.ResponseWriter, r *http.Request) {
+	st.realToken = realToken
+	st.token = st.cs.issueToken(realToken, r)
+
+	if st.cs.opts.JSCookieName != "" {
+		st.cs.setJSCookie(w, st.token)
+	}
+
+	if st.cs.opts.ResponseHeader != "" {
+		w.Header().Set(st.cs.opts.ResponseHeader, st.token)
+	}
+}
+
+// TokenFor returns the masked CSRF token issued by the middleware instance
+// with the given name (see the Name option). Token returns the token from the
+// innermost instance, so TokenFor is only needed when several instances are
+// nested - e.g. a separately configured instance on an admin sub-router. An
+// empty token is returned if no instance with that name has been applied.
+func TokenFor(ctx context.Context, r *http.Request, name string) string {
+	if st, ok := value(ctx, r, instanceKey{name, tokenKey}).(*requestState); ok {
+		return st.maskedToken()
+	}
+
+	return ""
+}
+
+// TokenFromRequest returns the masked CSRF token from the request context
+// (r.Context()) rather than a separately passed context.Context. This is useful
+// for handlers that have been adapted to a plain http.Handler. It returns the
+// same value as Token(ctx, r), and an empty token if the middleware has not
+// been applied.
+func TokenFromRequest(r *http.Request) string {
+	return Token(r.Context(), r)
+}
+
+// Protection returns how the middleware handled the request: Validated if it
+// passed the CSRF checks, Exempt or SafeMethod if the checks were skipped, or
+// Unprotected if the middleware has not been applied. Requests to an exempt
+// path are Exempt regardless of their method. Handlers can use this to decide
+// whether to apply additional checks of their own.
+func Protection(ctx context.Context, r *http.Request) ProtectionState {
+	if st, ok := value(ctx, r, tokenKey).(*requestState); ok {
+		return st.state
+	}
+
+	return Unprotected
+}
+
+// Inspection describes the CSRF state of a request, for debugging why requests
+// fail validation. It never contains the token itself. See Inspect.
+type Inspection struct {
+	// CookieName is the name of the session cookie.
+	CookieName string
+	// CookiePresent reports whether the request carried the session cookie.
+	CookiePresent bool
+	// TokenPresent reports whether a usable token was read from the store.
+	TokenPresent bool
+	// TokenExpired reports whether the stored token is older than the
+	// TokenTTL.
+	TokenExpired bool
+	// RequestTokenPresent reports whether the request carried a token in a
+	// header, form field or other configured location.
+	RequestTokenPresent bool
+	// Valid reports whether the request token would pass verification
+	// against the stored token. Origin and Referer checks aren't included.
+	Valid bool
+	// Reason is the error the token check would fail with - e.g. ErrNoToken
+	// or ErrBadToken - or nil if Valid.
+	Reason error
+	// State is how the middleware handled the request: see Protection.
+	State ProtectionState
+}
+
+// Inspect reports whether the request carries a session cookie and a token,
+// and whether the token would pass verification, so that debugging endpoints
+// can show why a form is being rejected. It re-reads the store and the request
+// token, so call it from a handler within the middleware, on the request being
+// diagnosed. An error is returned if the middleware has not been applied.
+//
+// Inspect only returns metadata: neither the stored token nor the request
+// token is included, so the result is safe to log.
+func Inspect(ctx context.Context, r *http.Request) (Inspection, error) {
+	st, ok := value(ctx, r, tokenKey).(*requestState)
+	if !ok {
+		return Inspection{}, errNotProtected
+	}
+
+	cs := st.cs
+	in := Inspection{CookieName: cs.opts.CookieName, State: st.state}
+	if _, err := requestCookie(r, cs.opts.CookieName, cs.opts.FallbackCookieNames); err == nil {
+		in.CookiePresent = true
+	}
+
+	realToken, expired, err := cs.getToken(r)
+	in.TokenPresent = err == nil && !expired && len(realToken) == cs.opts.TokenLength
+	in.TokenExpired = err == nil && expired
+
+	// A token that fails to decode was still sent.
+	issued, reqErr := cs.requestToken(r)
+	in.RequestTokenPresent = reqErr == nil || reqErr == ErrBadToken
+
+	switch {
+	case in.TokenExpired:
+		in.Reason = ErrTokenExpired
+	case !in.TokenPresent && missingToken(realToken, err):
+		in.Reason = ErrNoToken
+	case !in.TokenPresent:
+		in.Reason = ErrBadToken
+	case reqErr != nil:
+		in.Reason = reqErr
+	case !cs.verifyToken(issued, realToken, r):
+		in.Reason = ErrBadToken
+	default:
+		in.Valid = true
+	}
+
+	return in, nil
+}
+
 // FailureReason makes CSRF validation errors available in the request
 // context.
 // This is useful when you want to log the cause of the error or report it to
-// client.
+// client. Validation failures are reported as one of the package's Err*
+// values - e.g. ErrBadToken - which can be checked with errors.Is.
 func FailureReason(ctx context.Context, r *http.Request) error {
-	if err, ok := ctx.Value(errorKey).(error); ok {
+	if err, ok := value(ctx, r, errorKey).(error); ok {
+		return err
+	}
+
+	return nil
+}
+
+// FailureReasonFromRequest returns the CSRF validation error from the request
+// context (r.Context()), like TokenFromRequest. This is useful for error
+// handlers supplied to ErrorHandlerHTTP.
+func FailureReasonFromRequest(r *http.Request) error {
+	return FailureReason(r.Context(), r)
+}
+
+// FailureReasonFor returns the CSRF validation error, if any, reported by the
+// middleware instance with the given name (see the Name option). See TokenFor.
+func FailureReasonFor(ctx context.Context, r *http.Request, name string) error {
+	if err, ok := value(ctx, r, instanceKey{name, errorKey}).(error); ok {
+		return err
+	}
+
+	return nil
+}
+
+// TokenHandler returns a handler that responds to GET (and HEAD) requests with
+// the masked token as JSON - {"csrfToken":"<token>"} - so that single page
+// applications can fetch a token from an endpoint such as /csrf. The session
+// cookie is set by the middleware as usual. The handler must be mounted inside
+// Protect; it responds with a HTTP 500 otherwise, and a HTTP 405 to other
+// methods. Use TokenHandlerHTTP with ProtectHTTP.
+//
+// Example:
+//
+//	m := goji.NewMux()
+//	m.UseC(csrf.Protect(key))
+//	m.HandleC(pat.Get("/csrf"), csrf.TokenHandler())
+func TokenHandler() goji.Handler {
+	return goji.HandlerFunc(serveToken)
+}
+
+// TokenHandlerHTTP is like TokenHandler, for use with ProtectHTTP.
+func TokenHandlerHTTP() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveToken(r.Context(), w, r)
+	})
+}
+
+// serveToken writes the masked token for the request as JSON.
+func serveToken(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	token, err := EnsureToken(ctx, r, w)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// The token is masked differently on every response, which mustn't be
+	// cached.
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Token string `json:"csrfToken"`
+	}{token})
+}
+
+// ValidateUpgrade checks a WebSocket handshake (or other upgrade) request
+// against the middleware's configuration. The handshake is a GET request, which
+// the middleware lets through without validation, yet browsers will make it
+// cross-site with the user's cookies. ValidateUpgrade checks that the Origin
+// (or Referer) header matches the request or a trusted origin, and that the
+// request carries a valid token. It returns nil if the request is valid, and
+// otherwise one of the reasons a request can fail validation.
+//
+// Browsers can't set headers on a WebSocket handshake, so the token is usually
+// sent in the query string: enable the QueryFieldName option. The request must
+// have passed through the middleware.
+//
+// Example, using gorilla/websocket:
+//
+//	// Protect(key, csrf.QueryFieldName("csrf_token")), with the client
+//	// connecting to "wss://example.com/ws?csrf_token=" + token.
+//	func ServeWS(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+//	    if err := csrf.ValidateUpgrade(r); err != nil {
+//	        http.Error(w, err.Error(), http.StatusForbidden)
+//	        return
+//	    }
+//
+//	    conn, err := upgrader.Upgrade(w, r, nil)
+//	    ...
+//	}
+//
+// As ValidateUpgrade checks the origin itself, the upgrader's CheckOrigin can
+// then allow all origins.
+func ValidateUpgrade(r *http.Request) error {
+	st, ok := r.Context().Value(tokenKey).(*requestState)
+	if !ok {
+		return errNotProtected
+	}
+	cs := st.cs
+
+	if err := cs.checkOrigin(r, cs.requestURL(r)); err != nil {
+		return err
+	}
+
+	if st.realToken == nil {
+		return ErrNoToken
+	}
+
+	issued, err := cs.requestToken(r)
+	if err != nil {
 		return err
 	}
 
+	if !cs.verifyToken(issued, st.realToken, r) {
+		return ErrBadToken
+	}
+
 	return nil
 }
 
@@ -45,6 +516,20 @@ func UnsafeSkipCheck(ctx context.Context) context.Context {
 	return context.WithValue(ctx, skipCheckKey, true)
 }
 
+// WithFieldName returns a context that overrides the FieldName option - the
+// name of the hidden <input> field rendered by TemplateField - for a single
+// request. This allows several forms to use different field names without
+// separate middleware instances.
+//
+// TemplateField uses the override wherever it is set. For the middleware to
+// also look for the token in that field when the form is submitted, the
+// override must be in place before the request reaches the middleware - e.g.
+// set by an outer middleware or handler for the route, as with
+// UnsafeSkipCheck.
+func WithFieldName(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, fieldNameKey, name)
+}
+
 // TemplateField is a template helper for html/template that provides an <input> field
 // populated with a CSRF token.
 //
@@ -57,59 +542,355 @@ func UnsafeSkipCheck(ctx context.Context) context.Context {
 //      <input type="hidden" name="goji.csrf.Token" value="<token>">
 //
 func TemplateField(ctx context.Context, r *http.Request) template.HTML {
-	fragment := fmt.Sprintf(`<input type="hidden" name="%s" value="%s">`,
-		ctx.Value(formKey), Token(ctx, r))
+	return TemplateFieldWithAttrs(ctx, r, nil)
+}
+
+// TemplateFieldWithAttrs is like TemplateField, but adds the given attributes -
+// e.g. an id or data-* attributes - to the <input> field. Attribute values are
+// HTML-escaped, attributes are rendered in name order, and attributes with an
+// invalid name or that would replace type, name or value are ignored.
+//
+// Example:
+//
+//	csrf.TemplateFieldWithAttrs(ctx, r, map[string]string{"id": "csrf"})
+//
+//	// ... becomes:
+//	<input type="hidden" name="goji.csrf.Token" value="<token>" id="csrf">
+func TemplateFieldWithAttrs(ctx context.Context, r *http.Request, attrs map[string]string) template.HTML {
+	name, _ := value(ctx, r, fieldNameKey).(string)
+	if name == "" {
+		name, _ = value(ctx, r, formKey).(string)
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `<input type="hidden" name="%s" value="%s"`,
+		template.HTMLEscapeString(name), template.HTMLEscapeString(Token(ctx, r)))
+
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		if validAttrName(k) && !contains([]string{"type", "name", "value"}, strings.ToLower(k)) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		fmt.Fprintf(&b, ` %s="%s"`, k, template.HTMLEscapeString(attrs[k]))
+	}
+	b.WriteString(">")
 
-	return template.HTML(fragment)
+	return template.HTML(b.String())
 }
 
-// mask returns a unique-per-request token to mitigate the BREACH attack
+// MetaTag is a template helper for html/template that provides a <meta> tag
+// populated with a CSRF token, which JavaScript frameworks such as Rails UJS
+// and htmx-based setups read to set the request header. The name defaults to
+// "csrf-token" and can be changed with the MetaName option.
+//
+// Example:
+//
+//	// The following tag in the <head> of our layout.tmpl template:
+//	{{ .csrfMeta }}
+//
+//	// ... becomes:
+//	<meta name="csrf-token" content="<token>">
+func MetaTag(ctx context.Context, r *http.Request) template.HTML {
+	name := metaName
+	if st, ok := value(ctx, r, tokenKey).(*requestState); ok {
+		name = st.cs.opts.MetaName
+	}
+
+	return template.HTML(fmt.Sprintf(`<meta name="%s" content="%s">`,
+		template.HTMLEscapeString(name), template.HTMLEscapeString(Token(ctx, r))))
+}
+
+// validAttrName reports whether s is safe to use as a HTML attribute name.
+func validAttrName(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for _, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == ':', c == '.':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// padToken returns a unique-per-request token to mitigate the BREACH attack
 // as per http://breachattack.com/#mitigations
 //
-// The token is generated by XOR'ing a one-time-pad and the base (session) CSRF
-// token and returning them together as a 64-byte slice. This effectively
-// randomises the token on a per-request basis without breaking multiple browser
-// tabs/windows.
-func mask(realToken []byte, r *http.Request) string {
-	otp, err := generateRandomBytes(tokenLength)
+// The token is generated by XOR'ing a one-time-pad of the given length with the
+// real token and returning them together, pad first. Pads shorter than the
+// token are repeated to cover it. This effectively randomises the token on a
+// per-request basis without breaking multiple browser tabs/windows. It returns
+// nil if a pad can't be generated.
+func padToken(realToken []byte, padLength int) []byte {
+	otp, err := generateRandomBytes(padLength)
 	if err != nil {
-		return ""
+		return nil
 	}
 
 	// XOR the OTP with the real token to generate a masked token. Append the
 	// OTP to the front of the masked token to allow unmasking in the subsequent
 	// request.
-	return base64.StdEncoding.EncodeToString(append(otp, xorToken(otp, realToken)...))
+	return append(otp, xorPad(realToken, otp)...)
+}
+
+// encodeToken encodes a token sent to clients, or returns an empty string for
+// a nil token.
+func encodeToken(enc *base64.Encoding, token []byte) string {
+	if token == nil {
+		return ""
+	}
+
+	return enc.EncodeToString(token)
+}
+
+// issueToken returns the token sent to clients for the given real token: the
+// masked, bound token (see tokenBinding) or, in DoubleSubmit mode, the cookie
+// value.
+func (cs *csrf) issueToken(realToken []byte, r *http.Request) string {
+	if cs.ds != nil {
+		return encodeToken(cs.opts.Encoding, cs.ds.value(realToken))
+	}
+
+	return encodeToken(cs.opts.Encoding,
+		padToken(bindToken(realToken, cs.tokenBinding(r)), cs.maskLength()))
+}
+
+// maskLength returns the length of the one-time-pad used to mask tokens: the
+// MaskLength, if set, or else the token length.
+func (cs *csrf) maskLength() int {
+	if cs.opts.MaskLength > 0 {
+		return cs.opts.MaskLength
+	}
+
+	return cs.opts.TokenLength
+}
+
+// replayCache remembers hashes of recently used tokens, for ReplayWindow. As
+// every entry lives for the same window, the oldest entry is always the first
+// to expire, so a single list ordered by use serves for both expiry and
+// eviction when the cache is full.
+type replayCache struct {
+	mu      sync.Mutex
+	window  time.Duration
+	size    int
+	order   *list.List // of replayEntry, oldest first
+	entries map[[sha256.Size]byte]*list.Element
+}
+
+// replayEntry is a used token's hash and the time it leaves the window.
+type replayEntry struct {
+	key     [sha256.Size]byte
+	expires time.Time
+}
+
+// newReplayCache returns a replayCache that remembers up to size tokens for
+// the window.
+func newReplayCache(window time.Duration, size int) *replayCache {
+	return &replayCache{
+		window:  window,
+		size:    size,
+		order:   list.New(),
+		entries: make(map[[sha256.Size]byte]*list.Element),
+	}
+}
+
+// seen reports whether the token was used within the window before now, and
+// otherwise records it as used at now.
+func (rc *replayCache) seen(token []byte, now time.Time) bool {
+	// Only the hash is kept, so the cache never holds a usable token.
+	key := sha256.Sum256(token)
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	for e := rc.order.Front(); e != nil; e = rc.order.Front() {
+		entry := e.Value.(replayEntry)
+		if now.Before(entry.expires) {
+			break
+		}
+
+		rc.order.Remove(e)
+		delete(rc.entries, entry.key)
+	}
+
+	if _, ok := rc.entries[key]; ok {
+		return true
+	}
+
+	if rc.order.Len() >= rc.size {
+		oldest := rc.order.Front()
+		rc.order.Remove(oldest)
+		delete(rc.entries, oldest.Value.(replayEntry).key)
+	}
+
+	rc.entries[key] = rc.order.PushBack(replayEntry{key: key, expires: now.Add(rc.window)})
+
+	return false
+}
+
+// multipartMemory returns the maximum number of bytes of a multipart form held
+// in memory: the MultipartMaxMemory, if set, or else the default.
+func (cs *csrf) multipartMemory() int64 {
+	if cs.opts.MultipartMaxMemory > 0 {
+		return cs.opts.MultipartMaxMemory
+	}
+
+	return multipartMaxMemory
+}
+
+// jsonBodyLimit returns the maximum number of bytes of a JSON body read for a
+// token: the MaxBodyBytes, if set, or else the default.
+func (cs *csrf) jsonBodyLimit() int64 {
+	if cs.opts.MaxBodyBytes > 0 {
+		return cs.opts.MaxBodyBytes
+	}
+
+	return jsonMaxBodyBytes
+}
+
+// verifyToken reports whether the (decoded) token sent in the request was
+// issued for the given real token. See issueToken.
+func (cs *csrf) verifyToken(issued, realToken []byte, r *http.Request) bool {
+	// Never validate against an empty real token.
+	if len(realToken) == 0 {
+		return false
+	}
+
+	if cs.ds != nil {
+		return compareTokens(issued, cs.ds.value(realToken))
+	}
+
+	// Unmask the token, and compare it against the real token bound to the
+	// host (and client IP) of this request.
+	requestToken := unmaskToken(issued, cs.opts.TokenLength, cs.maskLength())
+
+	return compareTokens(requestToken, bindToken(realToken, cs.tokenBinding(r)))
+}
+
+// bindToken derives the token sent to clients from the real token and the
+// binding (see tokenBinding) it is issued for, so that a token minted for one
+// host fails validation on another. It returns
+// HMAC-SHA256(realToken, counter || binding), expanded with a counter as needed
+// and truncated to the length of the real token.
+func bindToken(realToken []byte, binding string) []byte {
+	bound := make([]byte, 0, len(realToken)+sha256.Size)
+	for i := byte(0); len(bound) < len(realToken); i++ {
+		mac := hmac.New(sha256.New, realToken)
+		mac.Write([]byte{i})
+		mac.Write([]byte(binding))
+		bound = mac.Sum(bound)
+	}
+
+	return bound[:len(realToken)]
 }
 
-// unmask splits the issued token (one-time-pad + masked token) and returns the
-// unmasked request token for comparison.
-func unmask(issued []byte) []byte {
+// tokenBinding returns the value that tokens are bound to. This is the cookie
+// Domain if one is set, as the cookie (and so the token) is then shared by
+// every host in it, or else the host the request was made to. With
+// BindClientIP, the client IP is appended, and then with BindUserAgent the
+// User-Agent.
+func (cs *csrf) tokenBinding(r *http.Request) string {
+	binding := strings.ToLower(r.Host)
+	if cs.opts.Domain != "" {
+		binding = strings.ToLower(strings.TrimPrefix(cs.opts.Domain, "."))
+	}
+
+	if cs.opts.BindClientIP {
+		binding += "\x00" + cs.clientIP(r)
+	}
+
+	if cs.opts.BindUserAgent {
+		binding += "\x00" + r.UserAgent()
+	}
+
+	return binding
+}
+
+// clientIP returns the IP address of the client: the first address in the
+// ClientIPHeader, if set and present, or else the request's remote address.
+func (cs *csrf) clientIP(r *http.Request) string {
+	if cs.opts.ClientIPHeader != "" {
+		// Proxies may append to a comma-separated list: the first entry is the
+		// client.
+		ip := strings.TrimSpace(strings.Split(r.Header.Get(cs.opts.ClientIPHeader), ",")[0])
+		if ip != "" {
+			return ip
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// unmaskToken splits the issued token (one-time-pad + masked token) and returns
+// the unmasked request token for comparison. n is the length of the real token
+// and padLength that of the pad. It returns nil if the issued token isn't the
+// expected length.
+func unmaskToken(issued []byte, n, padLength int) []byte {
 	// Issued tokens are always masked and combined with the pad.
-	if len(issued) != tokenLength*2 {
+	if padLength < 1 || len(issued) != padLength+n {
 		return nil
 	}
 
 	// We now know the length of the byte slice.
-	otp := issued[tokenLength:]
-	masked := issued[:tokenLength]
+	otp := issued[:padLength]
+	masked := issued[padLength:]
 
 	// Unmask the token by XOR'ing it against the OTP used to mask it.
-	return xorToken(otp, masked)
+	return xorPad(masked, otp)
 }
 
-// requestToken returns the issued token (pad + masked token) from the HTTP POST
-// body or HTTP header. It will return nil if the token fails to decode.
-func (cs *csrf) requestToken(r *http.Request) []byte {
-	// 1. Check the HTTP header first.
-	issued := r.Header.Get(cs.opts.RequestHeader)
+// requestToken returns the issued token (pad + masked token) from the
+// TokenExtractor, if set, or else the HTTP POST body, JSON body, query string or
+// HTTP header. It returns ErrNoToken if the
+// request doesn't include a token, and ErrBadToken if the token fails to
+// decode.
+func (cs *csrf) requestToken(r *http.Request) ([]byte, error) {
+	// A TokenExtractor replaces the built-in extraction entirely.
+	if cs.opts.TokenExtractor != nil {
+		issued, err := cs.opts.TokenExtractor(r)
+		if err != nil {
+			return nil, fmt.Errorf("%stoken extractor failed: %w", errorPrefix, err)
+		}
+
+		return decodeToken(issued, cs.opts.Encoding)
+	}
+
+	// 1. Check the HTTP headers first, in order.
+	var issued string
+	for _, header := range cs.opts.RequestHeaders {
+		if issued = cs.headerValue(r, header); issued != "" {
+			break
+		}
+	}
+
+	// 2. Fall back to the POST (form) value. Multipart forms are parsed in full
+	// so that any file parts remain available to the handler via r.FormFile
+	// and r.MultipartForm. Note that r.MultipartReader can't be used once the
+	// form has been parsed. A request without a body (as sent by some proxies
+	// and test harnesses) is treated as an empty form.
+	if issued == "" && r.Body != nil && r.Body != http.NoBody {
+		if isMultipart(r) {
+			r.ParseMultipartForm(cs.multipartMemory())
+		}
 
-	// 2. Fall back to the POST (form) value.
-	if issued == "" {
 		issued = r.PostFormValue(cs.opts.FieldName)
 	}
 
-	// 3. Finally, fall back to the multipart form (if set).
+	// 3. Fall back to the multipart form (if set).
 	if issued == "" && r.MultipartForm != nil {
 		vals := r.MultipartForm.Value[cs.opts.FieldName]
 
@@ -118,14 +899,348 @@ func (cs *csrf) requestToken(r *http.Request) []byte {
 		}
 	}
 
-	// Decode the "issued" (pad + masked) token sent in the request. Return a
-	// nil byte slice on a decoding error (this will fail upstream).
-	decoded, err := base64.StdEncoding.DecodeString(issued)
+	// 4. Fall back to a top-level key in a JSON request body (if configured).
+	if issued == "" && cs.opts.BodyFieldName != "" && isJSON(r) {
+		issued = jsonBodyValue(r, cs.opts.BodyFieldName, cs.jsonBodyLimit())
+	}
+
+	// 5. Finally, fall back to the URL query string (if configured).
+	if issued == "" && cs.opts.QueryFieldName != "" {
+		issued = r.URL.Query().Get(cs.opts.QueryFieldName)
+	}
+
+	return decodeToken(issued, cs.opts.Encoding)
+}
+
+// headerValue returns the value of the request header with the
+// HeaderValuePrefix (if set) removed. The prefix is matched case-insensitively,
+// as with HTTP authentication schemes, and a value without it is treated as
+// absent.
+func (cs *csrf) headerValue(r *http.Request, header string) string {
+	v := r.Header.Get(header)
+	prefix := cs.opts.HeaderValuePrefix
+	if prefix == "" {
+		return v
+	}
+
+	if len(v) < len(prefix) || !strings.EqualFold(v[:len(prefix)], prefix) {
+		return ""
+	}
+
+	return v[len(prefix):]
+}
+
+// decodeToken decodes the "issued" (pad + masked) token sent in the request
+// using the given encoding. It returns ErrNoToken if the token is empty, and
+// ErrBadToken if it fails to decode.
+func decodeToken(issued string, enc *base64.Encoding) ([]byte, error) {
+	if issued == "" {
+		return nil, ErrNoToken
+	}
+
+	decoded, err := enc.DecodeString(issued)
+	if err != nil {
+		return nil, ErrBadToken
+	}
+
+	return decoded, nil
+}
+
+// allowedContentType reports whether the media type of the request's
+// Content-Type is one of those allowed by RequireContentType.
+func (cs *csrf) allowedContentType(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+
+	return contains(cs.opts.ContentTypes, mediaType)
+}
+
+// isExempt reports whether the request is exempt from validation: its path
+// matches any of the exempt paths or glob patterns, or a Skip predicate
+// returns true.
+func (cs *csrf) isExempt(r *http.Request) bool {
+	if contains(cs.opts.ExemptPaths, r.URL.Path) {
+		return true
+	}
+
+	for _, pattern := range cs.opts.ExemptGlobs {
+		// Patterns are validated by the ExemptGlob option.
+		if ok, _ := path.Match(pattern, r.URL.Path); ok {
+			return true
+		}
+	}
+
+	for _, skip := range cs.opts.SkipFuncs {
+		if skip(r) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// addVary adds the value to the Vary header, unless it (or "*") is already
+// listed. Existing values are kept.
+func addVary(h http.Header, value string) {
+	for _, line := range h["Vary"] {
+		for _, v := range strings.Split(line, ",") {
+			v = strings.TrimSpace(v)
+			if v == "*" || strings.EqualFold(v, value) {
+				return
+			}
+		}
+	}
+
+	h.Add("Vary", value)
+}
+
+// failOpen reports whether the request should continue without a token when a
+// new token can't be saved with the given error, as per the
+// StoreFailurePolicy. By default, only safe requests continue. A cookie too
+// large to store is a misconfiguration that no request can recover from, so
+// it always fails closed.
+func (cs *csrf) failOpen(r *http.Request, err error) bool {
+	if errors.Is(err, ErrCookieTooLarge) {
+		return false
+	}
+
+	switch cs.opts.StoreFailurePolicy {
+	case FailOpen:
+		return true
+	case FailClosed:
+		return false
+	}
+
+	return contains(cs.opts.SafeMethods, r.Method)
+}
+
+// issues reports whether a token should be issued to requests without one:
+// either IssueOnPaths isn't set, or the request path is one of its paths. In
+// HeaderOnly mode, the request must also have a session header.
+func (cs *csrf) issues(r *http.Request) bool {
+	// In HeaderOnly mode, tokens can't be saved without a session.
+	if cs.opts.SessionHeader != "" && r.Header.Get(cs.opts.SessionHeader) == "" {
+		return false
+	}
+
+	return cs.opts.IssuePaths == nil || contains(cs.opts.IssuePaths, r.URL.Path)
+}
+
+// isJSON reports whether the request body is declared as JSON.
+func isJSON(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+
+	return mediaType == "application/json"
+}
+
+// limitedBody wraps a request body limited by http.MaxBytesReader, and records
+// whether reading it failed because the limit was exceeded.
+type limitedBody struct {
+	io.ReadCloser
+	limit    int64
+	read     int64
+	exceeded bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if err != nil && err != io.EOF && b.read >= b.limit {
+		b.exceeded = true
+	}
+
+	return n, err
+}
+
+// isMultipart reports whether the request body is declared as a multipart form.
+func isMultipart(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+
+	return mediaType == "multipart/form-data"
+}
+
+// jsonBodyValue returns the string value of the named top-level key in a JSON
+// request body. The body is buffered and restored so that it can still be read
+// by the wrapped handler. An empty string is returned if the body can't be
+// read, is larger than limit, isn't a JSON object or the key isn't a string.
+func jsonBodyValue(r *http.Request, name string, limit int64) string {
+	if r.Body == nil {
+		return ""
+	}
+
+	// Read one byte past the limit to tell a body of exactly limit bytes from a
+	// larger one.
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err == nil && int64(len(body)) > limit {
+		// Don't buffer the rest: hand the handler what was read followed by
+		// the unread remainder.
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return ""
+	}
+
+	r.Body.Close()
+	// Restore whatever we read so the downstream handler sees the same payload.
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return ""
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return ""
+	}
+
+	var value string
+	if err := json.Unmarshal(fields[name], &value); err != nil {
+		return ""
+	}
+
+	return value
+}
+
+// setJSCookie writes the masked token to a cookie that is readable by
+// JavaScript: see AngularCompat.
+func (cs *csrf) setJSCookie(w http.ResponseWriter, token string) {
+	cookie := &http.Cookie{
+		Name:     cs.opts.JSCookieName,
+		Value:    token,
+		HttpOnly: false,
+		Secure:   cs.opts.Secure,
+		Path:     cs.opts.Path,
+		Domain:   cs.opts.Domain,
+		SameSite: http.SameSite(cs.opts.SameSite),
+	}
+
+	// Match the lifetime of the session cookie (see MaxAge).
+	setMaxAge(cookie, cs.opts.MaxAge)
+
+	http.SetCookie(w, cookie)
+}
+
+// validJSCookie reports whether the request carries a JavaScript-readable token
+// cookie (see setJSCookie) that is valid for the real token.
+func (cs *csrf) validJSCookie(r *http.Request, realToken []byte) bool {
+	cookie, err := r.Cookie(cs.opts.JSCookieName)
+	if err != nil {
+		return false
+	}
+
+	issued, err := decodeToken(cookie.Value, cs.opts.Encoding)
 	if err != nil {
+		return false
+	}
+
+	return cs.verifyToken(issued, realToken, r)
+}
+
+// getToken retrieves the real token from the store. When a TokenTTL is set, the
+// issuance timestamp stored in front of the token is stripped, and expired
+// reports whether the token is older than the TTL.
+func (cs *csrf) getToken(r *http.Request) (token []byte, expired bool, err error) {
+	token, err = cs.st.Get(r)
+	if err != nil || cs.opts.TokenTTL <= 0 {
+		return token, false, err
+	}
+
+	if len(token) < timestampLength {
+		return nil, false, ErrBadToken
+	}
+
+	issued := time.Unix(int64(binary.BigEndian.Uint64(token[:timestampLength])), 0)
+
+	return token[timestampLength:], time.Since(issued) > cs.opts.TokenTTL, nil
+}
+
+// missingToken reports whether getToken found no token for the session: the
+// client didn't send the cookie, or the store has no token for it. Other
+// errors (e.g. a cookie that fails the HMAC check) mean the token is bad.
+func missingToken(token []byte, err error) bool {
+	return err == http.ErrNoCookie || errors.Is(err, ErrNoToken) ||
+		(err == nil && len(token) == 0)
+}
+
+// saveToken saves the real token to the store. When a TokenTTL is set, the
+// token is prefixed with the current time so that its age can be checked by
+// any store. Errors from the store are wrapped in ErrStoreFailure.
+func (cs *csrf) saveToken(token []byte, w http.ResponseWriter, r *http.Request) error {
+	token = cs.stampToken(token)
+
+	var err error
+	if hs, ok := cs.st.(*headerStore); ok {
+		err = hs.saveRequest(token, w, r)
+	} else {
+		err = cs.st.Save(token, w)
+	}
+
+	if err != nil {
+		return storeError{err}
+	}
+
+	return nil
+}
+
+// refreshToken re-saves the real token to extend its lifetime, for
+// SlidingExpiry. A TokenRefresher keeps the session ID. Other stores save the
+// token anew, and clear the previous token first, so that a server-side store
+// doesn't keep an entry for every request. Errors from the store are wrapped
+// in ErrStoreFailure.
+func (cs *csrf) refreshToken(token []byte, w http.ResponseWriter, r *http.Request) error {
+	if rf, ok := cs.st.(TokenRefresher); ok {
+		if err := rf.Refresh(cs.stampToken(token), w, r); err != nil {
+			return storeError{err}
+		}
+
 		return nil
 	}
 
-	return decoded
+	// The session cookie is overwritten by saveToken, so the cleared cookie
+	// isn't written.
+	if tc, ok := cs.st.(TokenClearer); ok {
+		if err := tc.Clear(discardWriter{}, r); err != nil {
+			return storeError{err}
+		}
+	}
+
+	return cs.saveToken(token, w, r)
+}
+
+// stampToken prefixes the token with the current time when a TokenTTL is set,
+// so that its age can be checked by any store.
+func (cs *csrf) stampToken(token []byte) []byte {
+	if cs.opts.TokenTTL <= 0 {
+		return token
+	}
+
+	stamped := make([]byte, timestampLength, timestampLength+len(token))
+	binary.BigEndian.PutUint64(stamped, uint64(time.Now().Unix()))
+
+	return append(stamped, token...)
+}
+
+// newToken returns a new real token, read from the RandReader if one has been
+// set.
+func (cs *csrf) newToken() ([]byte, error) {
+	if cs.opts.RandReader == nil {
+		return generateRandomBytes(cs.opts.TokenLength)
+	}
+
+	b := make([]byte, cs.opts.TokenLength)
+	if _, err := io.ReadFull(cs.opts.RandReader, b); err != nil {
+		return nil, err
+	}
+
+	return b, nil
 }
 
 // generateRandomBytes returns securely generated random bytes.
@@ -149,30 +1264,175 @@ func sameOrigin(a, b *url.URL) bool {
 	return (a.Scheme == b.Scheme && a.Host == b.Host)
 }
 
-// compare securely (constant-time) compares the unmasked token from the request
-// against the real token from the session.
-func compareTokens(a, b []byte) bool {
-	if subtle.ConstantTimeCompare(a, b) == 1 {
+// requestURL returns the request URL as seen by the client. Server requests
+// only carry the path in r.URL, so the host is taken from r.Host and the scheme
+// from the connection. When proxy headers are trusted, the scheme is taken from
+// the X-Forwarded-Proto header set by a TLS-terminating proxy.
+func (cs *csrf) requestURL(r *http.Request) *url.URL {
+	u := *r.URL
+	if u.Host == "" {
+		u.Host = r.Host
+	}
+	if u.Scheme == "" {
+		u.Scheme = "http"
+		if r.TLS != nil {
+			u.Scheme = "https"
+		}
+	}
+
+	if !cs.opts.TrustProxyHeaders {
+		return &u
+	}
+
+	// Proxies may send a comma-separated list: the first entry is the
+	// client-facing protocol.
+	proto := strings.TrimSpace(strings.Split(r.Header.Get("X-Forwarded-Proto"), ",")[0])
+	if proto != "" {
+		u.Scheme = strings.ToLower(proto)
+	}
+
+	return &u
+}
+
+// checkOrigin verifies that a request comes from the same origin as the
+// request URL u (or a trusted origin). The Origin header is checked first, as
+// some browsers strip the Referer header, falling back to the Referer header
+// when Origin is absent.
+func (cs *csrf) checkOrigin(r *http.Request, u *url.URL) error {
+	if cs.opts.DisableRefererCheck {
+		return nil
+	}
+
+	if origin := r.Header.Get("Origin"); origin != "" {
+		o, err := url.Parse(origin)
+		if err != nil || !cs.allowedOrigin(u, o) {
+			return ErrBadOrigin
+		}
+
+		return nil
+	}
+
+	if referer := r.Referer(); referer != "" {
+		ref, err := url.Parse(referer)
+		if err != nil || !cs.allowedOrigin(u, ref) {
+			return ErrBadReferer
+		}
+
+		return nil
+	}
+
+	// Local development tools don't always send either header.
+	if cs.opts.DevMode && isLoopback(u.Hostname()) {
+		return nil
+	}
+
+	// Neither do native apps, which HeaderOnly is for.
+	if cs.opts.SessionHeader != "" {
+		return nil
+	}
+
+	return ErrNoOrigin
+}
+
+// checkFetchSite returns ErrCrossSite if the Sec-Fetch-Site header reports a
+// cross-site request, unless its Origin is trusted. Requests without the header
+// are left to the other checks.
+func (cs *csrf) checkFetchSite(r *http.Request) error {
+	if !strings.EqualFold(r.Header.Get("Sec-Fetch-Site"), "cross-site") {
+		return nil
+	}
+
+	if o, err := url.Parse(r.Header.Get("Origin")); err == nil && o.Host != "" && cs.isTrustedOrigin(o) {
+		return nil
+	}
+
+	return ErrCrossSite
+}
+
+// allowedOrigin returns true if the origin matches the request URL or one of
+// the trusted origins. In DevMode, any loopback origin is allowed for requests
+// to a loopback host - e.g. a front-end dev server on another port.
+func (cs *csrf) allowedOrigin(u, origin *url.URL) bool {
+	if cs.opts.DevMode && isLoopback(u.Hostname()) && isLoopback(origin.Hostname()) {
+		return true
+	}
+
+	return sameOrigin(u, origin) || cs.isTrustedOrigin(origin)
+}
+
+// isLoopback reports whether host is "localhost" or a loopback IP address.
+func isLoopback(host string) bool {
+	if strings.EqualFold(host, "localhost") {
 		return true
 	}
 
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// isTrustedOrigin returns true if the scheme & host of the URL match one of
+// the trusted origins, including any wildcard origins.
+func (cs *csrf) isTrustedOrigin(u *url.URL) bool {
+	origin := normalizeOrigin(u)
+	for _, trusted := range cs.opts.TrustedOrigins {
+		if origin == trusted || matchWildcardOrigin(trusted, origin) {
+			return true
+		}
+	}
+
 	return false
 }
 
-// xorToken XORs tokens ([]byte) to provide unique-per-request CSRF tokens. It
-// will return a masked token if the base token is XOR'ed with a one-time-pad.
-// An unmasked token will be returned if a masked token is XOR'ed with the
-// one-time-pad used to mask it.
-func xorToken(a, b []byte) []byte {
-	n := len(a)
-	if len(b) < n {
-		n = len(b)
+// matchWildcardOrigin returns true if the normalized origin is a subdomain of
+// a trusted "scheme://*.host" origin. The scheme (and port) must match, and
+// the origin must have at least one more label than the trusted host.
+func matchWildcardOrigin(trusted, origin string) bool {
+	i := strings.Index(trusted, "://"+wildcardPrefix)
+	if i < 0 {
+		return false
+	}
+
+	scheme := trusted[:i+len("://")]
+	// Keep the leading "." so that "evilexample.com" doesn't match.
+	suffix := trusted[i+len("://*"):]
+
+	if !strings.HasPrefix(origin, scheme) {
+		return false
 	}
 
-	res := make([]byte, n)
+	host := origin[len(scheme):]
+	return len(host) > len(suffix) && strings.HasSuffix(host, suffix) &&
+		!strings.HasPrefix(host, ".")
+}
+
+// normalizeOrigin returns the lower-cased "scheme://host" form of a URL for
+// origin comparisons.
+func normalizeOrigin(u *url.URL) string {
+	return strings.ToLower(u.Scheme + "://" + u.Host)
+}
+
+// compare securely (constant-time) compares the unmasked token from the request
+// (a) against the real token from the session (b).
+//
+// subtle.ConstantTimeCompare returns early when the lengths differ, so a is
+// first copied into (or truncated to) a slice of the same length as b. The
+// length check is then folded into the result without branching.
+func compareTokens(a, b []byte) bool {
+	padded := make([]byte, len(b))
+	copy(padded, a)
+
+	equal := subtle.ConstantTimeCompare(padded, b)
+	sameLength := subtle.ConstantTimeEq(int32(len(a)), int32(len(b)))
 
-	for i := 0; i < n; i++ {
-		res[i] = a[i] ^ b[i]
+	return equal&sameLength == 1
+}
+
+// xorPad XORs the token with the pad, repeating the pad as needed to cover the
+// whole token. The result is the same length as the token.
+func xorPad(token, pad []byte) []byte {
+	res := make([]byte, len(token))
+	for i := range token {
+		res[i] = token[i] ^ pad[i%len(pad)]
 	}
 
 	return res
@@ -189,8 +1449,3 @@ func contains(vals []string, s string) bool {
 
 	return false
 }
-
-// setEnvError returns a request context with the CSRF error
-func setEnvError(ctx context.Context, err error) context.Context {
-	return context.WithValue(ctx, errorKey, err)
-}
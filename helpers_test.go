@@ -4,12 +4,16 @@ import (
 	"bytes"
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
 	"strings"
 	"testing"
 	"text/template"
@@ -69,6 +73,146 @@ func TestFormToken(t *testing.T) {
 	}
 }
 
+// Test that the token is available from the request context.
+func TestTokenFromRequest(t *testing.T) {
+	m := goji.NewMux()
+	m.UseC(Protect(testKey))
+
+	var token, fromRequest string
+	m.HandleFuncC(pat.New("/"), func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		token = Token(ctx, r)
+		fromRequest = TokenFromRequest(r)
+	})
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.ServeHTTP(httptest.NewRecorder(), r)
+
+	if token == "" || fromRequest != token {
+		t.Fatalf("TokenFromRequest did not match Token: got %q want %q", fromRequest, token)
+	}
+
+	// Requests that haven't passed through the middleware have no token.
+	if got := TokenFromRequest(r); got != "" {
+		t.Fatalf("TokenFromRequest returned a token without the middleware: got %q", got)
+	}
+}
+
+// TestUnmaskedToken tests that the unmasked token is the real token from the
+// store, and is empty without the middleware.
+func TestUnmaskedToken(t *testing.T) {
+	st := &singleTokenStore{}
+	m := goji.NewMux()
+	m.UseC(Protect(testKey, Store(st)))
+
+	var token, unmasked string
+	m.HandleFuncC(pat.New("/"), func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		token = Token(ctx, r)
+		unmasked = UnmaskedToken(ctx, r)
+	})
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.ServeHTTP(httptest.NewRecorder(), r)
+
+	if want := base64.StdEncoding.EncodeToString(st.token); unmasked != want {
+		t.Fatalf("unmasked token does not match the stored token: got %q want %q", unmasked, want)
+	}
+
+	if unmasked == token {
+		t.Fatal("unmasked token matches the masked token")
+	}
+
+	if got := UnmaskedToken(context.Background(), r); got != "" {
+		t.Fatalf("UnmaskedToken returned a token without the middleware: got %q", got)
+	}
+}
+
+// TestRegenerate tests that a regenerated token replaces the token in the
+// request context and store, and that the previous token no longer validates.
+func TestRegenerate(t *testing.T) {
+	m := goji.NewMux()
+	m.UseC(Protect(testKey))
+
+	var token, regenerated, after string
+	m.HandleFuncC(pat.Get("/"), func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		token = Token(ctx, r)
+	})
+	m.HandleFuncC(pat.Post("/login"), func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		var err error
+		regenerated, err = Regenerate(ctx, w, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		after = Token(ctx, r)
+	})
+	m.HandleFuncC(pat.Post("/"), testHandler)
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	m.ServeHTTP(rr, r)
+
+	r, err = http.NewRequest("POST", "/login", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setCookie(rr, r)
+	r.Header.Set("X-CSRF-Token", token)
+
+	loginRR := httptest.NewRecorder()
+	m.ServeHTTP(loginRR, r)
+
+	if regenerated == "" || regenerated != after {
+		t.Fatalf("Token did not return the regenerated token: got %q want %q", after, regenerated)
+	}
+
+	if loginRR.Header().Get("Set-Cookie") == "" {
+		t.Fatal("regenerated token was not saved")
+	}
+
+	var tokenTests = []struct {
+		cookie   *httptest.ResponseRecorder
+		token    string
+		expected int
+	}{
+		{loginRR, regenerated, http.StatusOK},
+		{loginRR, token, http.StatusForbidden},
+	}
+
+	for _, v := range tokenTests {
+		r, err = http.NewRequest("POST", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		setCookie(v.cookie, r)
+		r.Header.Set("X-CSRF-Token", v.token)
+
+		rr = httptest.NewRecorder()
+		m.ServeHTTP(rr, r)
+
+		if rr.Code != v.expected {
+			t.Errorf("post-regeneration request failed: got %v want %v", rr.Code, v.expected)
+		}
+	}
+
+	// Regenerate requires the middleware.
+	if _, err := Regenerate(context.Background(), httptest.NewRecorder(), r); err == nil {
+		t.Fatal("Regenerate did not report a missing middleware")
+	}
+}
+
 // Test that we can extract a CSRF token from a multipart form.
 func TestMultipartFormToken(t *testing.T) {
 	m := goji.NewMux()
@@ -127,115 +271,151 @@ func TestMultipartFormToken(t *testing.T) {
 	}
 }
 
-// TestMaskUnmaskTokens tests that a token traversing the mask -> unmask process
-// is correctly unmasked to the original 'real' token.
-func TestMaskUnmaskTokens(t *testing.T) {
-	t.Parallel()
+// Test that file parts of a multipart form are still available to the handler
+// after the token has been extracted.
+func TestMultipartFileUpload(t *testing.T) {
+	contents := []byte("the uploaded file contents")
 
-	realToken, err := generateRandomBytes(tokenLength)
+	var token string
+	var received []byte
+	s := Protect(testKey)(goji.HandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		token = Token(ctx, r)
+		if r.Method != "POST" {
+			return
+		}
+
+		f, _, err := r.FormFile("upload")
+		if err != nil {
+			t.Fatalf("file part not available to the handler: %v", err)
+		}
+		defer f.Close()
+
+		received, err = ioutil.ReadAll(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}))
+
+	r, err := http.NewRequest("GET", "/", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	issued := mask(realToken, nil)
-	decoded, err := base64.StdEncoding.DecodeString(issued)
+	rr := httptest.NewRecorder()
+	s.ServeHTTPC(context.Background(), rr, r)
+
+	// Set up a multipart form with both the token and a file part.
+	var b bytes.Buffer
+	mp := multipart.NewWriter(&b)
+	wr, err := mp.CreateFormFile("upload", "upload.txt")
 	if err != nil {
 		t.Fatal(err)
 	}
+	wr.Write(contents)
 
-	unmasked := unmask(decoded)
-	if !compareTokens(unmasked, realToken) {
-		t.Fatalf("tokens do not match: got %x want %x", unmasked, realToken)
+	if err := mp.WriteField(fieldName, token); err != nil {
+		t.Fatal(err)
 	}
-}
+	mp.Close()
 
-// Tests domains that should (or should not) return true for a
-// same-origin check.
-func TestSameOrigin(t *testing.T) {
-	var originTests = []struct {
-		o1       string
-		o2       string
-		expected bool
-	}{
-		{"https://goji.io/", "https://goji.io", true},
-		{"http://golang.org/", "http://golang.org/pkg/net/http", true},
-		{"https://goji.io/", "http://goji.io", false},
-		{"https://goji.io:3333/", "http://goji.io:4444", false},
+	r, err = http.NewRequest("POST", "/", &b)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	for _, origins := range originTests {
-		a, err := url.Parse(origins.o1)
-		if err != nil {
-			t.Fatal(err)
+	r.Header.Set("Content-Type", mp.FormDataContentType())
+	setCookie(rr, r)
+
+	rr = httptest.NewRecorder()
+	s.ServeHTTPC(context.Background(), rr, r)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("middleware failed to pass to the next handler: got %v want %v",
+			rr.Code, http.StatusOK)
+	}
+
+	if !bytes.Equal(received, contents) {
+		t.Fatalf("file part not received intact: got %q want %q", received, contents)
+	}
+}
+
+// TestMultipartMaxMemory tests that the token is read from the field of a
+// multipart form parsed with a MultipartMaxMemory limit, and that the file
+// parts beyond the limit are spilled to disk.
+func TestMultipartMaxMemory(t *testing.T) {
+	contents := bytes.Repeat([]byte("x"), 1024)
+
+	var token string
+	var onDisk bool
+	s := Protect(testKey, MultipartMaxMemory(64))(goji.HandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		token = Token(ctx, r)
+		if r.Method != "POST" {
+			return
 		}
+		defer r.MultipartForm.RemoveAll()
 
-		b, err := url.Parse(origins.o2)
+		f, _, err := r.FormFile("upload")
 		if err != nil {
-			t.Fatal(err)
+			t.Fatalf("file part not available to the handler: %v", err)
 		}
+		defer f.Close()
 
-		if sameOrigin(a, b) != origins.expected {
-			t.Fatalf("origin checking failed: %v and %v, expected %v",
-				origins.o1, origins.o2, origins.expected)
-		}
+		_, onDisk = f.(*os.File)
+	}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
 	}
-}
 
-func TestXOR(t *testing.T) {
-	testTokens := []struct {
-		a        []byte
-		b        []byte
-		expected []byte
-	}{
-		{[]byte("goodbye"), []byte("hello"), []byte{15, 10, 3, 8, 13}},
-		{[]byte("gophers"), []byte("clojure"), []byte{4, 3, 31, 2, 16, 0, 22}},
-		{nil, []byte("requestToken"), nil},
+	rr := httptest.NewRecorder()
+	s.ServeHTTPC(context.Background(), rr, r)
+
+	var b bytes.Buffer
+	mp := multipart.NewWriter(&b)
+	if err := mp.WriteField(fieldName, token); err != nil {
+		t.Fatal(err)
 	}
 
-	for _, token := range testTokens {
-		if res := xorToken(token.a, token.b); res != nil {
-			if bytes.Compare(res, token.expected) != 0 {
-				t.Fatalf("xorBytes failed to return the expected result: got %v want %v",
-					res, token.expected)
-			}
-		}
+	wr, err := mp.CreateFormFile("upload", "upload.txt")
+	if err != nil {
+		t.Fatal(err)
 	}
+	wr.Write(contents)
+	mp.Close()
 
-}
+	r, err = http.NewRequest("POST", "/", &b)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-// shortReader provides a broken implementation of io.Reader for testing.
-type shortReader struct{}
+	r.Header.Set("Content-Type", mp.FormDataContentType())
+	setCookie(rr, r)
 
-func (sr shortReader) Read(p []byte) (int, error) {
-	return len(p) % 2, io.ErrUnexpectedEOF
-}
+	rr = httptest.NewRecorder()
+	s.ServeHTTPC(context.Background(), rr, r)
 
-// TestGenerateRandomBytes tests the (extremely rare) case that crypto/rand does
-// not return the expected number of bytes.
-func TestGenerateRandomBytes(t *testing.T) {
-	// Pioneered from https://github.com/justinas/nosurf
-	original := rand.Reader
-	rand.Reader = shortReader{}
-	defer func() {
-		rand.Reader = original
-	}()
+	if rr.Code != http.StatusOK {
+		t.Fatalf("multipart form token not accepted: got %v want %v", rr.Code, http.StatusOK)
+	}
 
-	b, err := generateRandomBytes(tokenLength)
-	if err == nil {
-		t.Fatalf("generateRandomBytes did not report a short read: only read %d bytes", len(b))
+	if !onDisk {
+		t.Fatal("file part held in memory despite the MultipartMaxMemory limit")
+	}
+
+	if _, err := newCSRF(testKey, MultipartMaxMemory(0)); err == nil {
+		t.Fatal("MultipartMaxMemory accepted a limit of 0")
 	}
 }
 
-func TestTemplateField(t *testing.T) {
+// Test that a token in any of the configured request headers validates.
+func TestRequestHeaders(t *testing.T) {
 	m := goji.NewMux()
-	CSRF := Protect(testKey, FieldName(testFieldName))
-	m.UseC(CSRF)
+	m.UseC(Protect(testKey, RequestHeaders("X-XSRF-Token", "X-CSRF-Token")))
 
 	var token string
-	var customTemplateField string
 	m.HandleFuncC(pat.New("/"), func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 		token = Token(ctx, r)
-		customTemplateField = string(TemplateField(ctx, r))
 	})
 
 	r, err := http.NewRequest("GET", "/", nil)
@@ -246,49 +426,1570 @@ func TestTemplateField(t *testing.T) {
 	rr := httptest.NewRecorder()
 	m.ServeHTTP(rr, r)
 
-	expectedTemplateField := fmt.Sprintf(testTemplateField, testFieldName, token)
-
-	if customTemplateField != expectedTemplateField {
-		t.Fatalf("templateField not set correctly: got %v want %v",
-			customTemplateField, expectedTemplateField)
+	var headerTests = []struct {
+		header   string
+		expected int
+	}{
+		{"X-XSRF-Token", http.StatusOK},
+		{"X-CSRF-Token", http.StatusOK},
+		{"X-Other-Token", http.StatusForbidden},
 	}
-}
 
-func TestUnsafeSkipCSRFCheck(t *testing.T) {
-	m := goji.NewMux()
-	skipCheck := func(h goji.Handler) goji.Handler {
-		fn := func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-			ctx = UnsafeSkipCheck(ctx)
-			h.ServeHTTPC(ctx, w, r)
+	for _, v := range headerTests {
+		r, err := http.NewRequest("POST", "/", nil)
+		if err != nil {
+			t.Fatal(err)
 		}
 
-		return goji.HandlerFunc(fn)
-	}
+		setCookie(rr, r)
+		r.Header.Set(v.header, token)
 
-	// Must be used prior to the CSRF handler being invoked.
-	m.UseC(skipCheck)
+		rr2 := httptest.NewRecorder()
+		m.ServeHTTP(rr2, r)
 
-	CSRF := Protect(testKey)
-	m.UseC(CSRF)
+		if rr2.Code != v.expected {
+			t.Errorf("request header check failed for %s: got %v want %v",
+				v.header, rr2.Code, v.expected)
+		}
+	}
+}
 
-	var teapot = 418
+// Test that we can extract a CSRF token from a JSON request body without
+// consuming it.
+func TestJSONBodyToken(t *testing.T) {
+	m := goji.NewMux()
+	m.UseC(Protect(testKey, BodyFieldName("csrf_token")))
 
-	// Issue a POST request without a CSRF token in the request.
+	var token string
+	m.HandleFuncC(pat.Get("/"), func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		token = Token(ctx, r)
+	})
+
+	// The downstream handler should still see the full payload.
+	var received string
 	m.HandleFuncC(pat.Post("/"), func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-		// Set a non-200 header to make the test explicit.
-		w.WriteHeader(teapot)
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		received = string(b)
 	})
 
-	r, err := http.NewRequest("POST", "/", nil)
+	r, err := http.NewRequest("GET", "/", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	rr := httptest.NewRecorder()
-	m.ServeHTTPC(context.Background(), rr, r)
+	m.ServeHTTP(rr, r)
+	cookie := rr.Header().Get("Set-Cookie")
 
-	if status := rr.Code; status != teapot {
-		t.Fatalf("middleware failed to skip this request: got %v want %v",
-			status, teapot)
+	payload := fmt.Sprintf(`{"name": "goji", "csrf_token": %q}`, token)
+	r, err = http.NewRequest("POST", "/", strings.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.Header.Set("Content-Type", "application/json; charset=utf-8")
+	setCookie(rr, r)
+
+	rr = httptest.NewRecorder()
+	m.ServeHTTP(rr, r)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("middleware failed to pass to the next handler: got %v want %v",
+			rr.Code, http.StatusOK)
+	}
+
+	if received != payload {
+		t.Fatalf("request body not restored: got %q want %q", received, payload)
+	}
+
+	// Bodies over the limit aren't buffered in search of a token.
+	received = ""
+	payload = fmt.Sprintf(`{"csrf_token": %q, "padding": "%s"}`, token, strings.Repeat("x", jsonMaxBodyBytes))
+	r, err = http.NewRequest("POST", "/", strings.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Cookie", cookie)
+
+	rr = httptest.NewRecorder()
+	m.ServeHTTP(rr, r)
+
+	if rr.Code != http.StatusForbidden || received != "" {
+		t.Fatalf("oversized body accepted: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+}
+
+// Test that we can extract a CSRF token from the query string, and only when
+// the option is set.
+func TestQueryToken(t *testing.T) {
+	var queryTests = []struct {
+		opts     []Option
+		expected int
+	}{
+		{nil, http.StatusForbidden},
+		{[]Option{QueryFieldName("csrf_token")}, http.StatusOK},
+	}
+
+	for _, v := range queryTests {
+		m := goji.NewMux()
+		m.UseC(Protect(testKey, v.opts...))
+
+		var token string
+		m.HandleFuncC(pat.New("/"), func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			token = Token(ctx, r)
+		})
+
+		r, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		m.ServeHTTP(rr, r)
+
+		r, err = http.NewRequest("POST", "/?csrf_token="+url.QueryEscape(token), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		setCookie(rr, r)
+
+		rr = httptest.NewRecorder()
+		m.ServeHTTP(rr, r)
+
+		if rr.Code != v.expected {
+			t.Errorf("query token check failed: got %v want %v", rr.Code, v.expected)
+		}
+	}
+}
+
+// TestNilBody tests that a POST without a body is treated as an empty form,
+// and the token is read from the other sources.
+func TestNilBody(t *testing.T) {
+	s := Protect(testKey, QueryFieldName("csrf_token"), MaxBodyBytes(1024),
+		ResponseHeader("X-CSRF-Token"))(testHandler)
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTPC(context.Background(), rr, r)
+	token := rr.Header().Get("X-CSRF-Token")
+
+	for _, target := range []string{"/", "/?csrf_token=" + url.QueryEscape(token)} {
+		for _, body := range []io.ReadCloser{nil, http.NoBody} {
+			r, err := http.NewRequest("POST", target, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r.Body = body
+			setCookie(rr, r)
+			if target == "/" {
+				r.Header.Set("X-CSRF-Token", token)
+			}
+
+			post := httptest.NewRecorder()
+			s.ServeHTTPC(context.Background(), post, r)
+
+			if post.Code != http.StatusOK {
+				t.Errorf("POST %s with body %v: got %v want %v", target, body, post.Code, http.StatusOK)
+			}
+		}
+	}
+}
+
+// Test that a TokenExtractor replaces the built-in extraction, and that its
+// errors are passed to the error handler.
+func TestTokenExtractor(t *testing.T) {
+	errMissing := errors.New("no grpc-web metadata")
+	extractor := func(r *http.Request) (string, error) {
+		if r.Header.Get("Grpc-Metadata-Csrf") == "" && r.Header.Get("X-Grpc-Web") != "" {
+			return "", errMissing
+		}
+
+		return r.Header.Get("Grpc-Metadata-Csrf"), nil
+	}
+
+	var reason error
+	errorHandler := ErrorHandlerFunc(func(w http.ResponseWriter, r *http.Request, err error) {
+		reason = err
+		http.Error(w, "", http.StatusForbidden)
+	})
+
+	var token string
+	s := Protect(testKey, TokenExtractor(extractor), errorHandler)(goji.HandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		token = Token(ctx, r)
+	}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTPC(context.Background(), rr, r)
+
+	var extractorTests = []struct {
+		headers  map[string]string
+		expected int
+		reason   error
+	}{
+		{map[string]string{"Grpc-Metadata-Csrf": token}, http.StatusOK, nil},
+		// The built-in header is ignored.
+		{map[string]string{"X-CSRF-Token": token}, http.StatusForbidden, ErrNoToken},
+		{map[string]string{"X-Grpc-Web": "1"}, http.StatusForbidden, errMissing},
+	}
+
+	for _, v := range extractorTests {
+		reason = nil
+
+		r, err := http.NewRequest("POST", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for k, h := range v.headers {
+			r.Header.Set(k, h)
+		}
+		setCookie(rr, r)
+
+		rr2 := httptest.NewRecorder()
+		s.ServeHTTPC(context.Background(), rr2, r)
+
+		if rr2.Code != v.expected {
+			t.Errorf("%v: got %v want %v", v.headers, rr2.Code, v.expected)
+		}
+
+		if !errors.Is(reason, v.reason) {
+			t.Errorf("%v: wrong failure reason: got %v want %v", v.headers, reason, v.reason)
+		}
+	}
+}
+
+// Test that ValidateUpgrade checks the origin and token of upgrade requests.
+func TestValidateUpgrade(t *testing.T) {
+	var token string
+	var result error
+	s := Protect(testKey, QueryFieldName("csrf_token"), TrustedOrigins([]string{"https://app.example.com"}))(
+		goji.HandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			token = Token(ctx, r)
+			result = ValidateUpgrade(r)
+		}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Host = "example.com"
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTPC(context.Background(), rr, r)
+
+	cs, err := newCSRF(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var upgradeTests = []struct {
+		name     string
+		origin   string
+		token    string
+		expected error
+	}{
+		{"valid", "http://example.com", token, nil},
+		{"trusted origin", "https://app.example.com", token, nil},
+		{"cross-site", "http://evil.example", token, ErrBadOrigin},
+		{"no origin", "", token, ErrNoOrigin},
+		{"no token", "http://example.com", "", ErrNoToken},
+		{"wrong token", "http://example.com", cs.issueToken(make([]byte, tokenLength), r), ErrBadToken},
+	}
+
+	for _, v := range upgradeTests {
+		r, err := http.NewRequest("GET", "/ws?csrf_token="+url.QueryEscape(v.token), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Server requests carry only the path and query in r.URL.
+		r.URL.Scheme, r.URL.Host = "", ""
+		r.Host = "example.com"
+		r.Header.Set("Connection", "Upgrade")
+		r.Header.Set("Upgrade", "websocket")
+		if v.origin != "" {
+			r.Header.Set("Origin", v.origin)
+		}
+		setCookie(rr, r)
+
+		s.ServeHTTPC(context.Background(), httptest.NewRecorder(), r)
+
+		if result != v.expected {
+			t.Errorf("%s: got %v want %v", v.name, result, v.expected)
+		}
+	}
+
+	r, err = http.NewRequest("GET", "/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ValidateUpgrade(r); err == nil {
+		t.Error("ValidateUpgrade accepted a request the middleware wasn't applied to")
+	}
+}
+
+// TestMaskUnmaskTokens tests that a token traversing the issue -> verify
+// process is accepted for the original 'real' token, and only for it.
+func TestMaskUnmaskTokens(t *testing.T) {
+	t.Parallel()
+
+	cs, err := newCSRF(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	realToken, err := generateRandomBytes(tokenLength)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issued := cs.issueToken(realToken, r)
+	decoded, err := base64.StdEncoding.DecodeString(issued)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !cs.verifyToken(decoded, realToken, r) {
+		t.Fatalf("issued token %q not accepted", issued)
+	}
+
+	// Each issued token is masked with a fresh pad.
+	if again := cs.issueToken(realToken, r); again == issued {
+		t.Fatalf("token issued twice with the same pad: %q", issued)
+	}
+
+	if cs.verifyToken(decoded, make([]byte, tokenLength), r) {
+		t.Fatal("issued token accepted for a different real token")
+	}
+}
+
+// TestMaskLength tests that tokens masked with pads shorter and longer than the
+// token round-trip, both directly and through the middleware.
+func TestMaskLength(t *testing.T) {
+	realToken, err := generateRandomBytes(tokenLength)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, padLength := range []int{1, 8, tokenLength, 48, 64} {
+		cs, err := newCSRF(testKey, MaskLength(padLength))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		decoded, err := base64.StdEncoding.DecodeString(cs.issueToken(realToken, r))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(decoded) != tokenLength+padLength {
+			t.Errorf("pad length %d: wrong masked length: got %d want %d",
+				padLength, len(decoded), tokenLength+padLength)
+		}
+
+		if !cs.verifyToken(decoded, realToken, r) {
+			t.Errorf("pad length %d: issued token not accepted", padLength)
+		}
+
+		// The pad length is part of the format.
+		other, err := newCSRF(testKey, MaskLength(padLength+1))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if other.verifyToken(decoded, realToken, r) {
+			t.Errorf("pad length %d: accepted with the wrong pad length", padLength)
+		}
+
+		var token string
+		s := Protect(testKey, MaskLength(padLength))(goji.HandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			token = Token(ctx, r)
+		}))
+
+		r, err = http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		s.ServeHTTPC(context.Background(), rr, r)
+
+		r, err = http.NewRequest("POST", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		setCookie(rr, r)
+		r.Header.Set("X-CSRF-Token", token)
+
+		rr = httptest.NewRecorder()
+		s.ServeHTTPC(context.Background(), rr, r)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("MaskLength(%d): valid token rejected: got %v want %v", padLength, rr.Code, http.StatusOK)
+		}
+	}
+}
+
+// TestCompareTokens tests that tokens of differing lengths never compare as
+// equal, including when one is a prefix of the other.
+func TestCompareTokens(t *testing.T) {
+	realToken, err := generateRandomBytes(tokenLength)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var compareTests = []struct {
+		token    []byte
+		expected bool
+	}{
+		{realToken, true},
+		{append([]byte{}, realToken...), true},
+		{nil, false},
+		{[]byte{}, false},
+		{realToken[:1], false},
+		{realToken[:tokenLength-1], false},
+		{append(append([]byte{}, realToken...), 0), false},
+		{append(append([]byte{}, realToken...), realToken...), false},
+		{make([]byte, tokenLength), false},
+	}
+
+	for _, v := range compareTests {
+		if got := compareTokens(v.token, realToken); got != v.expected {
+			t.Errorf("compareTokens failed for a %d byte token: got %v want %v",
+				len(v.token), got, v.expected)
+		}
+	}
+
+	cs, err := newCSRF(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Verifying a token of the wrong length must not panic.
+	for _, n := range []int{0, 1, tokenLength, tokenLength*2 - 1, tokenLength*2 + 1, tokenLength * 3} {
+		issued := make([]byte, n)
+		if cs.verifyToken(issued, realToken, r) {
+			t.Errorf("a %d byte issued token was accepted", n)
+		}
+	}
+}
+
+// Tests domains that should (or should not) return true for a
+// same-origin check.
+func TestSameOrigin(t *testing.T) {
+	var originTests = []struct {
+		o1       string
+		o2       string
+		expected bool
+	}{
+		{"https://goji.io/", "https://goji.io", true},
+		{"http://golang.org/", "http://golang.org/pkg/net/http", true},
+		{"https://goji.io/", "http://goji.io", false},
+		{"https://goji.io:3333/", "http://goji.io:4444", false},
+	}
+
+	for _, origins := range originTests {
+		a, err := url.Parse(origins.o1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := url.Parse(origins.o2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if sameOrigin(a, b) != origins.expected {
+			t.Fatalf("origin checking failed: %v and %v, expected %v",
+				origins.o1, origins.o2, origins.expected)
+		}
+	}
+}
+
+func TestXOR(t *testing.T) {
+	testTokens := []struct {
+		token    []byte
+		pad      []byte
+		expected []byte
+	}{
+		{[]byte("hello"), []byte("goodbye"), []byte{15, 10, 3, 8, 13}},
+		{[]byte("goodbye"), []byte("hello"), []byte{15, 10, 3, 8, 13, 17, 0}},
+		{[]byte("gophers"), []byte("clojure"), []byte{4, 3, 31, 2, 16, 0, 22}},
+		{nil, []byte("requestToken"), []byte{}},
+	}
+
+	for _, token := range testTokens {
+		if res := xorPad(token.token, token.pad); !bytes.Equal(res, token.expected) {
+			t.Fatalf("xorPad failed to return the expected result: got %v want %v",
+				res, token.expected)
+		}
+	}
+
+}
+
+// shortReader provides a broken implementation of io.Reader for testing.
+type shortReader struct{}
+
+func (sr shortReader) Read(p []byte) (int, error) {
+	return len(p) % 2, io.ErrUnexpectedEOF
+}
+
+// TestGenerateRandomBytes tests the (extremely rare) case that crypto/rand does
+// not return the expected number of bytes.
+func TestGenerateRandomBytes(t *testing.T) {
+	// Pioneered from https://github.com/justinas/nosurf
+	original := rand.Reader
+	rand.Reader = shortReader{}
+	defer func() {
+		rand.Reader = original
+	}()
+
+	b, err := generateRandomBytes(tokenLength)
+	if err == nil {
+		t.Fatalf("generateRandomBytes did not report a short read: only read %d bytes", len(b))
+	}
+}
+
+func TestTemplateField(t *testing.T) {
+	m := goji.NewMux()
+	CSRF := Protect(testKey, FieldName(testFieldName))
+	m.UseC(CSRF)
+
+	var token string
+	var customTemplateField string
+	m.HandleFuncC(pat.New("/"), func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		token = Token(ctx, r)
+		customTemplateField = string(TemplateField(ctx, r))
+	})
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	m.ServeHTTP(rr, r)
+
+	expectedTemplateField := fmt.Sprintf(testTemplateField, testFieldName, token)
+
+	if customTemplateField != expectedTemplateField {
+		t.Fatalf("templateField not set correctly: got %v want %v",
+			customTemplateField, expectedTemplateField)
+	}
+}
+
+// TestTemplateFieldWithAttrs tests that extra attributes are rendered and
+// escaped, and that invalid or reserved attributes are dropped.
+func TestTemplateFieldWithAttrs(t *testing.T) {
+	m := goji.NewMux()
+	m.UseC(Protect(testKey, FieldName(testFieldName)))
+
+	attrs := map[string]string{
+		"id":           "csrf",
+		"data-form":    `"><script>alert(1)</script>`,
+		"value":        "override",
+		`onclick="x"`:  "y",
+		"autocomplete": "off",
+	}
+
+	var token string
+	var field string
+	m.HandleFuncC(pat.New("/"), func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		token = Token(ctx, r)
+		field = string(TemplateFieldWithAttrs(ctx, r, attrs))
+	})
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.ServeHTTP(httptest.NewRecorder(), r)
+
+	expected := fmt.Sprintf(`<input type="hidden" name="%s" value="%s" autocomplete="off" `+
+		`data-form="&#34;&gt;&lt;script&gt;alert(1)&lt;/script&gt;" id="csrf">`, testFieldName, token)
+
+	if field != expected {
+		t.Fatalf("templateField not set correctly: got %v want %v", field, expected)
+	}
+}
+
+// TestMetaTag tests that MetaTag renders the token in a <meta> tag, and escapes
+// its attributes.
+func TestMetaTag(t *testing.T) {
+	var metaTests = []struct {
+		opts     []Option
+		expected string
+	}{
+		{nil, `<meta name="csrf-token" content="%s">`},
+		{[]Option{MetaName(`x"><script>`)}, `<meta name="x&#34;&gt;&lt;script&gt;" content="%s">`},
+	}
+
+	for _, v := range metaTests {
+		var token, meta string
+		s := Protect(testKey, v.opts...)(goji.HandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			token = Token(ctx, r)
+			meta = string(MetaTag(ctx, r))
+		}))
+
+		r, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s.ServeHTTPC(context.Background(), httptest.NewRecorder(), r)
+
+		if expected := fmt.Sprintf(v.expected, template.HTMLEscapeString(token)); meta != expected {
+			t.Errorf("meta tag not rendered correctly: got %v want %v", meta, expected)
+		}
+	}
+}
+
+// TestEnsureToken tests that EnsureToken issues and saves a token for requests
+// that weren't issued one by the middleware.
+func TestEnsureToken(t *testing.T) {
+	var before, ensured string
+	var ensureErr error
+	s := Protect(testKey)(goji.HandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		before = Token(ctx, r)
+		ensured, ensureErr = EnsureToken(ctx, r, w)
+	}))
+
+	r, err := http.NewRequest("POST", "/api/bootstrap", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTPC(UnsafeSkipCheck(context.Background()), rr, r)
+
+	if ensureErr != nil {
+		t.Fatal(ensureErr)
+	}
+
+	if before != "" || ensured == "" {
+		t.Fatalf("token not issued lazily: got %q before and %q after", before, ensured)
+	}
+
+	if len(readSetCookies(rr)) != 1 {
+		t.Fatalf("token cookie not set: got %v", rr.Header()["Set-Cookie"])
+	}
+
+	// The ensured token validates.
+	r, err = http.NewRequest("POST", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setCookie(rr, r)
+	r.Header.Set("X-CSRF-Token", ensured)
+
+	rr2 := httptest.NewRecorder()
+	s.ServeHTTPC(context.Background(), rr2, r)
+
+	if rr2.Code != http.StatusOK {
+		t.Fatalf("ensured token rejected: got %v want %v", rr2.Code, http.StatusOK)
+	}
+
+	// An existing session token is reused instead of being replaced.
+	r, err = http.NewRequest("POST", "/api/bootstrap", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setCookie(rr, r)
+
+	rr2 = httptest.NewRecorder()
+	s.ServeHTTPC(UnsafeSkipCheck(context.Background()), rr2, r)
+
+	if c := rr2.Header().Get("Set-Cookie"); c != "" {
+		t.Fatalf("existing session token replaced: got %q", c)
+	}
+
+	if _, err := EnsureToken(context.Background(), r, httptest.NewRecorder()); err == nil {
+		t.Fatal("EnsureToken succeeded without the middleware")
+	}
+}
+
+func TestUnsafeSkipCSRFCheck(t *testing.T) {
+	m := goji.NewMux()
+	skipCheck := func(h goji.Handler) goji.Handler {
+		fn := func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			ctx = UnsafeSkipCheck(ctx)
+			h.ServeHTTPC(ctx, w, r)
+		}
+
+		return goji.HandlerFunc(fn)
+	}
+
+	// Must be used prior to the CSRF handler being invoked.
+	m.UseC(skipCheck)
+
+	CSRF := Protect(testKey)
+	m.UseC(CSRF)
+
+	var teapot = 418
+
+	// Issue a POST request without a CSRF token in the request.
+	m.HandleFuncC(pat.Post("/"), func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		// Set a non-200 header to make the test explicit.
+		w.WriteHeader(teapot)
+	})
+
+	r, err := http.NewRequest("POST", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	m.ServeHTTPC(context.Background(), rr, r)
+
+	if status := rr.Code; status != teapot {
+		t.Fatalf("middleware failed to skip this request: got %v want %v",
+			status, teapot)
+	}
+}
+
+// Test that real tokens are read from the configured RandReader.
+func TestRandReader(t *testing.T) {
+	seed := bytes.Repeat([]byte{0x2a}, tokenLength*2)
+
+	var tokens []string
+	s := Protect(testKey, RandReader(bytes.NewReader(seed)))(goji.HandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		tokens = append(tokens, UnmaskedToken(ctx, r))
+	}))
+
+	for i := 0; i < 2; i++ {
+		r, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s.ServeHTTPC(context.Background(), httptest.NewRecorder(), r)
+	}
+
+	expected := base64.StdEncoding.EncodeToString(seed[:tokenLength])
+	for i, token := range tokens {
+		if token != expected {
+			t.Errorf("token %d not read from the RandReader: got %v want %v", i, token, expected)
+		}
+	}
+
+	// An exhausted reader must fail rather than issue a short token.
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTPC(context.Background(), rr, r)
+
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("exhausted RandReader did not fail: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+}
+
+// TestWithFieldName tests that TemplateField and the middleware use a
+// per-request field name override, falling back to the FieldName option.
+func TestWithFieldName(t *testing.T) {
+	var token, field string
+	s := Protect(testKey, FieldName(testFieldName))(goji.HandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		token = Token(ctx, r)
+		field = string(TemplateField(ctx, r))
+	}))
+
+	// withName sets the override before the middleware, as a route would.
+	withName := goji.HandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		s.ServeHTTPC(WithFieldName(ctx, "signup_token"), w, r)
+	})
+
+	var fieldTests = []struct {
+		handler goji.Handler
+		name    string
+	}{
+		{s, testFieldName},
+		{withName, "signup_token"},
+	}
+
+	for _, v := range fieldTests {
+		r, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		v.handler.ServeHTTPC(context.Background(), rr, r)
+
+		expected := fmt.Sprintf(`<input type="hidden" name="%s" value="%s">`, v.name, token)
+		if field != expected {
+			t.Errorf("field not rendered with the %q name: got %v want %v", v.name, field, expected)
+		}
+
+		// The form is submitted with the overridden field name.
+		form := url.Values{v.name: {token}}
+		r, err = http.NewRequest("POST", "/", strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		setCookie(rr, r)
+
+		rr = httptest.NewRecorder()
+		v.handler.ServeHTTPC(context.Background(), rr, r)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("token in the %q field rejected: got %v want %v", v.name, rr.Code, http.StatusOK)
+		}
+	}
+
+	// An override set in the handler is still rendered.
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Protect(testKey)(goji.HandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		field = string(TemplateField(WithFieldName(ctx, "late"), r))
+	})).ServeHTTPC(context.Background(), httptest.NewRecorder(), r)
+
+	if !strings.Contains(field, `name="late"`) {
+		t.Errorf("override set in the handler not rendered: got %v", field)
+	}
+}
+
+// Test that bodies larger than MaxBodyBytes aren't read to find the token.
+func TestMaxBodyBytes(t *testing.T) {
+	var token string
+	s := Protect(testKey, MaxBodyBytes(1024))(goji.HandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		token = Token(ctx, r)
+	}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTPC(context.Background(), rr, r)
+
+	var bodyTests = []struct {
+		name     string
+		padding  int
+		header   bool
+		expected int
+	}{
+		{"small form", 100, false, http.StatusOK},
+		{"oversized form", 4096, false, http.StatusRequestEntityTooLarge},
+		// The body isn't read when the token is in a header.
+		{"oversized body, header token", 4096, true, http.StatusOK},
+	}
+
+	for _, v := range bodyTests {
+		form := url.Values{
+			fieldName: {token},
+			"comment": {strings.Repeat("a", v.padding)},
+		}
+		if v.header {
+			form.Del(fieldName)
+		}
+
+		r, err := http.NewRequest("POST", "/", strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if v.header {
+			r.Header.Set("X-CSRF-Token", token)
+		}
+		setCookie(rr, r)
+
+		rr2 := httptest.NewRecorder()
+		s.ServeHTTPC(context.Background(), rr2, r)
+
+		if rr2.Code != v.expected {
+			t.Errorf("%s: got %v want %v", v.name, rr2.Code, v.expected)
+		}
+
+		if v.expected == http.StatusRequestEntityTooLarge && !strings.Contains(rr2.Body.String(), ErrBodyTooLarge.Error()) {
+			t.Errorf("%s: reason not written: got %q", v.name, rr2.Body.String())
+		}
+	}
+}
+
+// TestClear tests that Clear deletes the token from the store and expires the
+// session cookie.
+func TestClear(t *testing.T) {
+	ms := NewMemoryStore()
+	defer ms.Close()
+
+	var token, after string
+	var clearErr error
+	m := goji.NewMux()
+	m.UseC(Protect(testKey, Store(ms)))
+	m.HandleFuncC(pat.Get("/"), func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		token = Token(ctx, r)
+	})
+	m.HandleFuncC(pat.Post("/logout"), func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		clearErr = Clear(ctx, w, r)
+		after = Token(ctx, r)
+	})
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	m.ServeHTTP(rr, r)
+
+	r, err = http.NewRequest("POST", "/logout", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setCookie(rr, r)
+	r.Header.Set("X-CSRF-Token", token)
+
+	rr2 := httptest.NewRecorder()
+	m.ServeHTTP(rr2, r)
+
+	if clearErr != nil {
+		t.Fatal(clearErr)
+	}
+
+	if after != "" {
+		t.Fatalf("token still set after Clear: got %q", after)
+	}
+
+	cookies := readSetCookies(rr2)
+	if len(cookies) != 1 || cookies[0].Name != cookieName || cookies[0].MaxAge >= 0 {
+		t.Fatalf("session cookie not expired: got %v", rr2.Header()["Set-Cookie"])
+	}
+
+	if len(ms.tokens) != 0 {
+		t.Fatalf("token not deleted from the store: %d remain", len(ms.tokens))
+	}
+
+	// The cleared token can't be reused.
+	rr3 := httptest.NewRecorder()
+	m.ServeHTTP(rr3, r)
+
+	if rr3.Code != http.StatusForbidden {
+		t.Fatalf("cleared token accepted: got %v want %v", rr3.Code, http.StatusForbidden)
+	}
+
+	if err := Clear(context.Background(), httptest.NewRecorder(), r); err == nil {
+		t.Fatal("Clear succeeded without the middleware")
+	}
+
+	// Store errors are reported as store failures.
+	s := Protect(testKey, Store(&brokenClearStore{ms}))(goji.HandlerFunc(
+		func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			clearErr = Clear(ctx, w, r)
+		}))
+
+	r, err = http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.ServeHTTPC(context.Background(), httptest.NewRecorder(), r)
+
+	if !errors.Is(clearErr, ErrStoreFailure) || !errors.Is(clearErr, errTestClear) {
+		t.Fatalf("store error not wrapped: got %v", clearErr)
+	}
+}
+
+// TestProtection tests that Protection reports how the request was handled.
+func TestProtection(t *testing.T) {
+	var token string
+	var state ProtectionState
+	s := Protect(testKey, ExemptPath("/webhook"))(goji.HandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		token = Token(ctx, r)
+		state = Protection(ctx, r)
+	}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTPC(context.Background(), rr, r)
+
+	if state != SafeMethod {
+		t.Fatalf("GET: got state %v want %v", state, SafeMethod)
+	}
+
+	var stateTests = []struct {
+		ctx      context.Context
+		path     string
+		expected ProtectionState
+	}{
+		{context.Background(), "/", Validated},
+		{context.Background(), "/webhook", Exempt},
+		{UnsafeSkipCheck(context.Background()), "/", Exempt},
+	}
+
+	for _, v := range stateTests {
+		r, err := http.NewRequest("POST", v.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		setCookie(rr, r)
+		r.Header.Set("X-CSRF-Token", token)
+
+		state = Unprotected
+		s.ServeHTTPC(v.ctx, httptest.NewRecorder(), r)
+
+		if state != v.expected {
+			t.Errorf("POST %s: got state %v want %v", v.path, state, v.expected)
+		}
+	}
+
+	if state := Protection(context.Background(), r); state != Unprotected {
+		t.Errorf("no middleware: got state %v want %v", state, Unprotected)
+	}
+}
+
+// TestTokenFromContext tests that the token can be read from the context
+// alone.
+func TestTokenFromContext(t *testing.T) {
+	var token, fromContext string
+	s := Protect(testKey)(goji.HandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		fromContext = TokenFromContext(ctx)
+		token = Token(ctx, r)
+	}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.ServeHTTPC(context.Background(), httptest.NewRecorder(), r)
+
+	if fromContext == "" || fromContext != token {
+		t.Fatalf("token not read from the context: got %q want %q", fromContext, token)
+	}
+
+	if got := TokenFromContext(context.Background()); got != "" {
+		t.Fatalf("TokenFromContext returned a token without the middleware: got %q", got)
+	}
+}
+
+// TestHeaderValuePrefix tests that the prefix is removed from the header value
+// before verification.
+func TestHeaderValuePrefix(t *testing.T) {
+	var token string
+	s := Protect(testKey, RequestHeader("Authorization"), HeaderValuePrefix("CSRF "))(goji.HandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		token = Token(ctx, r)
+	}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTPC(context.Background(), rr, r)
+
+	var prefixTests = []struct {
+		value    string
+		expected int
+		reason   error
+	}{
+		{"CSRF " + token, http.StatusOK, nil},
+		{"csrf " + token, http.StatusOK, nil},
+		{token, http.StatusForbidden, ErrNoToken},
+		{"Bearer " + token, http.StatusForbidden, ErrNoToken},
+	}
+
+	for _, v := range prefixTests {
+		r, err := http.NewRequest("POST", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		setCookie(rr, r)
+		r.Header.Set("Authorization", v.value)
+
+		var reason error
+		s := Protect(testKey, RequestHeader("Authorization"), HeaderValuePrefix("CSRF "),
+			ErrorHandlerFunc(func(w http.ResponseWriter, r *http.Request, err error) {
+				reason = err
+				w.WriteHeader(http.StatusForbidden)
+			}))(testHandler)
+
+		rr2 := httptest.NewRecorder()
+		s.ServeHTTPC(context.Background(), rr2, r)
+
+		if rr2.Code != v.expected {
+			t.Errorf("%q: got %v want %v", v.value, rr2.Code, v.expected)
+		}
+
+		if reason != v.reason {
+			t.Errorf("%q: got reason %v want %v", v.value, reason, v.reason)
+		}
+	}
+}
+
+// TestUnmaskLength tests that tokens that can't be split into a pad and a
+// token of the expected length aren't unmasked.
+func TestUnmaskLength(t *testing.T) {
+	for _, n := range []int{0, 1, tokenLength, 2*tokenLength - 1, 2*tokenLength + 1, 3 * tokenLength} {
+		if got := unmaskToken(make([]byte, n), tokenLength, tokenLength); got != nil {
+			t.Errorf("%d byte token unmasked: got %x", n, got)
+		}
+	}
+
+	if got := unmaskToken(make([]byte, tokenLength+8), tokenLength, 8); len(got) != tokenLength {
+		t.Errorf("token not unmasked: got %d bytes want %d", len(got), tokenLength)
+	}
+}
+
+// TestTokenHandler tests that TokenHandler serves a token that validates
+// against the issued cookie.
+func TestTokenHandler(t *testing.T) {
+	m := goji.NewMux()
+	m.UseC(Protect(testKey))
+	m.HandleC(pat.New("/csrf"), TokenHandler())
+	m.HandleFuncC(pat.Post("/"), testHandler)
+
+	r, err := http.NewRequest("GET", "/csrf", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	m.ServeHTTP(rr, r)
+
+	if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("wrong content type: got %q", ct)
+	}
+
+	var body struct {
+		Token string `json:"csrfToken"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err = http.NewRequest("POST", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setCookie(rr, r)
+
+	// The token should match the real token in the cookie.
+	cs, err := newCSRF(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	realToken, err := cs.st.Get(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issued, err := base64.StdEncoding.DecodeString(body.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !cs.verifyToken(issued, realToken, r) {
+		t.Fatalf("served token doesn't match the cookie: got %q", body.Token)
+	}
+
+	r.Header.Set("X-CSRF-Token", body.Token)
+
+	rr = httptest.NewRecorder()
+	m.ServeHTTP(rr, r)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("served token rejected: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	// Other methods aren't allowed, and the middleware is required.
+	r, err = http.NewRequest("PUT", "/csrf", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr = httptest.NewRecorder()
+	TokenHandler().ServeHTTPC(context.Background(), rr, r)
+
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("PUT: got %v want %v", rr.Code, http.StatusMethodNotAllowed)
+	}
+
+	r.Method = "GET"
+	rr = httptest.NewRecorder()
+	TokenHandlerHTTP().ServeHTTP(rr, r)
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("unprotected: got %v want %v", rr.Code, http.StatusInternalServerError)
+	}
+}
+
+// TestMaskRotation tests that each request is issued a differently masked
+// token for the same session, and that all of them verify.
+func TestMaskRotation(t *testing.T) {
+	var tokens []string
+	s := Protect(testKey)(goji.HandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		token := Token(ctx, r)
+		if again := Token(ctx, r); again != token {
+			t.Errorf("token changed within a request: got %q want %q", again, token)
+		}
+		tokens = append(tokens, token)
+	}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTPC(context.Background(), rr, r)
+	setCookie(rr, r)
+
+	for i := 0; i < 2; i++ {
+		s.ServeHTTPC(context.Background(), httptest.NewRecorder(), r)
+	}
+
+	seen := make(map[string]bool)
+	for _, token := range tokens {
+		if seen[token] {
+			t.Fatalf("masked token repeated: %q", token)
+		}
+		seen[token] = true
+
+		r, err := http.NewRequest("POST", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		setCookie(rr, r)
+		r.Header.Set("X-CSRF-Token", token)
+
+		rr2 := httptest.NewRecorder()
+		s.ServeHTTPC(context.Background(), rr2, r)
+
+		if rr2.Code != http.StatusOK {
+			t.Errorf("masked token %q rejected: got %v want %v", token, rr2.Code, http.StatusOK)
+		}
+	}
+}
+
+// TestEncoding tests that tokens round-trip with a custom encoding.
+func TestEncoding(t *testing.T) {
+	for _, mode := range [][]Option{nil, {DoubleSubmit()}} {
+		var token string
+		opts := append([]Option{Encoding(base64.URLEncoding), QueryFieldName("csrf")}, mode...)
+		s := Protect(testKey, opts...)(goji.HandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			token = Token(ctx, r)
+		}))
+
+		var encodingTests = []struct {
+			name     string
+			encode   func(string) string
+			expected int
+		}{
+			{"url", func(s string) string { return s }, http.StatusOK},
+			{"std", func(s string) string {
+				b, _ := base64.URLEncoding.DecodeString(s)
+				return base64.StdEncoding.EncodeToString(b)
+			}, http.StatusForbidden},
+		}
+
+		for _, v := range encodingTests {
+			r, err := http.NewRequest("GET", "/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+			s.ServeHTTPC(context.Background(), rr, r)
+
+			// Retry until the token differs between encodings, so that the
+			// std case is meaningful.
+			for v.name == "std" && v.encode(token) == token {
+				rr = httptest.NewRecorder()
+				s.ServeHTTPC(context.Background(), rr, r)
+			}
+
+			if _, err := base64.URLEncoding.DecodeString(token); err != nil {
+				t.Fatalf("%s (%d options): token not URL encoded: %v", v.name, len(mode), err)
+			}
+
+			r, err = http.NewRequest("POST", "/?csrf="+v.encode(token), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			setCookie(rr, r)
+
+			rr2 := httptest.NewRecorder()
+			s.ServeHTTPC(context.Background(), rr2, r)
+
+			if rr2.Code != v.expected {
+				t.Errorf("%s (%d options): got %v want %v", v.name, len(mode), rr2.Code, v.expected)
+			}
+		}
+	}
+}
+
+// TestRequireContentType tests that unsafe requests are only accepted with an
+// allowed content type.
+func TestRequireContentType(t *testing.T) {
+	var token string
+	s := Protect(testKey, RequireContentType("application/json", "application/merge-patch+json"))(goji.HandlerFunc(
+		func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			token = Token(ctx, r)
+		}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTPC(context.Background(), rr, r)
+
+	var contentTypeTests = []struct {
+		contentType string
+		expected    int
+	}{
+		{"application/json", http.StatusOK},
+		{"Application/JSON; charset=utf-8", http.StatusOK},
+		{"application/merge-patch+json", http.StatusOK},
+		{"application/x-www-form-urlencoded", http.StatusUnsupportedMediaType},
+		{"multipart/form-data; boundary=x", http.StatusUnsupportedMediaType},
+		{"text/plain", http.StatusUnsupportedMediaType},
+		{"", http.StatusUnsupportedMediaType},
+	}
+
+	for _, v := range contentTypeTests {
+		r, err := http.NewRequest("POST", "/", strings.NewReader("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		setCookie(rr, r)
+		r.Header.Set("X-CSRF-Token", token)
+		if v.contentType != "" {
+			r.Header.Set("Content-Type", v.contentType)
+		}
+
+		rr2 := httptest.NewRecorder()
+		s.ServeHTTPC(context.Background(), rr2, r)
+
+		if rr2.Code != v.expected {
+			t.Errorf("Content-Type %q: got %v want %v", v.contentType, rr2.Code, v.expected)
+		}
+
+		if v.expected != http.StatusOK && !strings.Contains(rr2.Body.String(), ErrBadContentType.Error()) {
+			t.Errorf("Content-Type %q: reason not reported: got %q", v.contentType, rr2.Body.String())
+		}
+	}
+
+	if err := RequireContentType("application/")(&csrf{}); err == nil {
+		t.Error("RequireContentType accepted an invalid media type")
+	}
+}
+
+// TestVerify tests that Verify accepts a token issued for the real token and
+// host, and rejects mismatched and malformed tokens.
+func TestVerify(t *testing.T) {
+	var token, realToken string
+	s := Protect(testKey)(goji.HandlerFunc(
+		func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			token = Token(ctx, r)
+			realToken = UnmaskedToken(ctx, r)
+		}))
+
+	r, err := http.NewRequest("GET", "http://www.example.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.ServeHTTPC(context.Background(), httptest.NewRecorder(), r)
+
+	other, err := generateRandomBytes(tokenLength)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var verifyTests = []struct {
+		name      string
+		realToken string
+		sentToken string
+		host      string
+		valid     bool
+	}{
+		{"match", realToken, token, "www.example.com", true},
+		{"host case", realToken, token, "WWW.example.com", true},
+		{"wrong host", realToken, token, "example.com", false},
+		{"wrong real token", base64.StdEncoding.EncodeToString(other), token, "www.example.com", false},
+		{"unmasked", realToken, realToken, "www.example.com", false},
+		{"truncated", realToken, token[:len(token)-4], "www.example.com", false},
+		{"malformed sent token", realToken, "%%%", "www.example.com", false},
+		{"malformed real token", "%%%", token, "www.example.com", false},
+		{"empty sent token", realToken, "", "www.example.com", false},
+		{"empty real token", "", token, "www.example.com", false},
+	}
+
+	for _, v := range verifyTests {
+		if got := Verify(v.realToken, v.sentToken, v.host); got != v.valid {
+			t.Errorf("%s: got %v want %v", v.name, got, v.valid)
+		}
+	}
+}
+
+// TestInspect tests that Inspect reports the cookie and token state of the
+// request without revealing the token.
+func TestInspect(t *testing.T) {
+	var token string
+	var in Inspection
+	s := Protect(testKey)(goji.HandlerFunc(
+		func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			if token == "" {
+				token = Token(ctx, r)
+			}
+
+			var err error
+			if in, err = Inspect(ctx, r); err != nil {
+				t.Fatal(err)
+			}
+		}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTPC(context.Background(), rr, r)
+
+	if in.CookiePresent || in.TokenPresent || in.Valid || in.Reason != ErrNoToken || in.CookieName != cookieName {
+		t.Fatalf("no cookie: got %+v", in)
+	}
+
+	cs, err := newCSRF(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := generateRandomBytes(tokenLength)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var inspectTests = []struct {
+		name   string
+		token  string
+		valid  bool
+		reason error
+	}{
+		{"valid", token, true, nil},
+		{"no request token", "", false, ErrNoToken},
+		{"wrong token", cs.issueToken(other, r), false, ErrBadToken},
+	}
+
+	for _, v := range inspectTests {
+		r, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		setCookie(rr, r)
+		r.Header.Set("X-CSRF-Token", v.token)
+
+		s.ServeHTTPC(context.Background(), httptest.NewRecorder(), r)
+
+		if !in.CookiePresent || !in.TokenPresent || in.RequestTokenPresent != (v.token != "") ||
+			in.Valid != v.valid || in.Reason != v.reason || in.State != SafeMethod {
+			t.Errorf("%s: got %+v", v.name, in)
+		}
+
+		if dump := fmt.Sprintf("%+v", in); v.token != "" && strings.Contains(dump, v.token) {
+			t.Errorf("%s: token revealed: %s", v.name, dump)
+		}
+	}
+
+	// A cookie that fails the HMAC check is a bad token, not a missing one,
+	// as it is for the middleware.
+	r, err = http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.AddCookie(&http.Cookie{Name: cookieName, Value: "tampered"})
+	r.Header.Set("X-CSRF-Token", token)
+	s.ServeHTTPC(context.Background(), httptest.NewRecorder(), r)
+
+	if !in.CookiePresent || in.TokenPresent || in.Reason != ErrBadToken {
+		t.Errorf("tampered cookie: got %+v", in)
+	}
+
+	// A TokenExtractor error isn't a token.
+	s = Protect(testKey, TokenExtractor(func(r *http.Request) (string, error) {
+		return "", errors.New("no header")
+	}))(goji.HandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		var err error
+		if in, err = Inspect(ctx, r); err != nil {
+			t.Fatal(err)
+		}
+	}))
+
+	r, err = http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setCookie(rr, r)
+	s.ServeHTTPC(context.Background(), httptest.NewRecorder(), r)
+
+	if in.RequestTokenPresent {
+		t.Errorf("extractor error: got %+v", in)
+	}
+
+	if _, err := Inspect(context.Background(), r); err == nil {
+		t.Error("Inspect did not report that the middleware was not applied")
 	}
 }
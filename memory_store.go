@@ -0,0 +1,232 @@
+package csrf
+
+import (
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// memorySweepInterval is how often a MemoryStore evicts expired tokens.
+const memorySweepInterval = time.Minute
+
+// memoryEntry is a token held by a MemoryStore and the time it expires.
+type memoryEntry struct {
+	token   []byte
+	expires time.Time
+}
+
+// MemoryStore is a server-side CSRF token store that keeps tokens in memory.
+// As with redisstore, clients are issued a cookie containing a random (256 bit)
+// session ID that references the real token, so the token itself never leaves
+// the server.
+//
+// Tokens expire after the configured MaxAge, and are evicted by a background
+// sweeper. As tokens aren't shared between processes, MemoryStore is only
+// suitable for applications running as a single process.
+type MemoryStore struct {
+	mu     sync.RWMutex
+	tokens map[string]memoryEntry
+	done   chan struct{}
+	once   sync.Once
+	cookie SessionCookie
+}
+
+// NewMemoryStore returns a MemoryStore and starts its sweeper. The cookie used
+// to carry the session ID is configured with the same options as Protect -
+// CookieName, MaxAge, Domain, Path, Secure, HttpOnly and SameSite - and MaxAge
+// is also used as the lifetime of the token. As every token needs a lifetime, a
+// MaxAge of zero or less uses the default of 12 hours. Other options are
+// ignored, but NewMemoryStore panics if any option returns an error.
+//
+// Call Close to stop the sweeper once the store is no longer used.
+//
+// Example:
+//
+//	opts := []csrf.Option{csrf.MaxAge(3600), csrf.CookieName("_session")}
+//	st := csrf.NewMemoryStore(opts...)
+//	defer st.Close()
+//	m.UseC(csrf.Protect(key, append(opts, csrf.Store(st))...))
+func NewMemoryStore(opts ...Option) *MemoryStore {
+	cookie, err := NewSessionCookie(opts...)
+	if err != nil {
+		panic(err)
+	}
+
+	ms := &MemoryStore{
+		tokens: make(map[string]memoryEntry),
+		done:   make(chan struct{}),
+		cookie: cookie,
+	}
+
+	go ms.sweeper(memorySweepInterval)
+
+	return ms
+}
+
+// Get retrieves the CSRF token referenced by the session ID in the request
+// cookie. It returns an error if the cookie doesn't exist, or ErrNoToken if the
+// token has expired from (or was never saved to) the store.
+func (ms *MemoryStore) Get(r *http.Request) ([]byte, error) {
+	cookie, err := r.Cookie(ms.cookie.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	ms.mu.RLock()
+	e, ok := ms.tokens[cookie.Value]
+	ms.mu.RUnlock()
+
+	// The sweeper may not have evicted the token yet.
+	if !ok || !time.Now().Before(e.expires) {
+		return nil, ErrNoToken
+	}
+
+	return e.token, nil
+}
+
+// Save stores the CSRF token under a new session ID and writes the ID to the
+// session cookie.
+func (ms *MemoryStore) Save(token []byte, w http.ResponseWriter) error {
+	id, err := generateRandomBytes(tokenLength)
+	if err != nil {
+		return err
+	}
+
+	sid := hex.EncodeToString(id)
+	ttl := time.Duration(ms.cookie.MaxAge) * time.Second
+
+	ms.mu.Lock()
+	ms.tokens[sid] = memoryEntry{
+		token:   append([]byte(nil), token...),
+		expires: time.Now().Add(ttl),
+	}
+	ms.mu.Unlock()
+
+	ms.cookie.Set(w, sid)
+
+	return nil
+}
+
+// Refresh stores the CSRF token under the session ID in the request cookie,
+// resetting its lifetime, and rewrites the session cookie. It returns an error
+// if the cookie doesn't exist, or ErrNoToken if the session's token has
+// expired from (or was never saved to) the store.
+func (ms *MemoryStore) Refresh(token []byte, w http.ResponseWriter, r *http.Request) error {
+	cookie, err := r.Cookie(ms.cookie.Name)
+	if err != nil {
+		return err
+	}
+
+	ttl := time.Duration(ms.cookie.MaxAge) * time.Second
+
+	ms.mu.Lock()
+	e, ok := ms.tokens[cookie.Value]
+	live := ok && time.Now().Before(e.expires)
+	if live {
+		ms.tokens[cookie.Value] = memoryEntry{
+			token:   append([]byte(nil), token...),
+			expires: time.Now().Add(ttl),
+		}
+	}
+	ms.mu.Unlock()
+
+	if !live {
+		return ErrNoToken
+	}
+
+	ms.cookie.Set(w, cookie.Value)
+
+	return nil
+}
+
+// Clear deletes the CSRF token referenced by the session ID in the request
+// cookie from the store, and expires the session cookie.
+func (ms *MemoryStore) Clear(w http.ResponseWriter, r *http.Request) error {
+	if cookie, err := r.Cookie(ms.cookie.Name); err == nil {
+		ms.mu.Lock()
+		delete(ms.tokens, cookie.Value)
+		ms.mu.Unlock()
+	}
+
+	ms.cookie.Expire(w)
+
+	return nil
+}
+
+// memoryKeyPrefix is prepended to keys saved with SaveKey, so they can't
+// collide with session IDs.
+const memoryKeyPrefix = "key."
+
+// GetKey retrieves the CSRF token saved under the key, or ErrNoToken if it has
+// expired from (or was never saved to) the store.
+func (ms *MemoryStore) GetKey(key string) ([]byte, error) {
+	ms.mu.RLock()
+	e, ok := ms.tokens[memoryKeyPrefix+key]
+	ms.mu.RUnlock()
+
+	if !ok || !time.Now().Before(e.expires) {
+		return nil, ErrNoToken
+	}
+
+	return e.token, nil
+}
+
+// SaveKey stores the CSRF token under the key for the store's MaxAge.
+func (ms *MemoryStore) SaveKey(key string, token []byte) error {
+	ms.mu.Lock()
+	ms.tokens[memoryKeyPrefix+key] = memoryEntry{
+		token:   append([]byte(nil), token...),
+		expires: time.Now().Add(time.Duration(ms.cookie.MaxAge) * time.Second),
+	}
+	ms.mu.Unlock()
+
+	return nil
+}
+
+// DeleteKey deletes the CSRF token saved under the key.
+func (ms *MemoryStore) DeleteKey(key string) error {
+	ms.mu.Lock()
+	delete(ms.tokens, memoryKeyPrefix+key)
+	ms.mu.Unlock()
+
+	return nil
+}
+
+// SessionCookie returns the configuration of the session cookie.
+func (ms *MemoryStore) SessionCookie() SessionCookie {
+	return ms.cookie
+}
+
+// Close stops the sweeper. Tokens are no longer evicted, but the store can
+// still be used.
+func (ms *MemoryStore) Close() {
+	ms.once.Do(func() { close(ms.done) })
+}
+
+// sweeper evicts expired tokens every interval until the store is closed.
+func (ms *MemoryStore) sweeper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			ms.sweep(now)
+		case <-ms.done:
+			return
+		}
+	}
+}
+
+// sweep evicts the tokens that have expired by now.
+func (ms *MemoryStore) sweep(now time.Time) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	for sid, e := range ms.tokens {
+		if !now.Before(e.expires) {
+			delete(ms.tokens, sid)
+		}
+	}
+}
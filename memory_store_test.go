@@ -0,0 +1,409 @@
+package csrf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"goji.io"
+	"goji.io/pat"
+)
+
+// Check Store implementations
+var _ TokenStore = &MemoryStore{}
+var _ TokenClearer = &MemoryStore{}
+var _ TokenRefresher = &MemoryStore{}
+
+// TestMemoryStoreExpiry tests that a saved token can be retrieved using the
+// issued session cookie, and that it is evicted once it expires.
+func TestMemoryStoreExpiry(t *testing.T) {
+	age := 3600
+	ms := NewMemoryStore(MaxAge(age))
+	defer ms.Close()
+
+	token, err := generateRandomBytes(tokenLength)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	if err := ms.Save(token, rr); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setCookie(rr, r)
+
+	got, err := ms.Get(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !compareTokens(got, token) {
+		t.Fatalf("tokens do not match: got %x want %x", got, token)
+	}
+
+	// Sweeping before the token expires should keep it.
+	ms.sweep(time.Now())
+	if _, err := ms.Get(r); err != nil {
+		t.Fatalf("memory store evicted a valid token: %v", err)
+	}
+
+	ms.sweep(time.Now().Add(time.Duration(age+1) * time.Second))
+	if len(ms.tokens) != 0 {
+		t.Fatalf("memory store did not evict an expired token: %d remain", len(ms.tokens))
+	}
+
+	if _, err := ms.Get(r); err == nil {
+		t.Fatal("memory store returned an expired token")
+	}
+
+	// Unknown session IDs should return an error.
+	r.Header.Del("Cookie")
+	r.AddCookie(&http.Cookie{Name: cookieName, Value: "unknown"})
+	if _, err := ms.Get(r); err == nil {
+		t.Fatal("memory store did not report an unknown session ID")
+	}
+}
+
+// TestMemoryStoreConcurrent tests concurrent use of the store. Run with -race.
+func TestMemoryStoreConcurrent(t *testing.T) {
+	ms := NewMemoryStore()
+	defer ms.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			token, err := generateRandomBytes(tokenLength)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			rr := httptest.NewRecorder()
+			if err := ms.Save(token, rr); err != nil {
+				t.Error(err)
+				return
+			}
+
+			r, err := http.NewRequest("GET", "/", nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			setCookie(rr, r)
+
+			got, err := ms.Get(r)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			if !compareTokens(got, token) {
+				t.Errorf("tokens do not match: got %x want %x", got, token)
+			}
+
+			ms.sweep(time.Now())
+		}()
+	}
+
+	wg.Wait()
+}
+
+// TestMemoryStoreProtect tests a full request cycle through the middleware
+// using the memory store.
+func TestMemoryStoreProtect(t *testing.T) {
+	ms := NewMemoryStore()
+	defer ms.Close()
+
+	m := goji.NewMux()
+	m.UseC(Protect(testKey, Store(ms)))
+
+	var token string
+	m.HandleFuncC(pat.New("/"), func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		token = Token(ctx, r)
+	})
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	m.ServeHTTP(rr, r)
+
+	r, err = http.NewRequest("POST", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setCookie(rr, r)
+	r.Header.Set("X-CSRF-Token", token)
+
+	rr = httptest.NewRecorder()
+	m.ServeHTTP(rr, r)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("middleware failed to pass to the next handler: got %v want %v",
+			rr.Code, http.StatusOK)
+	}
+}
+
+// TestSingleUse tests that a SingleUse token validates once, that the
+// replacement token validates, and that a replayed request is rejected.
+func TestSingleUse(t *testing.T) {
+	ms := NewMemoryStore()
+	defer ms.Close()
+
+	var token string
+	s := Protect(testKey, Store(ms), SingleUse(true))(goji.HandlerFunc(
+		func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			token = Token(ctx, r)
+		}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTPC(context.Background(), rr, r)
+	first := token
+
+	post := func(cookies *httptest.ResponseRecorder, token string) *httptest.ResponseRecorder {
+		r, err := http.NewRequest("POST", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		setCookie(cookies, r)
+		r.Header.Set("X-CSRF-Token", token)
+
+		rr := httptest.NewRecorder()
+		s.ServeHTTPC(context.Background(), rr, r)
+		return rr
+	}
+
+	used := post(rr, first)
+	if used.Code != http.StatusOK {
+		t.Fatalf("first use of the token failed: got %v want %v", used.Code, http.StatusOK)
+	}
+
+	if len(readSetCookies(used)) != 1 {
+		t.Fatalf("no replacement cookie written: %q", used.Header()["Set-Cookie"])
+	}
+
+	if replay := post(rr, first); replay.Code != http.StatusForbidden {
+		t.Fatalf("replayed token accepted: got %v want %v", replay.Code, http.StatusForbidden)
+	}
+
+	if next := post(used, token); next.Code != http.StatusOK {
+		t.Fatalf("replacement token failed: got %v want %v", next.Code, http.StatusOK)
+	}
+
+	for _, opts := range [][]Option{{SingleUse(true)}, {DoubleSubmit(), SingleUse(true)}} {
+		if _, err := newCSRF(testKey, opts...); err == nil {
+			t.Errorf("SingleUse accepted a cookie store")
+		}
+	}
+}
+
+// TestRegenerateRevokes tests that Regenerate deletes the previous token from
+// a server-side store, so the old session cookie and token stop validating.
+func TestRegenerateRevokes(t *testing.T) {
+	ms := NewMemoryStore()
+	defer ms.Close()
+
+	var token string
+	s := Protect(testKey, Store(ms))(goji.HandlerFunc(
+		func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/login" {
+				var err error
+				if token, err = Regenerate(ctx, w, r); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			token = Token(ctx, r)
+		}))
+
+	serve := func(method, path string, cookies *httptest.ResponseRecorder, token string) *httptest.ResponseRecorder {
+		r, err := http.NewRequest(method, path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if cookies != nil {
+			setCookie(cookies, r)
+		}
+		if token != "" {
+			r.Header.Set("X-CSRF-Token", token)
+		}
+
+		rr := httptest.NewRecorder()
+		s.ServeHTTPC(context.Background(), rr, r)
+		return rr
+	}
+
+	issued := serve("GET", "/", nil, "")
+	before := token
+
+	login := serve("POST", "/login", issued, before)
+	if login.Code != http.StatusOK {
+		t.Fatalf("login failed: got %v want %v", login.Code, http.StatusOK)
+	}
+
+	ms.mu.RLock()
+	n := len(ms.tokens)
+	ms.mu.RUnlock()
+	if n != 1 {
+		t.Errorf("previous token not deleted: got %d entries want 1", n)
+	}
+
+	if rr := serve("POST", "/", issued, before); rr.Code != http.StatusForbidden {
+		t.Errorf("token from before Regenerate accepted: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+
+	if rr := serve("POST", "/", login, token); rr.Code != http.StatusOK {
+		t.Errorf("regenerated token failed: got %v want %v", rr.Code, http.StatusOK)
+	}
+}
+
+// TestMemoryStoreSlidingExpiry tests that SlidingExpiry refreshes the token
+// under the existing session ID, rather than adding an entry per request.
+func TestMemoryStoreSlidingExpiry(t *testing.T) {
+	ms := NewMemoryStore(MaxAge(3600))
+	defer ms.Close()
+
+	var token string
+	s := Protect(testKey, Store(ms), SlidingExpiry(true))(goji.HandlerFunc(
+		func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			token = Token(ctx, r)
+		}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issued := httptest.NewRecorder()
+	s.ServeHTTPC(context.Background(), issued, r)
+	sid := readSetCookies(issued)[0].Value
+
+	for i := 0; i < 100; i++ {
+		method := "GET"
+		if i%2 == 1 {
+			method = "POST"
+		}
+
+		r, err := http.NewRequest(method, "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		setCookie(issued, r)
+		r.Header.Set("X-CSRF-Token", token)
+
+		rr := httptest.NewRecorder()
+		s.ServeHTTPC(context.Background(), rr, r)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("request %d failed: got %v want %v", i, rr.Code, http.StatusOK)
+		}
+
+		if c := readSetCookies(rr); len(c) != 1 || c[0].Value != sid {
+			t.Fatalf("request %d: session cookie not refreshed in place: %q", i, rr.Header()["Set-Cookie"])
+		}
+	}
+
+	ms.mu.RLock()
+	n := len(ms.tokens)
+	ms.mu.RUnlock()
+	if n != 1 {
+		t.Fatalf("refreshes added store entries: got %d want 1", n)
+	}
+}
+
+// TestHeaderOnly tests that in HeaderOnly mode the token is delivered and
+// validated in headers, keyed by the session header, without any cookies.
+func TestHeaderOnly(t *testing.T) {
+	ms := NewMemoryStore()
+	defer ms.Close()
+
+	s := Protect(testKey, HeaderOnly("Authorization", ms))(testHandler)
+
+	serve := func(method, auth, token string) *httptest.ResponseRecorder {
+		r, err := http.NewRequest(method, "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		if token != "" {
+			r.Header.Set("X-CSRF-Token", token)
+		}
+
+		rr := httptest.NewRecorder()
+		s.ServeHTTPC(context.Background(), rr, r)
+
+		if c := rr.Header().Get("Set-Cookie"); c != "" {
+			t.Errorf("%s request wrote a cookie: %q", method, c)
+		}
+		return rr
+	}
+
+	if rr := serve("GET", "", ""); rr.Header().Get("X-CSRF-Token") != "" {
+		t.Fatal("token issued without a session header")
+	}
+
+	token := serve("GET", "Bearer abc", "").Header().Get("X-CSRF-Token")
+	if token == "" {
+		t.Fatal("no token in the response header")
+	}
+
+	if rr := serve("GET", "Bearer abc", ""); rr.Header().Get("X-CSRF-Token") == "" {
+		t.Fatal("no token in the response header of a repeat request")
+	}
+
+	var headerTests = []struct {
+		name  string
+		auth  string
+		token string
+		code  int
+	}{
+		{"valid", "Bearer abc", token, http.StatusOK},
+		{"other session", "Bearer xyz", token, http.StatusForbidden},
+		{"no session", "", token, http.StatusForbidden},
+		{"no token", "Bearer abc", "", http.StatusForbidden},
+	}
+
+	for _, v := range headerTests {
+		if rr := serve("POST", v.auth, v.token); rr.Code != v.code {
+			t.Errorf("%s: got %v want %v", v.name, rr.Code, v.code)
+		}
+	}
+
+	for i, opts := range [][]Option{
+		{HeaderOnly("Authorization", ms), Store(ms)},
+		{HeaderOnly("Authorization", ms), DoubleSubmit()},
+		{HeaderOnly("Authorization", ms), AngularCompat()},
+		{HeaderOnly("Authorization", ms), EncryptCookie(testKey)},
+		{HeaderOnly("", ms)},
+	} {
+		if _, err := newCSRF(testKey, opts...); err == nil {
+			t.Errorf("HeaderOnly accepted conflicting options (case %d)", i)
+		}
+	}
+}
@@ -1,12 +1,32 @@
 package csrf
 
-import "goji.io"
+import (
+	"crypto/aes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"goji.io"
+)
 
 // Option describes a functional option for configuring the CSRF handler.
 type Option func(*csrf) error
 
 // MaxAge sets the maximum age (in seconds) of a CSRF token's underlying cookie.
 // Defaults to 12 hours.
+//
+// A MaxAge of zero issues a session cookie, with no Max-Age or Expires
+// attribute, which the browser clears when it is closed. A negative MaxAge
+// expires the cookie immediately.
 func MaxAge(age int) Option {
 	return func(cs *csrf) error {
 		cs.opts.MaxAge = age
@@ -14,6 +34,62 @@ func MaxAge(age int) Option {
 	}
 }
 
+// SlidingExpiry re-issues the session cookie with a fresh MaxAge on every
+// request that passes the CSRF checks, so that active users keep their token
+// while idle users' cookies still expire. The real token is unchanged, so
+// tokens already rendered into pages remain valid. Server-side stores that
+// implement TokenRefresher keep the session ID; other stores have the previous
+// token cleared and save it under a new one. TokenTTL is also measured from
+// the last refresh.
+//
+// The JavaScript-readable cookie set by AngularCompat is refreshed along with
+// the session cookie, even if NoReissueIfPresent is set, so that it doesn't
+// expire first.
+func SlidingExpiry(s bool) Option {
+	return func(cs *csrf) error {
+		cs.opts.SlidingExpiry = s
+		return nil
+	}
+}
+
+// HeaderOnly configures the middleware for clients that don't keep cookies,
+// such as native apps. The token is delivered in the ResponseHeader (by default
+// X-CSRF-Token) of safe requests, and must be sent back in the request header.
+// The real token is kept in st, keyed by the sessionHeader - such as
+// "Authorization" - that the client already sends with every request. No
+// cookies are read or written.
+//
+// Tokens are only issued to requests with the session header, and unsafe
+// requests without it are rejected with ErrNoToken. HeaderOnly can't be
+// combined with Store, DoubleSubmit, AngularCompat or the cookie store's
+// options.
+func HeaderOnly(sessionHeader string, st KeyedTokenStore) Option {
+	return func(cs *csrf) error {
+		if sessionHeader == "" || st == nil {
+			return errors.New(errorPrefix + "HeaderOnly requires a session header and a store")
+		}
+
+		cs.opts.SessionHeader = http.CanonicalHeaderKey(sessionHeader)
+		cs.opts.KeyedStore = st
+		return nil
+	}
+}
+
+// MaxAgeDuration is like MaxAge, but takes a time.Duration - e.g.
+// MaxAgeDuration(2*time.Hour) - which is rounded down to whole seconds. An
+// error is returned if the duration is negative: use MaxAge(-1) to expire the
+// cookie immediately.
+func MaxAgeDuration(d time.Duration) Option {
+	return func(cs *csrf) error {
+		if d < 0 {
+			return fmt.Errorf("%snegative MaxAgeDuration %v", errorPrefix, d)
+		}
+
+		cs.opts.MaxAge = int(d / time.Second)
+		return nil
+	}
+}
+
 // Domain sets the cookie domain. Defaults to the current domain of the request
 // only (recommended).
 //
@@ -48,7 +124,30 @@ func Secure(s bool) Option {
 	}
 }
 
+// DevMode configures the middleware for local development over plain HTTP: the
+// cookie isn't Secure (so browsers send it to http://localhost), and requests
+// to a loopback host - "localhost", 127.0.0.1 or ::1 - accept any loopback
+// Origin or Referer, or neither. Tokens are still required. A warning is logged
+// when the middleware is created.
+//
+// DevMode must never be used in production: enable it from configuration that
+// is only set in development. Options after it can override Secure.
+func DevMode() Option {
+	return func(cs *csrf) error {
+		if err := Secure(false)(cs); err != nil {
+			return err
+		}
+
+		cs.opts.DevMode = true
+		return nil
+	}
+}
+
 // HttpOnly sets the 'HttpOnly' flag on the cookie. Defaults to true (recommended).
+//
+// A warning is logged if HttpOnly is disabled with a server-side Store, as
+// scripts have no use for its session ID: use AngularCompat to expose the token
+// to JavaScript instead.
 func HttpOnly(h bool) Option {
 	return func(cs *csrf) error {
 		// Note that the function and field names match the case of the
@@ -59,13 +158,239 @@ func HttpOnly(h bool) Option {
 	}
 }
 
+// CheckFetchMetadata rejects unsafe requests that the browser reports as
+// cross-site in the Sec-Fetch-Site header with ErrCrossSite, unless their
+// Origin is one of the TrustedOrigins. This is checked in addition to the
+// token and the Origin/Referer checks. Requests from the same site (e.g. a
+// sibling subdomain) aren't rejected, and requests without the header - from
+// older browsers and non-browser clients - are left to the other checks.
+// Disabled by default.
+func CheckFetchMetadata(c bool) Option {
+	return func(cs *csrf) error {
+		cs.opts.CheckFetchMetadata = c
+		return nil
+	}
+}
+
+// SetVaryCookie adds "Cookie" to the Vary header of responses, alongside any
+// values already set, so that shared caches don't serve a response containing
+// one user's token to another. Defaults to true (recommended). Only disable it
+// if the responses are never cached, or caching is controlled elsewhere.
+func SetVaryCookie(v bool) Option {
+	return func(cs *csrf) error {
+		cs.opts.VaryCookie = v
+		return nil
+	}
+}
+
+// SameSite sets the cookie SameSite attribute. Defaults to unset, which leaves
+// the decision to the browser (most treat it as Lax).
+//
+// SameSite(SameSiteStrictMode) will prevent the cookie from being sent by the
+// browser in all cross-site browsing contexts, even when following a regular
+// link (GET request). SameSite(SameSiteLaxMode) allows the cookie to be sent
+// when following a regular link from an external site, but not on CSRF-prone
+// request methods (e.g. POST).
+//
+// SameSite(SameSiteNoneMode) requires the 'Secure' flag, and will force it on.
+// An error is returned if Secure(false) has already been set.
+func SameSite(mode SameSiteMode) Option {
+	return func(cs *csrf) error {
+		if mode == SameSiteNoneMode && !cs.opts.Secure {
+			return errors.New(errorPrefix + "SameSite=None requires a Secure cookie")
+		}
+
+		cs.opts.SameSite = mode
+		return nil
+	}
+}
+
+// Partitioned sets the cookie Partitioned attribute, which asks the browser to
+// store a separate cookie for each top-level site the application is embedded
+// in (see https://developer.mozilla.org/en-US/docs/Web/Privacy/Partitioned_cookies).
+// This allows CSRF protection to work in third-party iframes once browsers block
+// unpartitioned third-party cookies. It is usually combined with
+// SameSite(SameSiteNoneMode).
+//
+// Partitioned(true) requires the 'Secure' flag, and will force it on. An error
+// is returned if Secure(false) has already been set.
+func Partitioned(p bool) Option {
+	return func(cs *csrf) error {
+		if p && !cs.opts.Secure {
+			return errors.New(errorPrefix + "Partitioned requires a Secure cookie")
+		}
+
+		cs.opts.Partitioned = p
+		return nil
+	}
+}
+
+// VerificationKeys supplies previous authentication keys for use when rotating
+// the key passed to Protect. New cookies are always signed with the key passed
+// to Protect, but existing cookies signed with any of these keys are still
+// accepted until they expire. Remove a key once cookies signed with it have
+// expired (see MaxAge).
+//
+// Each key must be at least 32 bytes long.
+func VerificationKeys(keys ...[]byte) Option {
+	return func(cs *csrf) error {
+		for _, key := range keys {
+			if err := checkKey(key); err != nil {
+				return err
+			}
+		}
+
+		cs.opts.VerificationKeys = append(cs.opts.VerificationKeys, keys...)
+		return nil
+	}
+}
+
+// Name identifies a middleware instance when several are nested - e.g. an
+// admin sub-router with different settings inside a router that is already
+// protected. The instance's token and failure reason can then be retrieved
+// with TokenFor and FailureReasonFor, whereas Token and FailureReason always
+// refer to the innermost instance.
+//
+// Nested instances should each use a distinct CookieName and RequestHeader (or
+// FieldName), otherwise they'll overwrite each other's cookie and inspect the
+// same token.
+func Name(name string) Option {
+	return func(cs *csrf) error {
+		cs.opts.Name = name
+		return nil
+	}
+}
+
+// AngularCompat configures the middleware for clients that implement the
+// "cookie-to-header" pattern, such as Angular and Axios. These read a cookie
+// named XSRF-TOKEN and echo its value in an X-XSRF-TOKEN request header.
+//
+// The masked token is written to a separate XSRF-TOKEN cookie with HttpOnly
+// disabled, and X-XSRF-TOKEN becomes the (only) request header inspected. The
+// real token stays in the usual session cookie, which remains HttpOnly.
+//
+// Note: any JavaScript running on your pages - including injected scripts in
+// the event of an XSS vulnerability - can read the XSRF-TOKEN cookie. This is
+// no worse than rendering the token into the page, but make sure that's a
+// trade-off you're happy with.
+func AngularCompat() Option {
+	return func(cs *csrf) error {
+		cs.opts.JSCookieName = jsCookieName
+		cs.opts.RequestHeaders = []string{jsHeaderName}
+		return nil
+	}
+}
+
+// ResponseHeader sets the name of a response header - e.g. X-CSRF-Token - that
+// the masked token is written to on safe (e.g. GET) requests. Single page
+// applications can then read the token from the response to their first
+// request, instead of parsing it out of the HTML. Regenerate also updates the
+// header. No header is written by default.
+func ResponseHeader(name string) Option {
+	return func(cs *csrf) error {
+		cs.opts.ResponseHeader = name
+		return nil
+	}
+}
+
+// BindClientIP binds tokens to the IP address of the client they were issued
+// to, in addition to the request host, so that a token leaked to (or stolen
+// from) another network fails validation. This is a hardening measure for
+// high-value applications such as admin panels.
+//
+// Note that legitimate users whose IP address changes between loading a form
+// and submitting it - e.g. on mobile networks, or behind load-balanced proxies
+// - will see their requests fail, and have to reload the page. Behind a reverse
+// proxy, use ClientIPHeader so that the proxy's address isn't used instead.
+// Tokens are not bound in DoubleSubmit mode.
+func BindClientIP(b bool) Option {
+	return func(cs *csrf) error {
+		cs.opts.BindClientIP = b
+		return nil
+	}
+}
+
+// BindUserAgent binds tokens to the User-Agent of the client they were issued
+// to, in addition to the request host, so that a token replayed from a
+// different client fails validation. It is off by default, and is intended as
+// extra hardening for sensitive flows rather than a defence on its own: the
+// header is chosen by the client, so an attacker who knows the victim's
+// User-Agent can send it.
+//
+// Note that browsers change their User-Agent when they update, so a form loaded
+// before an update and submitted after it will fail, and the user will have to
+// reload the page. Tokens are not bound in DoubleSubmit mode.
+func BindUserAgent(b bool) Option {
+	return func(cs *csrf) error {
+		cs.opts.BindUserAgent = b
+		return nil
+	}
+}
+
+// ClientIPHeader sets a request header - e.g. "X-Forwarded-For" or
+// "X-Real-IP" - to read the client IP address from for BindClientIP, instead
+// of the request's remote address. The first address in a comma-separated list
+// is used. Only set this if the header is always set by a proxy you trust, as
+// clients can otherwise supply any value.
+func ClientIPHeader(header string) Option {
+	return func(cs *csrf) error {
+		cs.opts.ClientIPHeader = header
+		return nil
+	}
+}
+
+// DoubleSubmit switches the middleware to the stateless "signed double-submit
+// cookie" pattern. The token is stored in the cookie alongside an HMAC of it
+// (keyed with the authKey), and the cookie is readable by JavaScript. Requests
+// must submit the cookie value back - in a header or form field, as usual -
+// and validate if it matches the cookie and the HMAC is genuine. No Store is
+// used, so Protect panics if one is supplied, and TokenTTL is ignored: use
+// MaxAge to limit the token lifetime.
+//
+// The threat model differs from the default mode:
+//
+//   - Tokens are not masked, so the token is the same in every response. This
+//     removes the BREACH mitigation that masking provides: don't use it if
+//     responses that contain the token are compressed alongside
+//     attacker-controlled input.
+//   - Tokens are not bound to the request host.
+//   - Any script on the page can read the cookie, as with AngularCompat.
+//   - The HMAC only covers the token: it isn't tied to a session or host. It
+//     stops an attacker from inventing a token, but not from planting a
+//     cookie the server minted for them. An attacker who can set cookies for
+//     your domain - e.g. from a compromised subdomain - can fetch a genuine
+//     cookie, plant it in the victim's browser and submit the same value. Use
+//     HostPrefix so that other subdomains can't set the cookie.
+func DoubleSubmit() Option {
+	return func(cs *csrf) error {
+		cs.opts.DoubleSubmit = true
+		return nil
+	}
+}
+
+// NoReissueIfPresent stops the middleware from writing a new token cookie on
+// every response when the client already has a valid one, which reduces
+// Set-Cookie churn and keeps responses cacheable. The session cookie is only
+// ever written when a new token is issued; this option extends that to the
+// XSRF-TOKEN cookie written by AngularCompat, which is otherwise replaced with
+// a freshly masked token on every response.
+func NoReissueIfPresent(b bool) Option {
+	return func(cs *csrf) error {
+		cs.opts.NoReissueIfPresent = b
+		return nil
+	}
+}
+
 // ErrorHandler allows you to change the handler called when CSRF request
 // processing encounters an invalid token or request. A typical use would be to
 // provide a handler that returns a static HTML file with a HTTP 403 status. By
 // default a HTTP 403 status and a plain text CSRF failure reason are served.
 //
-// Note that a custom error handler can also access the csrf.Failure(c, r)
+// Note that a custom error handler can also access the csrf.FailureReason(c, r)
 // function to retrieve the CSRF validation reason from Goji's request context.
+//
+// ErrorHandler, ErrorHandlerFunc and ErrorHandlerHTTP replace each other: the
+// last one supplied wins.
 func ErrorHandler(h goji.Handler) Option {
 	return func(cs *csrf) error {
 		cs.opts.ErrorHandler = h
@@ -73,11 +398,177 @@ func ErrorHandler(h goji.Handler) Option {
 	}
 }
 
+// ErrorHandlerFunc is like ErrorHandler, but the failure reason is passed
+// directly to fn rather than looked up with FailureReason, and no knowledge of
+// Goji's request context is required.
+//
+// ErrorHandler, ErrorHandlerFunc and ErrorHandlerHTTP replace each other: the
+// last one supplied wins.
+func ErrorHandlerFunc(fn func(w http.ResponseWriter, r *http.Request, reason error)) Option {
+	return ErrorHandler(goji.HandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		fn(w, r, FailureReason(ctx, r))
+	}))
+}
+
+// ErrorHandlerHTTP is like ErrorHandler, but takes a plain http.Handler. The
+// request's context carries the failure reason, which the handler can retrieve
+// with FailureReasonFromRequest(r).
+//
+// ErrorHandler, ErrorHandlerFunc and ErrorHandlerHTTP replace each other: the
+// last one supplied wins.
+func ErrorHandlerHTTP(h http.Handler) Option {
+	return ErrorHandler(goji.HandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r.WithContext(ctx))
+	}))
+}
+
+// FailureStatus sets the HTTP status code written by the default error handler
+// when a request fails validation - e.g. http.StatusBadRequest for APIs. Codes
+// outside of the 4xx and 5xx ranges are replaced with the default of
+// http.StatusForbidden. It has no effect when an ErrorHandler is supplied.
+func FailureStatus(code int) Option {
+	return func(cs *csrf) error {
+		if code < 400 || code > 599 {
+			code = http.StatusForbidden
+		}
+
+		cs.opts.FailureStatus = code
+		return nil
+	}
+}
+
+// FailureBody sets the response body written by the default error handler in
+// place of the plain text failure reason - e.g. a JSON error envelope - along
+// with its Content-Type. An empty contentType is served as plain text. The
+// status is still chosen by the default handler, or FailureStatus. It has no
+// effect when an ErrorHandler is supplied.
+//
+// Example:
+//
+//	csrf.FailureBody(`{"error":"invalid CSRF token"}`, "application/json")
+func FailureBody(body string, contentType string) Option {
+	return func(cs *csrf) error {
+		if contentType == "" {
+			contentType = "text/plain; charset=utf-8"
+		}
+
+		if _, _, err := mime.ParseMediaType(contentType); err != nil {
+			return fmt.Errorf("%sinvalid failure content type %q: %v", errorPrefix, contentType, err)
+		}
+
+		cs.opts.FailureBody = body
+		cs.opts.FailureContentType = contentType
+		return nil
+	}
+}
+
+// OnFailure sets a callback that is invoked whenever a request fails CSRF
+// processing, before the ErrorHandler is called. It receives the request and
+// the failure reason (e.g. ErrNoToken, ErrBadToken, ErrBadReferer), which makes
+// it suitable for metrics or structured logging. The callback is observational
+// only: it has no access to the response.
+func OnFailure(fn func(r *http.Request, reason error)) Option {
+	return func(cs *csrf) error {
+		cs.opts.OnFailure = fn
+		return nil
+	}
+}
+
+// Logger sets a CSRFLogger that receives human-readable diagnostics when a
+// request fails validation, or a session token can't be read from the store.
+// Nothing is logged by default. Use OnFailure to count failures instead.
+func Logger(l CSRFLogger) Option {
+	return func(cs *csrf) error {
+		cs.opts.Logger = l
+		return nil
+	}
+}
+
+// Tracer sets a CSRFTracer that is told about every request that fails CSRF
+// processing, with the failure reason, so that failures can be correlated with
+// request traces. It is called along with OnFailure.
+//
+// Example, using OpenTelemetry:
+//
+//	type otelTracer struct{}
+//
+//	func (otelTracer) RecordFailure(ctx context.Context, reason error) {
+//		trace.SpanFromContext(ctx).AddEvent("csrf.failure",
+//			trace.WithAttributes(attribute.String("csrf.reason", reason.Error())))
+//	}
+//
+//	m.UseC(csrf.Protect(key, csrf.Tracer(otelTracer{})))
+func Tracer(t CSRFTracer) Option {
+	return func(cs *csrf) error {
+		cs.opts.Tracer = t
+		return nil
+	}
+}
+
 // RequestHeader allows you to change the request header the CSRF middleware
 // inspects. The default is X-CSRF-Token.
 func RequestHeader(header string) Option {
+	return RequestHeaders(header)
+}
+
+// RequestHeaders allows the CSRF middleware to inspect several request
+// headers, in order, using the first one that is present. This is useful when
+// migrating clients from one header to another - e.g.
+// RequestHeaders("X-XSRF-Token", "X-CSRF-Token") accepts both. It replaces any
+// header set by RequestHeader.
+func RequestHeaders(headers ...string) Option {
+	return func(cs *csrf) error {
+		cs.opts.RequestHeaders = headers
+		return nil
+	}
+}
+
+// Encoding sets the base64 encoding of the tokens sent to clients - and
+// expected back - including the XSRF-TOKEN cookie, the DoubleSubmit cookie and
+// UnmaskedToken. Defaults to base64.StdEncoding. Use base64.URLEncoding or
+// base64.RawURLEncoding for tokens that are placed in URLs, such as with
+// QueryFieldName. The signed session cookie of the default store is unaffected,
+// as it is already URL-safe.
+//
+// Note that changing the encoding invalidates all outstanding masked tokens.
+func Encoding(enc *base64.Encoding) Option {
+	return func(cs *csrf) error {
+		cs.opts.Encoding = enc
+		return nil
+	}
+}
+
+// MetaName sets the name of the <meta> tag rendered by MetaTag. Defaults to
+// "csrf-token".
+func MetaName(name string) Option {
+	return func(cs *csrf) error {
+		cs.opts.MetaName = name
+		return nil
+	}
+}
+
+// HeaderValuePrefix sets a prefix that is removed from the value of the request
+// header before the token is verified, for clients that send the token as an
+// authentication scheme - e.g. HeaderValuePrefix("CSRF ") with
+// RequestHeader("Authorization") accepts "Authorization: CSRF <token>". The
+// prefix is matched case-insensitively. A header without the prefix is treated
+// as absent, so the remaining headers and the form field are checked instead.
+func HeaderValuePrefix(prefix string) Option {
+	return func(cs *csrf) error {
+		cs.opts.HeaderValuePrefix = prefix
+		return nil
+	}
+}
+
+// TokenExtractor sets a function that returns the (masked) token from the
+// request, for tokens sent somewhere the built-in extraction doesn't look -
+// e.g. a gRPC-Web metadata header. When set, it replaces the RequestHeader,
+// FieldName, BodyFieldName and QueryFieldName lookups entirely. An empty token
+// fails with ErrNoToken. An error returned by fn fails the request with a
+// reason that wraps it, so the ErrorHandler can inspect it with errors.Is.
+func TokenExtractor(fn func(r *http.Request) (string, error)) Option {
 	return func(cs *csrf) error {
-		cs.opts.RequestHeader = header
+		cs.opts.TokenExtractor = fn
 		return nil
 	}
 }
@@ -91,29 +582,537 @@ func FieldName(name string) Option {
 	}
 }
 
+// BodyFieldName allows the middleware to read the token from a top-level key
+// in a JSON request body - e.g. {"csrf_token": "<token>"} - for requests with a
+// Content-Type of application/json. The body is buffered and restored, so the
+// wrapped handler still receives the full payload. Only the first MaxBodyBytes
+// (10MB by default) are read: a larger body is treated as carrying no token.
+//
+// The request header and form fields are still checked first. Disabled by
+// default.
+func BodyFieldName(name string) Option {
+	return func(cs *csrf) error {
+		cs.opts.BodyFieldName = name
+		return nil
+	}
+}
+
+// QueryFieldName allows the middleware to read the token from the named URL
+// query parameter - e.g. /confirm?csrf_token=<token> - for integrations that
+// can't send a header or form body. The query string is checked last, after
+// the request header, form fields and JSON body. Disabled by default.
+//
+// Note: tokens in URLs are easily leaked via server logs, browser history and
+// the Referer header sent to other sites. Only enable this if you must.
+func QueryFieldName(name string) Option {
+	return func(cs *csrf) error {
+		cs.opts.QueryFieldName = name
+		return nil
+	}
+}
+
 // CookieName changes the name of the CSRF cookie issued to clients.
 //
-// Note that cookie names should not contain whitespace, commas, semicolons,
-// backslashes or control characters as per RFC6265.
+// Cookie names must be a valid RFC6265 token: an error is returned if the name
+// is empty, or contains whitespace, control characters or any of the
+// separators ()<>@,;:\"/[]?={}.
 func CookieName(name string) Option {
 	return func(cs *csrf) error {
+		if !validCookieName(name) {
+			return fmt.Errorf("%sinvalid cookie name %q", errorPrefix, name)
+		}
+
 		cs.opts.CookieName = name
 		return nil
 	}
 }
 
-// setStore sets the store used by the CSRF middleware.
-// Note: this is private (for now) to allow for internal API changes.
-func setStore(s store) Option {
+// validCookieName reports whether name is a valid cookie name: a token as
+// defined by RFC2616 section 2.2, which RFC6265 refers to.
+func validCookieName(name string) bool {
+	if name == "" {
+		return false
+	}
+
+	for _, c := range name {
+		if c <= ' ' || c >= 0x7f || strings.ContainsRune(`()<>@,;:\"/[]?={}`, c) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// FallbackCookieNames sets previous names of the CSRF cookie, which are read
+// when the cookie named by CookieName is absent. Cookies are always written
+// using CookieName, so the cookie can be renamed without invalidating the
+// tokens already issued: remove the fallbacks once those have expired. Clear
+// expires the fallback cookies along with the current one.
+//
+// Fallbacks are read by the default cookie store and by DoubleSubmit, and are
+// ignored by other stores. Each name is validated as per CookieName.
+//
+// Example:
+//
+//	// Rename "_goji_csrf" to "__Host-_goji_csrf".
+//	csrf.Protect(key, csrf.HostPrefix(), csrf.FallbackCookieNames("_goji_csrf"))
+func FallbackCookieNames(names ...string) Option {
+	return func(cs *csrf) error {
+		for _, name := range names {
+			if !validCookieName(name) {
+				return fmt.Errorf("%sinvalid cookie name %q", errorPrefix, name)
+			}
+		}
+
+		cs.opts.FallbackCookieNames = names
+		return nil
+	}
+}
+
+// HostPrefix adds the "__Host-" prefix to the cookie name (see CookieName). The
+// prefix asks browsers to only accept the cookie if it is Secure, has a Path of
+// "/" and no Domain, so that it can't be set or overwritten by other
+// subdomains. The Path defaults to "/" when HostPrefix is used.
+//
+// Protect panics if the options conflict with the prefix: Secure(false), a
+// Domain, or a Path other than "/". The same constraints are enforced when a
+// CookieName already starting with "__Host-" is supplied.
+func HostPrefix() Option {
+	return func(cs *csrf) error {
+		cs.opts.HostPrefix = true
+		return nil
+	}
+}
+
+// ExemptPath exempts requests to the given paths - e.g. "/webhooks/stripe" -
+// from CSRF validation. Paths are matched exactly against r.URL.Path. Exempt
+// requests are passed straight to the wrapped handler, but are still issued a
+// token so that subsequent requests to protected paths work.
+//
+// Note: exempt paths are open to CSRF attacks. Only exempt endpoints that can't
+// be reached by a browser session (e.g. webhooks authenticated by a shared
+// secret) or that don't change state.
+func ExemptPath(paths ...string) Option {
+	return func(cs *csrf) error {
+		cs.opts.ExemptPaths = append(cs.opts.ExemptPaths, paths...)
+		return nil
+	}
+}
+
+// IssueOnPaths only issues a token - and writes the session cookie - to
+// requests without one when their path is one of the given paths, such as the
+// pages that render forms. Other requests, e.g. for static assets, don't get a
+// Set-Cookie header, and Token returns an empty token for them unless the
+// session already has one. Paths are matched exactly against r.URL.Path.
+//
+// Validation still applies to unsafe requests on every path: requests to other
+// paths fail with ErrNoToken until a token has been issued. EnsureToken still
+// issues a token on any path.
+func IssueOnPaths(paths ...string) Option {
+	return func(cs *csrf) error {
+		cs.opts.IssuePaths = append(cs.opts.IssuePaths, paths...)
+		return nil
+	}
+}
+
+// ExemptGlob exempts requests with a path matching the given pattern - e.g.
+// "/webhooks/*" - from CSRF validation. Patterns use the path.Match syntax, and
+// an error is returned if the pattern is malformed. See ExemptPath for the
+// security implications.
+func ExemptGlob(pattern string) Option {
+	return func(cs *csrf) error {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("%sinvalid exempt pattern %q: %v", errorPrefix, pattern, err)
+		}
+
+		cs.opts.ExemptGlobs = append(cs.opts.ExemptGlobs, pattern)
+		return nil
+	}
+}
+
+// Skip exempts requests from CSRF validation when fn returns true - e.g. for
+// service-to-service requests authenticated with a client certificate. It is
+// more flexible than ExemptPath, as fn can inspect any part of the request.
+// Skipped requests are passed straight to the wrapped handler, but are still
+// issued a token. Skip may be supplied more than once: a request is skipped
+// if any predicate returns true.
+//
+// Note: fn runs before any validation, on every request. Be conservative: only
+// return true for requests that can't originate from a browser session, such
+// as those with verified client certificates or API credentials that browsers
+// don't attach automatically.
+func Skip(fn func(r *http.Request) bool) Option {
+	return func(cs *csrf) error {
+		cs.opts.SkipFuncs = append(cs.opts.SkipFuncs, fn)
+		return nil
+	}
+}
+
+// TrustedOrigins allows cross-origin requests from the given origins - e.g.
+// "https://app.example.com" - to pass the origin check performed on HTTPS
+// requests, in addition to the request's own origin. Origins are matched on
+// scheme and host (including the port), and are compared against the Origin
+// header or, when absent, the Referer header. Cross-origin fetch and gRPC-Web
+// clients typically send an Origin but no Referer, which is sufficient.
+//
+// Trusting an origin here only allows its requests past the CSRF checks: the
+// browser must still be allowed to send them with credentials, and to read the
+// response, by the application's CORS headers (e.g.
+// Access-Control-Allow-Origin and Access-Control-Allow-Credentials), which this
+// package doesn't set. Tokens are still required, so the trusted origin must
+// also obtain one - e.g. from a TokenHandler.
+//
+// A host beginning with "*." trusts any subdomain: "https://*.example.com"
+// matches "https://app.example.com" and "https://a.b.example.com", but not
+// "https://example.com" itself (list it separately if it should be trusted) or
+// "https://evilexample.com".
+//
+// An error is returned if an origin doesn't include both a scheme and a host,
+// or uses a wildcard anywhere other than the first label of the host.
+func TrustedOrigins(origins []string) Option {
+	return func(cs *csrf) error {
+		trusted := make([]string, 0, len(origins))
+		for _, origin := range origins {
+			u, err := url.Parse(origin)
+			if err != nil || u.Scheme == "" || u.Host == "" {
+				return fmt.Errorf("%sinvalid trusted origin %q", errorPrefix, origin)
+			}
+
+			if host := strings.TrimPrefix(u.Host, wildcardPrefix); host == "" ||
+				strings.Contains(host, "*") || strings.HasPrefix(host, ".") {
+				return fmt.Errorf("%sinvalid trusted origin %q", errorPrefix, origin)
+			}
+
+			trusted = append(trusted, normalizeOrigin(u))
+		}
+
+		cs.opts.TrustedOrigins = append(cs.opts.TrustedOrigins, trusted...)
+		return nil
+	}
+}
+
+// DisableRefererCheck skips the check that unsafe HTTPS requests carry an
+// Origin or Referer header matching the request (or a trusted origin), while
+// still requiring a valid token. This is intended for deployments behind a
+// gateway that already enforces this check, where the Referer seen by the
+// application can't be relied upon. A warning is logged when the middleware is
+// created.
+//
+// The check defends against an attacker who can obtain a valid token and
+// cookie pair - e.g. by injecting a cookie over plain HTTP via a
+// man-in-the-middle, or from a sibling subdomain - and then submit a
+// cross-origin HTTPS request with it. Only disable it if something else
+// rejects such requests. It is also skipped by ValidateUpgrade.
+func DisableRefererCheck() Option {
+	return func(cs *csrf) error {
+		cs.opts.DisableRefererCheck = true
+		return nil
+	}
+}
+
+// TrustProxyHeaders instructs the middleware to use the X-Forwarded-Proto
+// header to determine whether a request was made over HTTPS, for applications
+// that sit behind a TLS-terminating proxy and only see plain HTTP. When the
+// header reports "https", the Origin/Referer check is enforced against the
+// HTTPS origin of the request. Defaults to false.
+//
+// Note: only enable this if every request passes through a trusted proxy that
+// overwrites or strips any X-Forwarded-Proto header supplied by the client.
+// Otherwise clients can control which checks are applied to their requests.
+func TrustProxyHeaders(trust bool) Option {
+	return func(cs *csrf) error {
+		cs.opts.TrustProxyHeaders = trust
+		return nil
+	}
+}
+
+// SafeMethods overrides the HTTP methods that are exempt from token validation.
+// Defaults to the idempotent ("safe") methods defined by RFC7231: GET, HEAD,
+// OPTIONS and TRACE. Method names are converted to upper case.
+//
+// Requests using any method are still issued a token. Note that any method
+// listed here can be used in a cross-site request without a token, so only
+// list methods that don't change state.
+func SafeMethods(methods ...string) Option {
+	return func(cs *csrf) error {
+		cs.opts.SafeMethods = make([]string, len(methods))
+		for i, method := range methods {
+			cs.opts.SafeMethods[i] = strings.ToUpper(method)
+		}
+
+		return nil
+	}
+}
+
+// TokenTTL sets a maximum age for the real CSRF token, independent of the
+// cookie's MaxAge. The time a token was issued is saved alongside it in the
+// store; requests made with an older token fail with ErrTokenExpired and a new
+// token is issued. Disabled by default, in which case tokens last as long as
+// the store keeps them.
+//
+// The timestamp is saved by the middleware, so this works with any store.
+// Note that with the default cookie store the timestamp lives in the client's
+// cookie: it is authenticated and can't be altered, but an expired cookie can
+// still be presented (and will be rejected).
+//
+// Enabling or disabling this invalidates all outstanding tokens.
+func TokenTTL(d time.Duration) Option {
+	return func(cs *csrf) error {
+		cs.opts.TokenTTL = d
+		return nil
+	}
+}
+
+// TokenLength sets the length (in bytes) of the generated CSRF token. Defaults
+// to 32 bytes and must be at least 16 bytes. Masked tokens sent to clients are
+// twice this length before encoding, unless a MaskLength is set.
+//
+// Note that changing the token length invalidates all outstanding tokens: any
+// existing token of a different length is discarded and a new one is issued.
+// Lengths much above 2KB produce cookies too large for browsers to store, which
+// the default cookie store refuses with ErrCookieTooLarge.
+func TokenLength(n int) Option {
+	return func(cs *csrf) error {
+		if n < minTokenLength {
+			return fmt.Errorf("%stoken length must be at least %d bytes",
+				errorPrefix, minTokenLength)
+		}
+
+		cs.opts.TokenLength = n
+		return nil
+	}
+}
+
+// RandReader sets the source of randomness used to generate real tokens.
+// Defaults to crypto/rand. It is intended for deterministic tests, or for
+// plugging in a different cryptographically secure generator. The one-time pads
+// used to mask tokens are always read from crypto/rand.
+//
+// Warning: tokens are only as unpredictable as this reader. Using anything
+// other than a CSPRNG in production allows attackers to guess tokens, which
+// removes all CSRF protection.
+func RandReader(r io.Reader) Option {
+	return func(cs *csrf) error {
+		cs.opts.RandReader = r
+		return nil
+	}
+}
+
+// MaskLength sets the length (in bytes) of the one-time-pad used to mask
+// tokens on each response. Defaults to the token length (see TokenLength).
+// Masked tokens sent to clients are the pad length plus the token length
+// before encoding. A pad shorter than the token is repeated to cover it, which
+// weakens the BREACH mitigation that masking provides: this option is intended
+// for experimentation, and the default is recommended.
+//
+// Note that changing the mask length invalidates all outstanding masked
+// tokens.
+func MaskLength(n int) Option {
+	return func(cs *csrf) error {
+		if n < 1 {
+			return fmt.Errorf("%smask length must be at least 1 byte", errorPrefix)
+		}
+
+		cs.opts.MaskLength = n
+		return nil
+	}
+}
+
+// MultipartMaxMemory sets the maximum number of bytes of a multipart form
+// (including files) held in memory when it is parsed for the token, as with
+// http.Request.ParseMultipartForm. The remainder is stored in temporary files.
+// Defaults to 32MB, which matches net/http. An error is returned if n is less
+// than 1. Use MaxBodyBytes to limit the size of the form itself.
+func MultipartMaxMemory(n int64) Option {
+	return func(cs *csrf) error {
+		if n < 1 {
+			return fmt.Errorf("%smultipart memory limit must be at least 1 byte", errorPrefix)
+		}
+
+		cs.opts.MultipartMaxMemory = n
+		return nil
+	}
+}
+
+// MaxBodyBytes limits the size (in bytes) of request bodies that are read to
+// find the token - e.g. form and JSON bodies - so that a huge body can't be
+// used to exhaust memory or disk. Requests with a larger body fail with
+// ErrBodyTooLarge, which the default error handler serves as a HTTP 413
+// Request Entity Too Large (or the FailureStatus, if set). The limit also
+// applies to the wrapped handler's reads of the body. By default, a multipart
+// form may hold up to 32MB in memory and spill the remainder to temporary
+// files: see MultipartMaxMemory.
+func MaxBodyBytes(n int64) Option {
+	return func(cs *csrf) error {
+		cs.opts.MaxBodyBytes = n
+		return nil
+	}
+}
+
+// RequireContentType rejects unsafe requests whose Content-Type isn't one of
+// the given media types - e.g. "application/json" - with ErrBadContentType,
+// which the default error handler serves as a HTTP 415 Unsupported Media Type
+// (or the FailureStatus, if set). Parameters such as charset are ignored, and
+// requests without a Content-Type are rejected. This is defense in depth: HTML
+// forms on other sites can only submit application/x-www-form-urlencoded,
+// multipart/form-data and text/plain bodies, and other types can't be sent
+// cross-origin without a CORS preflight. Tokens are still required.
+//
+// An error is returned if a media type can't be parsed.
+func RequireContentType(types ...string) Option {
+	return func(cs *csrf) error {
+		allowed := make([]string, 0, len(types))
+		for _, t := range types {
+			mediaType, _, err := mime.ParseMediaType(t)
+			if err != nil {
+				return fmt.Errorf("%sinvalid content type %q: %v", errorPrefix, t, err)
+			}
+
+			allowed = append(allowed, mediaType)
+		}
+
+		cs.opts.ContentTypes = allowed
+		return nil
+	}
+}
+
+// StoreFailurePolicy sets how requests are handled when a new token can't be
+// saved to the TokenStore - e.g. because a server-side store is unavailable.
+// With FailOpen, the request is passed to the handler without a token: Token
+// returns an empty token, and unsafe requests fail validation as usual. With
+// FailClosed, the request fails with ErrStoreFailure, which the default error
+// handler serves as a HTTP 500 Internal Server Error.
+//
+// By default, safe (e.g. GET) requests fail open, so that pages that don't
+// render a form stay available, and other requests fail closed. A token too
+// large for the cookie store (ErrCookieTooLarge) always fails closed, whatever
+// the policy, so that the misconfiguration is noticed.
+func StoreFailurePolicy(p FailurePolicy) Option {
+	return func(cs *csrf) error {
+		cs.opts.StoreFailurePolicy = p
+		return nil
+	}
+}
+
+// EncryptCookie encrypts the real token within the default cookie store using
+// AES-GCM, in addition to the HMAC that authenticates the cookie. This means a
+// stolen cookie doesn't reveal the real token. The key must be 16, 24 or 32
+// bytes long (for AES-128, AES-192 or AES-256), should be distinct from the
+// authentication key passed to Protect, and should be generated using
+// crypto/rand.
+//
+// Cookies that can't be decrypted - e.g. because they have been tampered with
+// or were issued before encryption was enabled - are rejected with ErrBadToken
+// and replaced with a new token. Protect panics if EncryptCookie is combined
+// with a Store or DoubleSubmit.
+func EncryptCookie(key []byte) Option {
+	return func(cs *csrf) error {
+		if _, err := aes.NewCipher(key); err != nil {
+			return fmt.Errorf("%sinvalid encryption key: %w", errorPrefix, err)
+		}
+
+		cs.opts.EncryptionKey = key
+		return nil
+	}
+}
+
+// Codec sets the CookieCodec used by the default cookie store to encode the
+// cookie value - e.g. to sign it with a key held in a KMS. Defaults to signing
+// and timestamping the value with gorilla/securecookie, using the key passed to
+// Protect. VerificationKeys only apply to the default codec, and a custom codec
+// is responsible for enforcing MaxAge if it should. Protect panics if Codec is
+// combined with a Store or DoubleSubmit.
+func Codec(c CookieCodec) Option {
+	return func(cs *csrf) error {
+		cs.opts.Codec = c
+		return nil
+	}
+}
+
+// Store sets the TokenStore used by the CSRF middleware to persist the real
+// token. Defaults to a signed cookie store when not set. See NewMemoryStore and
+// the redisstore package for server-side stores, and NewCookieStore to create
+// the default store explicitly.
+func Store(s TokenStore) Option {
 	return func(cs *csrf) error {
 		cs.st = s
 		return nil
 	}
 }
 
+// ReplayWindow rejects an unsafe request with ErrTokenReplayed if the session's
+// token was already used by another unsafe request within d - e.g. a form that
+// is submitted twice by a double click, or a captured request that is replayed
+// soon after. As the check is made against the session's real token, re-masking
+// a captured token doesn't evade it. Unlike SingleUse, it works with any store,
+// and the session token isn't replaced. Only a SHA-256 hash of each token is
+// kept, in memory, so the window isn't shared between processes. Up to 10,000
+// sessions are remembered: beyond that, the oldest are forgotten early.
+//
+// This allows a single unsafe request per session in each window, including
+// across browser tabs, and concurrent requests from scripts: keep the window
+// short (e.g. a few seconds), and don't use it where a client legitimately
+// sends unsafe requests in quick succession. A duration of zero or less
+// disables the check.
+func ReplayWindow(d time.Duration) Option {
+	return func(cs *csrf) error {
+		cs.opts.ReplayWindow = d
+		return nil
+	}
+}
+
+// SingleUse makes each token valid for a single unsafe request: once a request
+// has been validated, its token is deleted from the store and a new one is
+// generated. The new session cookie is written to the response, and the new
+// token is available to the handler via Token (and in the response header, if
+// ResponseHeader is set). A replayed request then fails with ErrNoToken.
+//
+// SingleUse requires a server-side Store that implements TokenClearer, such as
+// MemoryStore or redisstore.Store: a cookie store can't invalidate the token carried
+// by a cookie the client already has, and Protect panics if one is used.
+//
+// Note: only the most recent token is valid, so concurrent submissions - e.g.
+// two forms open in separate tabs, or parallel XHRs - fail after the first one.
+// Clients must use the token returned by each response for the next request.
+func SingleUse(s bool) Option {
+	return func(cs *csrf) error {
+		cs.opts.SingleUse = s
+		return nil
+	}
+}
+
+// PresetStrict returns options for deployments where the application is only
+// ever used directly - i.e. never via links or forms on other sites: a
+// SameSite=Strict, Secure and HttpOnly cookie. Browsers then withhold the cookie
+// from all cross-site requests, including top-level navigations, in addition to
+// the token check. Options that follow it can override any of these.
+//
+// Example:
+//
+//	opts := append(csrf.PresetStrict(), csrf.Path("/app"))
+//	m.UseC(csrf.Protect(key, opts...))
+func PresetStrict() []Option {
+	return []Option{
+		SameSite(SameSiteStrictMode),
+		Secure(true),
+		HttpOnly(true),
+	}
+}
+
+// PresetRelaxed is like PresetStrict, but with a SameSite=Lax cookie, so that
+// the cookie is still sent when users follow a link to the application from
+// another site. Unsafe cross-site requests are still rejected.
+func PresetRelaxed() []Option {
+	return []Option{
+		SameSite(SameSiteLaxMode),
+		Secure(true),
+		HttpOnly(true),
+	}
+}
+
 // parseOptions parses the supplied options functions and returns a configured
-// csrf handler.
-func parseOptions(h goji.Handler, opts ...Option) *csrf {
+// csrf handler, or the first error returned by an option.
+func parseOptions(h goji.Handler, opts ...Option) (*csrf, error) {
 	// Set the handler to call after processing.
 	cs := &csrf{
 		h: h,
@@ -123,14 +1122,19 @@ func parseOptions(h goji.Handler, opts ...Option) *csrf {
 	// Set here to allow package users to override the default.
 	cs.opts.Secure = true
 	cs.opts.HttpOnly = true
+	cs.opts.VaryCookie = true
+	// Set here so that MaxAge(0) can request a session cookie.
+	cs.opts.MaxAge = defaultMaxAge
 
 	// Range over each options function and apply it
 	// to our csrf type to configure it. Options functions are
 	// applied in order, with any conflicting options overriding
 	// earlier calls.
 	for _, option := range opts {
-		option(cs)
+		if err := option(cs); err != nil {
+			return nil, err
+		}
 	}
 
-	return cs
+	return cs, nil
 }
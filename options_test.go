@@ -29,10 +29,14 @@ func TestOptions(t *testing.T) {
 		FieldName(field),
 		ErrorHandler(goji.HandlerFunc(errorHandler)),
 		CookieName(name),
+		SameSite(SameSiteStrictMode),
 	}
 
 	// Parse our test options and check that they set the related struct fields.
-	cs := parseOptions(h, testOpts...)
+	cs, err := parseOptions(h, testOpts...)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	if cs.opts.MaxAge != age {
 		t.Errorf("MaxAge not set correctly: got %v want %v", cs.opts.MaxAge, age)
@@ -54,8 +58,8 @@ func TestOptions(t *testing.T) {
 		t.Errorf("Secure not set correctly: got %v want %v", cs.opts.Secure, false)
 	}
 
-	if cs.opts.RequestHeader != header {
-		t.Errorf("RequestHeader not set correctly: got %v want %v", cs.opts.RequestHeader, header)
+	if len(cs.opts.RequestHeaders) != 1 || cs.opts.RequestHeaders[0] != header {
+		t.Errorf("RequestHeader not set correctly: got %v want %v", cs.opts.RequestHeaders, header)
 	}
 
 	if cs.opts.FieldName != field {
@@ -71,4 +75,198 @@ func TestOptions(t *testing.T) {
 		t.Errorf("CookieName not set correctly: got %v want %v",
 			cs.opts.CookieName, name)
 	}
+
+	if cs.opts.SameSite != SameSiteStrictMode {
+		t.Errorf("SameSite not set correctly: got %v want %v",
+			cs.opts.SameSite, SameSiteStrictMode)
+	}
+}
+
+// TestSameSiteNone tests that SameSite=None refuses an explicitly insecure
+// cookie.
+func TestSameSiteNone(t *testing.T) {
+	cs := &csrf{}
+	cs.opts.Secure = false
+
+	if err := SameSite(SameSiteNoneMode)(cs); err == nil {
+		t.Fatal("SameSite(SameSiteNoneMode) did not reject Secure(false)")
+	}
+
+	if cs.opts.SameSite != 0 {
+		t.Fatalf("SameSite set despite an error: got %v want %v", cs.opts.SameSite, 0)
+	}
+
+	cs.opts.Secure = true
+	if err := SameSite(SameSiteNoneMode)(cs); err != nil {
+		t.Fatalf("SameSite(SameSiteNoneMode) rejected a Secure cookie: %v", err)
+	}
+}
+
+// TestPartitionedSecure tests that Partitioned(true) rejects Secure(false).
+func TestPartitionedSecure(t *testing.T) {
+	cs := &csrf{}
+	cs.opts.Secure = false
+
+	if err := Partitioned(true)(cs); err == nil {
+		t.Fatal("Partitioned(true) did not reject Secure(false)")
+	}
+
+	if err := Partitioned(false)(cs); err != nil {
+		t.Fatalf("Partitioned(false) rejected an insecure cookie: %v", err)
+	}
+}
+
+// TestTokenLengthMinimum tests that short token lengths are rejected.
+func TestTokenLengthMinimum(t *testing.T) {
+	cs := &csrf{}
+
+	if err := TokenLength(minTokenLength - 1)(cs); err == nil {
+		t.Fatalf("TokenLength accepted a length of %d", minTokenLength-1)
+	}
+
+	if err := TokenLength(minTokenLength)(cs); err != nil {
+		t.Fatalf("TokenLength rejected a length of %d: %v", minTokenLength, err)
+	}
+}
+
+// TestExemptGlobPattern tests that malformed glob patterns are rejected.
+func TestExemptGlobPattern(t *testing.T) {
+	cs := &csrf{}
+
+	if err := ExemptGlob("/webhooks/[")(cs); err == nil {
+		t.Fatal("ExemptGlob accepted a malformed pattern")
+	}
+
+	if len(cs.opts.ExemptGlobs) != 0 {
+		t.Fatalf("ExemptGlob stored a malformed pattern: got %v", cs.opts.ExemptGlobs)
+	}
+}
+
+// TestTrustedOriginsInvalid tests that origins without a scheme or host are
+// rejected.
+func TestTrustedOriginsInvalid(t *testing.T) {
+	for _, origin := range []string{"example.com", "https://", "://example.com"} {
+		cs := &csrf{}
+		if err := TrustedOrigins([]string{origin})(cs); err == nil {
+			t.Errorf("TrustedOrigins accepted an invalid origin: %q", origin)
+		}
+	}
+
+	cs := &csrf{}
+	if err := TrustedOrigins([]string{"https://Example.com:8443"})(cs); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := "https://example.com:8443"; !contains(cs.opts.TrustedOrigins, want) {
+		t.Fatalf("TrustedOrigins not normalized: got %v want %v", cs.opts.TrustedOrigins, want)
+	}
+}
+
+// TestHostPrefix tests that the __Host- prefix is applied, and that options
+// that conflict with it are rejected.
+func TestHostPrefix(t *testing.T) {
+	cs := Protect(testKey, HostPrefix())(testHandler).(*csrf)
+	if cs.opts.CookieName != "__Host-"+cookieName || cs.opts.Path != "/" {
+		t.Fatalf("HostPrefix not applied: got name %q, path %q", cs.opts.CookieName, cs.opts.Path)
+	}
+
+	var prefixTests = []struct {
+		name  string
+		opts  []Option
+		valid bool
+	}{
+		{"prefix", []Option{HostPrefix(), Path("/")}, true},
+		{"prefixed name", []Option{CookieName("__Host-csrf"), Path("/")}, true},
+		{"insecure", []Option{HostPrefix(), Secure(false)}, false},
+		{"domain", []Option{HostPrefix(), Domain("example.com")}, false},
+		{"path", []Option{HostPrefix(), Path("/forms/")}, false},
+		{"prefixed name without path", []Option{CookieName("__Host-csrf")}, false},
+	}
+
+	for _, v := range prefixTests {
+		func() {
+			defer func() {
+				if r := recover(); (r == nil) != v.valid {
+					t.Errorf("%s: got panic %v, want valid %v", v.name, r, v.valid)
+				}
+			}()
+
+			Protect(testKey, v.opts...)(testHandler)
+		}()
+	}
+}
+
+// TestCookieNameValidation tests that invalid cookie names are rejected.
+func TestCookieNameValidation(t *testing.T) {
+	var nameTests = []struct {
+		name  string
+		valid bool
+	}{
+		{"__Host-csrf_token.v2", true},
+		{"", false},
+		{"csrf token", false},
+		{"csrf,token", false},
+		{"csrf;token", false},
+		{`csrf\token`, false},
+		{"csrf\ttoken", false},
+		{"csrf\x00token", false},
+		{"csrf=token", false},
+		{"jeton-é", false},
+	}
+
+	for _, v := range nameTests {
+		cs := &csrf{}
+
+		err := CookieName(v.name)(cs)
+		if (err == nil) != v.valid {
+			t.Errorf("CookieName(%q): got error %v, want valid %v", v.name, err, v.valid)
+		}
+
+		if !v.valid && cs.opts.CookieName != "" {
+			t.Errorf("CookieName(%q) set despite an error", v.name)
+		}
+	}
+
+	if _, err := parseOptions(nil, CookieName("bad name")); err == nil {
+		t.Error("parseOptions did not return the CookieName error")
+	}
+}
+
+// TestMaskLengthMinimum tests that pads shorter than a byte are rejected.
+func TestMaskLengthMinimum(t *testing.T) {
+	cs := &csrf{}
+
+	if err := MaskLength(0)(cs); err == nil {
+		t.Fatal("MaskLength accepted a length of 0")
+	}
+
+	if err := MaskLength(1)(cs); err != nil {
+		t.Fatalf("MaskLength rejected a length of 1: %v", err)
+	}
+}
+
+// TestConflictingStoreOptions tests that options for the cookie store are
+// rejected when combined with another store.
+func TestConflictingStoreOptions(t *testing.T) {
+	ms := NewMemoryStore()
+	defer ms.Close()
+
+	var conflictTests = []struct {
+		name  string
+		opts  []Option
+		valid bool
+	}{
+		{"store and double submit", []Option{Store(ms), DoubleSubmit()}, false},
+		{"store and encryption", []Option{Store(ms), EncryptCookie(testKey)}, false},
+		{"store and codec", []Option{Store(ms), Codec(prefixCodec{})}, false},
+		{"double submit and encryption", []Option{DoubleSubmit(), EncryptCookie(testKey)}, false},
+		{"store", []Option{Store(ms), MaxAge(3600)}, true},
+		{"cookie store", []Option{EncryptCookie(testKey), Codec(prefixCodec{})}, true},
+	}
+
+	for _, v := range conflictTests {
+		if _, err := newCSRF(testKey, v.opts...); (err == nil) != v.valid {
+			t.Errorf("%s: got error %v, want valid %v", v.name, err, v.valid)
+		}
+	}
 }
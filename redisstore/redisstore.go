@@ -0,0 +1,162 @@
+// Package redisstore provides a server-side CSRF token store for
+// github.com/goji/ctx-csrf, backed by Redis. It is a separate package so that
+// applications that don't use it don't depend on a Redis client. It uses the
+// go-redis v6 API.
+package redisstore
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/go-redis/redis"
+
+	csrf "github.com/goji/ctx-csrf"
+)
+
+// keyPrefix is prepended to session IDs to form the Redis key.
+const keyPrefix = "goji.csrf.session."
+
+// namedKeyPrefix is prepended to keys saved with SaveKey.
+const namedKeyPrefix = "goji.csrf.key."
+
+// sessionIDLength is the length of session IDs in bytes, before hex encoding.
+const sessionIDLength = 32
+
+// Store is a server-side CSRF token store backed by Redis. Clients are issued
+// a cookie containing a random (256 bit) session ID that references the real
+// token in Redis, so the token itself never leaves the server.
+//
+// Tokens expire from Redis after the configured MaxAge.
+type Store struct {
+	client *redis.Client
+	cookie csrf.SessionCookie
+}
+
+// New returns a Store using the provided client. The cookie used to carry the
+// session ID is configured with the same options as csrf.Protect -
+// CookieName, MaxAge, Domain, Path, Secure, HttpOnly and SameSite - and MaxAge
+// is also used as the TTL of the Redis key. As every key needs a TTL, a MaxAge
+// of zero or less uses the default of 12 hours. Other options are ignored, but
+// New panics if any option returns an error.
+//
+// Example:
+//
+//	client := redis.NewClient(&redis.Options{Addr: "localhost:6379"})
+//	opts := []csrf.Option{csrf.MaxAge(3600), csrf.CookieName("_session")}
+//	st := redisstore.New(client, opts...)
+//	m.UseC(csrf.Protect(key, append(opts, csrf.Store(st))...))
+func New(client *redis.Client, opts ...csrf.Option) *Store {
+	cookie, err := csrf.NewSessionCookie(opts...)
+	if err != nil {
+		panic(err)
+	}
+
+	return &Store{client: client, cookie: cookie}
+}
+
+// Get retrieves the CSRF token referenced by the session ID in the request
+// cookie. It returns an error if the cookie doesn't exist, or csrf.ErrNoToken
+// if the token has expired from (or was never saved to) Redis.
+func (rs *Store) Get(r *http.Request) ([]byte, error) {
+	cookie, err := r.Cookie(rs.cookie.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := rs.client.Get(keyPrefix + cookie.Value).Bytes()
+	if err == redis.Nil {
+		return nil, csrf.ErrNoToken
+	}
+
+	return token, err
+}
+
+// Save stores the CSRF token in Redis under a new session ID and writes the ID
+// to the session cookie.
+func (rs *Store) Save(token []byte, w http.ResponseWriter) error {
+	id := make([]byte, sessionIDLength)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+
+	sid := hex.EncodeToString(id)
+	if err := rs.client.Set(keyPrefix+sid, token, rs.ttl()).Err(); err != nil {
+		return err
+	}
+
+	rs.cookie.Set(w, sid)
+
+	return nil
+}
+
+// Refresh stores the CSRF token in Redis under the session ID in the request
+// cookie, resetting its lifetime, and rewrites the session cookie. It returns
+// an error if the cookie doesn't exist, or csrf.ErrNoToken if the session's
+// token has expired from (or was never saved to) Redis.
+func (rs *Store) Refresh(token []byte, w http.ResponseWriter, r *http.Request) error {
+	cookie, err := r.Cookie(rs.cookie.Name)
+	if err != nil {
+		return err
+	}
+
+	// Only overwrite an existing key, so that an expired session isn't
+	// revived under an ID the client chose.
+	ok, err := rs.client.SetXX(keyPrefix+cookie.Value, token, rs.ttl()).Result()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return csrf.ErrNoToken
+	}
+
+	rs.cookie.Set(w, cookie.Value)
+
+	return nil
+}
+
+// Clear deletes the CSRF token referenced by the session ID in the request
+// cookie from Redis, and expires the session cookie.
+func (rs *Store) Clear(w http.ResponseWriter, r *http.Request) error {
+	if cookie, err := r.Cookie(rs.cookie.Name); err == nil {
+		if err := rs.client.Del(keyPrefix + cookie.Value).Err(); err != nil {
+			return err
+		}
+	}
+
+	rs.cookie.Expire(w)
+
+	return nil
+}
+
+// GetKey retrieves the CSRF token saved under the key, or csrf.ErrNoToken if it
+// has expired from (or was never saved to) Redis.
+func (rs *Store) GetKey(key string) ([]byte, error) {
+	token, err := rs.client.Get(namedKeyPrefix + key).Bytes()
+	if err == redis.Nil {
+		return nil, csrf.ErrNoToken
+	}
+
+	return token, err
+}
+
+// SaveKey stores the CSRF token in Redis under the key for the store's MaxAge.
+func (rs *Store) SaveKey(key string, token []byte) error {
+	return rs.client.Set(namedKeyPrefix+key, token, rs.ttl()).Err()
+}
+
+// DeleteKey deletes the CSRF token saved under the key from Redis.
+func (rs *Store) DeleteKey(key string) error {
+	return rs.client.Del(namedKeyPrefix + key).Err()
+}
+
+// SessionCookie returns the configuration of the session cookie.
+func (rs *Store) SessionCookie() csrf.SessionCookie {
+	return rs.cookie
+}
+
+// ttl returns the lifetime of tokens in Redis: the cookie's MaxAge.
+func (rs *Store) ttl() time.Duration {
+	return time.Duration(rs.cookie.MaxAge) * time.Second
+}
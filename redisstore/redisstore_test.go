@@ -0,0 +1,194 @@
+package redisstore
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/go-redis/redis"
+	"golang.org/x/net/context"
+
+	"goji.io"
+	"goji.io/pat"
+
+	csrf "github.com/goji/ctx-csrf"
+)
+
+// Check Store implementations
+var _ csrf.TokenStore = &Store{}
+var _ csrf.TokenClearer = &Store{}
+var _ csrf.TokenRefresher = &Store{}
+var _ csrf.KeyedTokenStore = &Store{}
+
+var testKey = []byte("keep-it-secret-keep-it-safe-----")
+var testHandler = goji.HandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {})
+
+// cookieName is the default session cookie name.
+const cookieName = "_goji_csrf"
+
+func newTestStore(t *testing.T, opts ...csrf.Option) (*Store, *miniredis.Miniredis) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	return New(client, opts...), mr
+}
+
+// setCookie copies the session cookie set on the recorded response to r.
+func setCookie(rr *httptest.ResponseRecorder, r *http.Request) {
+	r.Header.Set("Cookie", rr.Header().Get("Set-Cookie"))
+}
+
+// TestStoreRoundTrip tests that a saved token can be retrieved using the
+// issued session cookie.
+func TestStoreRoundTrip(t *testing.T) {
+	age := 3600
+	rs, mr := newTestStore(t, csrf.MaxAge(age))
+	defer mr.Close()
+
+	token := []byte("a-real-csrf-token-of-32-bytes---")
+
+	rr := httptest.NewRecorder()
+	if err := rs.Save(token, rr); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setCookie(rr, r)
+
+	got, err := rs.Get(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, token) {
+		t.Fatalf("tokens do not match: got %x want %x", got, token)
+	}
+
+	// The cookie should only carry the session ID, and the key should expire
+	// after MaxAge.
+	cookie, err := r.Cookie(cookieName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := keyPrefix + cookie.Value
+	if ttl := mr.TTL(key); ttl != time.Duration(age)*time.Second {
+		t.Fatalf("redis TTL not set correctly: got %v want %v", ttl, time.Duration(age)*time.Second)
+	}
+
+	mr.FastForward(time.Duration(age+1) * time.Second)
+	if _, err := rs.Get(r); err == nil {
+		t.Fatal("redis store returned an expired token")
+	}
+}
+
+// TestStoreMissing tests that an unknown session ID returns an error.
+func TestStoreMissing(t *testing.T) {
+	rs, mr := newTestStore(t)
+	defer mr.Close()
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := rs.Get(r); err == nil {
+		t.Fatal("redis store did not report a missing cookie")
+	}
+
+	r.AddCookie(&http.Cookie{Name: cookieName, Value: "unknown"})
+	if _, err := rs.Get(r); err == nil {
+		t.Fatal("redis store did not report an unknown session ID")
+	}
+}
+
+// TestStoreProtect tests a full request cycle through the middleware
+// using the Redis store.
+func TestStoreProtect(t *testing.T) {
+	rs, mr := newTestStore(t)
+	defer mr.Close()
+
+	m := goji.NewMux()
+	m.UseC(csrf.Protect(testKey, csrf.Store(rs)))
+
+	var token string
+	m.HandleFuncC(pat.New("/"), func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		token = csrf.Token(ctx, r)
+	})
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	m.ServeHTTP(rr, r)
+
+	r, err = http.NewRequest("POST", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setCookie(rr, r)
+	r.Header.Set("X-CSRF-Token", token)
+
+	rr = httptest.NewRecorder()
+	m.ServeHTTP(rr, r)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("middleware failed to pass to the next handler: got %v want %v",
+			rr.Code, http.StatusOK)
+	}
+}
+
+// TestStoreSlidingExpiry tests that SlidingExpiry refreshes the token
+// under the existing session ID, and doesn't revive an expired session.
+func TestStoreSlidingExpiry(t *testing.T) {
+	rs, mr := newTestStore(t, csrf.MaxAge(3600))
+	defer mr.Close()
+
+	s := csrf.Protect(testKey, csrf.Store(rs), csrf.SlidingExpiry(true))(testHandler)
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issued := httptest.NewRecorder()
+	s.ServeHTTPC(context.Background(), issued, r)
+
+	for i := 0; i < 10; i++ {
+		r, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		setCookie(issued, r)
+		s.ServeHTTPC(context.Background(), httptest.NewRecorder(), r)
+	}
+
+	if keys := mr.Keys(); len(keys) != 1 {
+		t.Fatalf("refreshes added Redis keys: got %q", keys)
+	}
+
+	// The session expires, and a refresh must not recreate it.
+	mr.FlushAll()
+	r, err = http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setCookie(issued, r)
+	if err := rs.Refresh([]byte("token"), httptest.NewRecorder(), r); err != csrf.ErrNoToken {
+		t.Fatalf("expired session refreshed: got %v want %v", err, csrf.ErrNoToken)
+	}
+}
@@ -1,58 +1,219 @@
 package csrf
 
 import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"net/http"
 	"time"
 
 	"github.com/gorilla/securecookie"
 )
 
-// store represents the session storage used for CSRF tokens.
-type store interface {
-	// Get returns the real CSRF token from the store.
+// Maximum size in bytes of a cookie (name, value and attributes) that browsers
+// are required to store, as per RFC 6265 section 6.1.
+const maxCookieSize = 4096
+
+// CookieFormatVersion is the version of the value format written by the cookie
+// store: a version byte followed by the (optionally encrypted) token, which the
+// CookieCodec then encodes. Cookies with any other version - including those
+// issued before the format was versioned - are rejected with ErrBadToken and
+// replaced with a new token, as after a key rotation.
+const CookieFormatVersion byte = 1
+
+// ErrCookieTooLarge is returned by the cookie store when the encoded CSRF
+// cookie exceeds the size browsers will store - e.g. because the TokenLength is
+// too large. Browsers silently drop such cookies, which would otherwise cause
+// every unsafe request to fail.
+var ErrCookieTooLarge = errors.New(errorPrefix + "CSRF cookie too large")
+
+// TokenStore represents the session storage used for CSRF tokens. Implement it
+// and pass it to the Store option to keep tokens somewhere other than the
+// default signed cookie - e.g. a server-side session or database.
+type TokenStore interface {
+	// Get returns the real CSRF token from the store. Stores should return
+	// ErrNoToken if they hold no token for the request.
 	Get(r *http.Request) ([]byte, error)
 	// Save stores the real CSRF token in the store and writes a
 	// cookie to the http.ResponseWriter.
 	// For non-cookie stores, the cookie should contain a unique (256 bit) ID
 	// or key that references the token in the backend store.
-	// csrf.GenerateRandomBytes is a helper function for generating secure IDs.
+	// IDs should be generated using crypto/rand.
 	Save(token []byte, w http.ResponseWriter) error
 }
 
-// cookieStore is a signed cookie session store for CSRF tokens.
-type cookieStore struct {
+// TokenClearer is implemented by TokenStores that can delete a token - e.g.
+// on logout. See Clear.
+type TokenClearer interface {
+	// Clear deletes the real CSRF token from the store, and expires the
+	// cookie referencing it.
+	Clear(w http.ResponseWriter, r *http.Request) error
+}
+
+// TokenRefresher is implemented by server-side stores that can re-save a token
+// under the session's existing ID, extending its lifetime, instead of issuing
+// a new session ID. SlidingExpiry uses it, so that a refresh doesn't leave a
+// store entry behind for every request. MemoryStore and redisstore.Store
+// implement it.
+type TokenRefresher interface {
+	// Refresh saves the real CSRF token under the session ID in the request
+	// cookie, resetting its lifetime, and rewrites the session cookie. It
+	// returns ErrNoToken if the store has no token for the session.
+	Refresh(token []byte, w http.ResponseWriter, r *http.Request) error
+}
+
+// KeyedTokenStore is implemented by server-side stores that can hold tokens
+// under a key chosen by the middleware, rather than a session ID they issue in
+// a cookie. It is required by HeaderOnly. MemoryStore and redisstore.Store
+// implement it.
+type KeyedTokenStore interface {
+	// GetKey returns the real CSRF token saved under the key, or ErrNoToken
+	// if there is none.
+	GetKey(key string) ([]byte, error)
+	// SaveKey saves the real CSRF token under the key, replacing any
+	// existing token.
+	SaveKey(key string, token []byte) error
+	// DeleteKey deletes the token saved under the key, if any.
+	DeleteKey(key string) error
+}
+
+// CookieCodec encodes and decodes the value of the cookie used by the default
+// cookie store. The default codec signs and timestamps the value using
+// gorilla/securecookie: implement CookieCodec and pass it to the Codec option to
+// use a different scheme. Decode must return an error if the encoded value
+// hasn't been produced by Encode for the same cookie name.
+type CookieCodec interface {
+	Encode(name string, value []byte) (string, error)
+	Decode(name, encoded string) ([]byte, error)
+}
+
+// secureCookieCodec is the default CookieCodec.
+type secureCookieCodec struct {
+	sc *securecookie.SecureCookie
+}
+
+// Encode signs and timestamps the value.
+func (c secureCookieCodec) Encode(name string, value []byte) (string, error) {
+	return c.sc.Encode(name, value)
+}
+
+// Decode verifies the signature and timestamp of the encoded value, and
+// returns the value.
+func (c secureCookieCodec) Decode(name, encoded string) ([]byte, error) {
+	var value []byte
+	if err := c.sc.Decode(name, encoded, &value); err != nil {
+		return nil, err
+	}
+
+	return value, nil
+}
+
+// CookieStore is a signed cookie session store for CSRF tokens, and the store
+// that Protect uses by default. It is exported so that applications can wrap
+// it - e.g. to add telemetry to Save - and supply the wrapper with the Store
+// option. Create one with NewCookieStore.
+type CookieStore struct {
 	name     string
 	maxAge   int
 	secure   bool
 	httpOnly bool
 	path     string
 	domain   string
-	sc       *securecookie.SecureCookie
+	sameSite SameSiteMode
+	// partitioned adds the Partitioned attribute, which http.Cookie doesn't
+	// support before Go 1.23.
+	partitioned bool
+	codec       CookieCodec
+	// verify holds codecs for previous keys, which are only used to decode
+	// existing cookies.
+	verify []CookieCodec
+	// aead encrypts the token within the cookie, if set.
+	aead cipher.AEAD
+	// fallbacks are cookie names read when the named cookie is absent.
+	fallbacks []string
+}
+
+// NewCookieStore returns a CookieStore configured exactly as the default store
+// of Protect(authKey, opts...) would be, so authKey should be the key given to
+// Protect. The cookie options - CookieName, MaxAge, Domain, Path, Secure,
+// HttpOnly, SameSite, Partitioned, HostPrefix and FallbackCookieNames - and
+// EncryptCookie, Codec and VerificationKeys apply. Other options are ignored,
+// but NewCookieStore panics if the key is too short or any option returns an
+// error, or if the options select another store, such as DoubleSubmit.
+//
+// EncryptCookie and Codec can't also be passed to Protect once the store is
+// supplied with the Store option, as they only apply to the store.
+//
+// Example:
+//
+//	opts := []csrf.Option{csrf.CookieName("_csrf"), csrf.MaxAge(3600)}
+//	st := csrf.NewCookieStore(key, opts...)
+//	m.UseC(csrf.Protect(key, append(opts, csrf.Store(&countingStore{st}))...))
+func NewCookieStore(authKey []byte, opts ...Option) *CookieStore {
+	// Protect warns about the configuration, so don't repeat it here.
+	opts = append(opts[:len(opts):len(opts)], Logger(nopLogger{}))
+
+	cs, err := newCSRF(authKey, opts...)
+	if err != nil {
+		panic(err)
+	}
+
+	st, ok := cs.st.(*CookieStore)
+	if !ok {
+		panic(errors.New(errorPrefix + "NewCookieStore can't be combined with Store, DoubleSubmit or HeaderOnly"))
+	}
+
+	return st
 }
 
 // Get retrieves a CSRF token from the session cookie. It returns an empty token
 // if decoding fails (e.g. HMAC validation fails or the named cookie doesn't exist).
-func (cs *cookieStore) Get(r *http.Request) ([]byte, error) {
-	// Retrieve the cookie from the request
-	cookie, err := r.Cookie(cs.name)
+func (cs *CookieStore) Get(r *http.Request) ([]byte, error) {
+	// Retrieve the cookie from the request, falling back to any previous names.
+	cookie, err := requestCookie(r, cs.name, cs.fallbacks)
 	if err != nil {
 		return nil, err
 	}
 
-	token := make([]byte, tokenLength)
-	// Decode the HMAC authenticated cookie.
-	err = cs.sc.Decode(cs.name, cookie.Value, &token)
+	// Decode the HMAC authenticated cookie, falling back to any previous keys.
+	// The cookie is bound to the name it was issued under.
+	token, err := cs.codec.Decode(cookie.Name, cookie.Value)
+	for i := 0; err != nil && i < len(cs.verify); i++ {
+		token, err = cs.verify[i].Decode(cookie.Name, cookie.Value)
+	}
 	if err != nil {
 		return nil, err
 	}
 
+	if len(token) == 0 || token[0] != CookieFormatVersion {
+		return nil, ErrBadToken
+	}
+	token = token[1:]
+
+	if cs.aead != nil {
+		return cs.decrypt(token, cookie.Name)
+	}
+
 	return token, nil
 }
 
 // Save stores the CSRF token in the session cookie.
-func (cs *cookieStore) Save(token []byte, w http.ResponseWriter) error {
-	// Generate an encoded cookie value with the CSRF token.
-	encoded, err := cs.sc.Encode(cs.name, token)
+func (cs *CookieStore) Save(token []byte, w http.ResponseWriter) error {
+	if cs.aead != nil {
+		var err error
+		if token, err = cs.encrypt(token); err != nil {
+			return err
+		}
+	}
+
+	// Generate an encoded cookie value with the version and CSRF token.
+	value := make([]byte, 0, 1+len(token))
+	value = append(append(value, CookieFormatVersion), token...)
+	encoded, err := cs.codec.Encode(cs.name, value)
 	if err != nil {
 		return err
 	}
@@ -60,23 +221,341 @@ func (cs *cookieStore) Save(token []byte, w http.ResponseWriter) error {
 	cookie := &http.Cookie{
 		Name:     cs.name,
 		Value:    encoded,
-		MaxAge:   cs.maxAge,
 		HttpOnly: cs.httpOnly,
 		Secure:   cs.secure,
 		Path:     cs.path,
 		Domain:   cs.domain,
+		SameSite: http.SameSite(cs.sameSite),
+	}
+
+	setMaxAge(cookie, cs.maxAge)
+
+	v := cookie.String()
+	if cs.partitioned {
+		v += "; Partitioned"
+	}
+
+	// Refuse to issue a cookie the browser would drop.
+	if len(v) > maxCookieSize {
+		return fmt.Errorf("%w: %d bytes exceeds %d", ErrCookieTooLarge, len(v), maxCookieSize)
+	}
+
+	// Write the authenticated cookie to the response.
+	w.Header().Add("Set-Cookie", v)
+
+	return nil
+}
+
+// Clear expires the session cookie, and any fallback cookies.
+func (cs *CookieStore) Clear(w http.ResponseWriter, r *http.Request) error {
+	for _, name := range append([]string{cs.name}, cs.fallbacks...) {
+		expireCookie(w, &http.Cookie{
+			Name:     name,
+			HttpOnly: cs.httpOnly,
+			Secure:   cs.secure,
+			Path:     cs.path,
+			Domain:   cs.domain,
+			SameSite: http.SameSite(cs.sameSite),
+		}, cs.partitioned)
 	}
 
-	// Set the Expires field on the cookie based on the MaxAge
-	if cs.maxAge > 0 {
+	return nil
+}
+
+// encrypt seals the token with a random nonce, which is prepended to the
+// result. The cookie name is authenticated along with the token.
+func (cs *CookieStore) encrypt(token []byte) ([]byte, error) {
+	nonce, err := generateRandomBytes(cs.aead.NonceSize())
+	if err != nil {
+		return nil, err
+	}
+
+	return cs.aead.Seal(nonce, nonce, token, []byte(cs.name)), nil
+}
+
+// decrypt opens a token sealed by encrypt for the named cookie. It returns
+// ErrBadToken if the token can't be decrypted.
+func (cs *CookieStore) decrypt(sealed []byte, name string) ([]byte, error) {
+	n := cs.aead.NonceSize()
+	if len(sealed) < n {
+		return nil, ErrBadToken
+	}
+
+	token, err := cs.aead.Open(nil, sealed[:n], sealed[n:], []byte(name))
+	if err != nil {
+		return nil, ErrBadToken
+	}
+
+	return token, nil
+}
+
+// setMaxAge sets the MaxAge and Expires fields on the cookie. A maxAge of zero
+// leaves both unset, making it a session cookie, and a negative maxAge expires
+// it immediately.
+func setMaxAge(cookie *http.Cookie, maxAge int) {
+	if maxAge > 0 {
+		cookie.MaxAge = maxAge
 		cookie.Expires = time.Now().Add(
-			time.Duration(cs.maxAge) * time.Second)
-	} else {
+			time.Duration(maxAge) * time.Second)
+	} else if maxAge < 0 {
+		cookie.MaxAge = -1
 		cookie.Expires = time.Unix(1, 0)
 	}
+}
+
+// SessionCookie is the cookie that a server-side TokenStore issues to carry
+// its session ID. It allows stores in other packages, such as redisstore, to
+// be configured with the same cookie options as Protect.
+type SessionCookie struct {
+	Name     string
+	MaxAge   int
+	Secure   bool
+	HttpOnly bool
+	Path     string
+	Domain   string
+	SameSite SameSiteMode
+}
+
+// NewSessionCookie returns the SessionCookie configured by the cookie options
+// - CookieName, MaxAge, Domain, Path, Secure, HttpOnly and SameSite - with the
+// same defaults as Protect. As every session needs a lifetime, a MaxAge of zero
+// or less uses the default of 12 hours. Other options are ignored, but an error
+// is returned if any option returns one.
+func NewSessionCookie(opts ...Option) (SessionCookie, error) {
+	cs, err := parseOptions(nil, opts...)
+	if err != nil {
+		return SessionCookie{}, err
+	}
 
-	// Write the authenticated cookie to the response.
-	http.SetCookie(w, cookie)
+	if cs.opts.MaxAge < 1 {
+		cs.opts.MaxAge = defaultMaxAge
+	}
+
+	if cs.opts.CookieName == "" {
+		cs.opts.CookieName = cookieName
+	}
+
+	return SessionCookie{
+		Name:     cs.opts.CookieName,
+		MaxAge:   cs.opts.MaxAge,
+		Secure:   cs.opts.Secure,
+		HttpOnly: cs.opts.HttpOnly,
+		Path:     cs.opts.Path,
+		Domain:   cs.opts.Domain,
+		SameSite: cs.opts.SameSite,
+	}, nil
+}
+
+// Set writes the session cookie, carrying the session ID, to the response.
+func (c SessionCookie) Set(w http.ResponseWriter, sid string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     c.Name,
+		Value:    sid,
+		MaxAge:   c.MaxAge,
+		HttpOnly: c.HttpOnly,
+		Secure:   c.Secure,
+		Path:     c.Path,
+		Domain:   c.Domain,
+		SameSite: http.SameSite(c.SameSite),
+		Expires:  time.Now().Add(time.Duration(c.MaxAge) * time.Second),
+	})
+}
+
+// Expire writes a cookie to the response that deletes the session cookie.
+func (c SessionCookie) Expire(w http.ResponseWriter) {
+	expireCookie(w, &http.Cookie{
+		Name:     c.Name,
+		HttpOnly: c.HttpOnly,
+		Secure:   c.Secure,
+		Path:     c.Path,
+		Domain:   c.Domain,
+		SameSite: http.SameSite(c.SameSite),
+	}, false)
+}
+
+// storeHttpOnly reports whether the session cookie written by the store is
+// HttpOnly, if that is known: stores report their cookie with a
+// SessionCookie method, as MemoryStore does.
+func storeHttpOnly(st TokenStore) bool {
+	if sc, ok := st.(interface{ SessionCookie() SessionCookie }); ok {
+		return sc.SessionCookie().HttpOnly
+	}
+
+	return true
+}
+
+// errNoSession is returned by the header store when a token can't be saved, as
+// the request has no session header.
+var errNoSession = errors.New(errorPrefix + "session header not found in request")
+
+// headerStore keeps tokens in a KeyedTokenStore under a key derived from the
+// session header sent by the client, such as Authorization - see HeaderOnly.
+// It never writes a cookie.
+type headerStore struct {
+	header string
+	keyed  KeyedTokenStore
+	// secret keys the HMAC of the header value, so that the store's keys
+	// don't reveal it.
+	secret []byte
+}
+
+// key returns the store key for the request's session header.
+func (hs *headerStore) key(r *http.Request) (string, error) {
+	v := r.Header.Get(hs.header)
+	if v == "" {
+		return "", errNoSession
+	}
+
+	mac := hmac.New(sha256.New, hs.secret)
+	mac.Write([]byte(v))
+
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// Get retrieves the CSRF token saved for the request's session header. It
+// returns ErrNoToken if the request has no session header, or no token has
+// been saved for it.
+func (hs *headerStore) Get(r *http.Request) ([]byte, error) {
+	key, err := hs.key(r)
+	if err != nil {
+		return nil, ErrNoToken
+	}
+
+	return hs.keyed.GetKey(key)
+}
+
+// Save always fails, as the key depends on the request: see saveRequest.
+func (hs *headerStore) Save(token []byte, w http.ResponseWriter) error {
+	return errNoSession
+}
+
+// saveRequest saves the CSRF token for the request's session header.
+func (hs *headerStore) saveRequest(token []byte, w http.ResponseWriter, r *http.Request) error {
+	key, err := hs.key(r)
+	if err != nil {
+		return err
+	}
+
+	return hs.keyed.SaveKey(key, token)
+}
+
+// Clear deletes the CSRF token saved for the request's session header.
+func (hs *headerStore) Clear(w http.ResponseWriter, r *http.Request) error {
+	key, err := hs.key(r)
+	if err != nil {
+		return nil
+	}
+
+	return hs.keyed.DeleteKey(key)
+}
+
+// requestCookie returns the named cookie from the request or, if it's absent,
+// the first of the fallbacks that is present.
+func requestCookie(r *http.Request, name string, fallbacks []string) (*http.Cookie, error) {
+	cookie, err := r.Cookie(name)
+	for i := 0; err == http.ErrNoCookie && i < len(fallbacks); i++ {
+		cookie, err = r.Cookie(fallbacks[i])
+	}
+
+	return cookie, err
+}
+
+// expireCookie writes the cookie with an empty value and a negative MaxAge, so
+// that the browser deletes it. A partitioned cookie is only deleted by a cookie
+// that is also partitioned.
+func expireCookie(w http.ResponseWriter, cookie *http.Cookie, partitioned bool) {
+	cookie.Value = ""
+	setMaxAge(cookie, -1)
+
+	v := cookie.String()
+	if partitioned {
+		v += "; Partitioned"
+	}
+
+	w.Header().Add("Set-Cookie", v)
+}
+
+// doubleSubmitStore is the store used in DoubleSubmit mode. The cookie holds
+// the token followed by an HMAC of it, and is readable by JavaScript so that
+// clients can submit its value back.
+type doubleSubmitStore struct {
+	name        string
+	maxAge      int
+	secure      bool
+	path        string
+	domain      string
+	sameSite    SameSiteMode
+	partitioned bool
+	key         []byte
+	encoding    *base64.Encoding
+	fallbacks   []string
+}
+
+// value returns the token followed by its HMAC. The cookie holds this value,
+// base64 encoded, and requests must submit the same.
+func (ds *doubleSubmitStore) value(token []byte) []byte {
+	mac := hmac.New(sha256.New, ds.key)
+	mac.Write(token)
+
+	return mac.Sum(append([]byte(nil), token...))
+}
+
+// Get retrieves the token from the cookie. It returns an error if the cookie
+// doesn't exist, or its HMAC doesn't match - e.g. because it has been forged.
+func (ds *doubleSubmitStore) Get(r *http.Request) ([]byte, error) {
+	cookie, err := requestCookie(r, ds.name, ds.fallbacks)
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := ds.encoding.DecodeString(cookie.Value)
+	if err != nil || len(v) <= sha256.Size {
+		return nil, ErrBadToken
+	}
+
+	token := v[:len(v)-sha256.Size]
+	if !hmac.Equal(v, ds.value(token)) {
+		return nil, ErrBadToken
+	}
+
+	return token, nil
+}
+
+// Save writes the token and its HMAC to the cookie.
+func (ds *doubleSubmitStore) Save(token []byte, w http.ResponseWriter) error {
+	cookie := &http.Cookie{
+		Name:     ds.name,
+		Value:    ds.encoding.EncodeToString(ds.value(token)),
+		HttpOnly: false,
+		Secure:   ds.secure,
+		Path:     ds.path,
+		Domain:   ds.domain,
+		SameSite: http.SameSite(ds.sameSite),
+	}
+
+	setMaxAge(cookie, ds.maxAge)
+
+	v := cookie.String()
+	if ds.partitioned {
+		v += "; Partitioned"
+	}
+
+	w.Header().Add("Set-Cookie", v)
+
+	return nil
+}
+
+// Clear expires the cookie, and any fallback cookies.
+func (ds *doubleSubmitStore) Clear(w http.ResponseWriter, r *http.Request) error {
+	for _, name := range append([]string{ds.name}, ds.fallbacks...) {
+		expireCookie(w, &http.Cookie{
+			Name:     name,
+			Secure:   ds.secure,
+			Path:     ds.path,
+			Domain:   ds.domain,
+			SameSite: http.SameSite(ds.sameSite),
+		}, ds.partitioned)
+	}
 
 	return nil
 }
@@ -1,25 +1,36 @@
 package csrf
 
 import (
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"goji.io"
 
 	"goji.io/pat"
 
 	"github.com/gorilla/securecookie"
+	"golang.org/x/net/context"
 )
 
 // Check Store implementations
-var _ store = &cookieStore{}
+var _ TokenStore = &CookieStore{}
+var _ TokenClearer = &CookieStore{}
+var _ TokenClearer = &doubleSubmitStore{}
+
+// errTestSave is returned by brokenSaveStore.
+var errTestSave = errors.New("test error")
 
 // brokenSaveStore is a CSRF store that cannot, well, save.
 type brokenSaveStore struct {
-	store
+	TokenStore
 }
 
 func (bs *brokenSaveStore) Get(*http.Request) ([]byte, error) {
@@ -28,14 +39,45 @@ func (bs *brokenSaveStore) Get(*http.Request) ([]byte, error) {
 }
 
 func (bs *brokenSaveStore) Save(realToken []byte, w http.ResponseWriter) error {
-	return errors.New("test error")
+	return errTestSave
+}
+
+// errTestClear is returned by brokenClearStore.
+var errTestClear = errors.New("test clear error")
+
+// brokenClearStore is a CSRF store that cannot delete its tokens.
+type brokenClearStore struct {
+	TokenStore
+}
+
+func (bs *brokenClearStore) Clear(http.ResponseWriter, *http.Request) error {
+	return errTestClear
+}
+
+// singleTokenStore is a CSRF store that holds a single token, regardless of
+// the request, so tests can inspect and modify the stored value.
+type singleTokenStore struct {
+	token []byte
+}
+
+func (ss *singleTokenStore) Get(*http.Request) ([]byte, error) {
+	if ss.token == nil {
+		return nil, errors.New("no token")
+	}
+
+	return ss.token, nil
+}
+
+func (ss *singleTokenStore) Save(token []byte, w http.ResponseWriter) error {
+	ss.token = token
+	return nil
 }
 
 // Tests for failure if the middleware can't save to the Store.
 func TestStoreCannotSave(t *testing.T) {
 	m := goji.NewMux()
 	bs := &brokenSaveStore{}
-	m.UseC(Protect(testKey, setStore(bs)))
+	m.UseC(Protect(testKey, Store(bs), StoreFailurePolicy(FailClosed)))
 	m.HandleFuncC(pat.Get("/"), testHandler)
 
 	r, err := http.NewRequest("GET", "/", nil)
@@ -46,9 +88,9 @@ func TestStoreCannotSave(t *testing.T) {
 	rr := httptest.NewRecorder()
 	m.ServeHTTP(rr, r)
 
-	if rr.Code != http.StatusForbidden {
+	if rr.Code != http.StatusInternalServerError {
 		t.Fatalf("broken store did not set an error status: got %v want %v",
-			rr.Code, http.StatusForbidden)
+			rr.Code, http.StatusInternalServerError)
 	}
 
 	if c := rr.Header().Get("Set-Cookie"); c != "" {
@@ -58,6 +100,109 @@ func TestStoreCannotSave(t *testing.T) {
 
 }
 
+// Tests that store failures are reported to the error handler, wrapping the
+// store's error, and aren't revealed to clients.
+func TestStoreFailure(t *testing.T) {
+	var reason error
+	bs := &brokenSaveStore{}
+	h := Protect(testKey, Store(bs), StoreFailurePolicy(FailClosed), ErrorHandlerFunc(func(w http.ResponseWriter, r *http.Request, err error) {
+		reason = err
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))(testHandler)
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTPC(context.Background(), rr, r)
+
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("error handler not called: got %v want %v", rr.Code, http.StatusServiceUnavailable)
+	}
+
+	if !errors.Is(reason, ErrStoreFailure) || !errors.Is(reason, errTestSave) ||
+		!strings.Contains(reason.Error(), "test error") {
+		t.Fatalf("store error not wrapped: got %v", reason)
+	}
+
+	// The default handler serves a 500, even with a FailureStatus, without
+	// the store's error.
+	for _, opts := range [][]Option{nil, {FailureStatus(http.StatusBadRequest)}} {
+		rr := httptest.NewRecorder()
+		Protect(testKey, append(opts, Store(bs), StoreFailurePolicy(FailClosed))...)(testHandler).ServeHTTPC(context.Background(), rr, r)
+
+		if rr.Code != http.StatusInternalServerError {
+			t.Errorf("%d options: got %v want %v", len(opts), rr.Code, http.StatusInternalServerError)
+		}
+
+		if strings.Contains(rr.Body.String(), "test error") {
+			t.Errorf("%d options: store error revealed: %q", len(opts), rr.Body.String())
+		}
+	}
+
+	// Helpers that save a token return the error too.
+	ctx := context.Background()
+	h = Protect(testKey, Store(bs))(goji.HandlerFunc(func(c context.Context, w http.ResponseWriter, r *http.Request) {
+		ctx = c
+	}))
+	h.ServeHTTPC(UnsafeSkipCheck(context.Background()), httptest.NewRecorder(), r)
+
+	if _, err := Regenerate(ctx, httptest.NewRecorder(), r); !errors.Is(err, ErrStoreFailure) {
+		t.Fatalf("Regenerate: got %v want %v", err, ErrStoreFailure)
+	}
+}
+
+// TestStoreFailurePolicy tests that requests fail open or closed when the
+// store can't save a token, as per the policy.
+func TestStoreFailurePolicy(t *testing.T) {
+	var policyTests = []struct {
+		name     string
+		method   string
+		opts     []Option
+		expected int
+	}{
+		{"default safe", "GET", nil, http.StatusOK},
+		{"default unsafe", "POST", nil, http.StatusInternalServerError},
+		{"fail open safe", "GET", []Option{StoreFailurePolicy(FailOpen)}, http.StatusOK},
+		// The request continues, but fails validation without a token.
+		{"fail open unsafe", "POST", []Option{StoreFailurePolicy(FailOpen)}, http.StatusForbidden},
+		{"fail closed safe", "GET", []Option{StoreFailurePolicy(FailClosed)}, http.StatusInternalServerError},
+		{"fail closed unsafe", "POST", []Option{StoreFailurePolicy(FailClosed)}, http.StatusInternalServerError},
+	}
+
+	for _, v := range policyTests {
+		var token string
+		called := false
+		s := Protect(testKey, append(v.opts, Store(&brokenSaveStore{}))...)(goji.HandlerFunc(
+			func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+				called = true
+				token = Token(ctx, r)
+			}))
+
+		r, err := http.NewRequest(v.method, "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		s.ServeHTTPC(context.Background(), rr, r)
+
+		if rr.Code != v.expected {
+			t.Errorf("%s: got %v want %v", v.name, rr.Code, v.expected)
+		}
+
+		if called != (v.expected == http.StatusOK) || token != "" {
+			t.Errorf("%s: handler called %v with token %q", v.name, called, token)
+		}
+
+		if c := rr.Header().Get("Set-Cookie"); c != "" {
+			t.Errorf("%s: cookie set by a broken store: %q", v.name, c)
+		}
+	}
+}
+
 // TestCookieDecode tests that an invalid cookie store returns a decoding error.
 func TestCookieDecode(t *testing.T) {
 	r, err := http.NewRequest("GET", "/", nil)
@@ -70,7 +215,7 @@ func TestCookieDecode(t *testing.T) {
 	// Test with a nil hash key
 	sc := securecookie.New(nil, nil)
 	sc.MaxAge(age)
-	st := &cookieStore{cookieName, age, true, true, "", "", sc}
+	st := &CookieStore{name: cookieName, maxAge: age, secure: true, httpOnly: true, codec: secureCookieCodec{sc}}
 
 	// Set a fake cookie value so r.Cookie passes.
 	r.Header.Set("Cookie", fmt.Sprintf("%s=%s", cookieName, "notacookie"))
@@ -88,7 +233,7 @@ func TestCookieEncode(t *testing.T) {
 	// Test with a nil hash key
 	sc := securecookie.New(nil, nil)
 	sc.MaxAge(age)
-	st := &cookieStore{cookieName, age, true, true, "", "", sc}
+	st := &CookieStore{name: cookieName, maxAge: age, secure: true, httpOnly: true, codec: secureCookieCodec{sc}}
 
 	rr := httptest.NewRecorder()
 
@@ -97,3 +242,801 @@ func TestCookieEncode(t *testing.T) {
 		t.Fatal("cookiestore did not report an invalid hashkey on encode")
 	}
 }
+
+// TestCookieFormatVersion tests that the cookie store round-trips tokens in the
+// current format, and rejects values with an unknown or missing version.
+func TestCookieFormatVersion(t *testing.T) {
+	codec := secureCookieCodec{newSecureCookie(testKey, 3600)}
+	st := &CookieStore{name: cookieName, maxAge: 3600, codec: codec}
+
+	token, err := generateRandomBytes(tokenLength)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	if err := st.Save(token, rr); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setCookie(rr, r)
+
+	got, err := st.Get(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !compareTokens(got, token) {
+		t.Fatalf("tokens do not match: got %x want %x", got, token)
+	}
+
+	for name, value := range map[string][]byte{
+		"unknown version": append([]byte{CookieFormatVersion + 1}, token...),
+		"empty":           {},
+	} {
+		encoded, err := codec.Encode(cookieName, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r.Header.Set("Cookie", cookieName+"="+encoded)
+		if _, err := st.Get(r); err != ErrBadToken {
+			t.Errorf("%s: got %v want %v", name, err, ErrBadToken)
+		}
+	}
+}
+
+// TestCookieSameSite tests that the SameSite attribute is set on the cookie.
+func TestCookieSameSite(t *testing.T) {
+	m := goji.NewMux()
+	m.UseC(Protect(testKey, SameSite(SameSiteStrictMode)))
+	m.HandleFuncC(pat.Get("/"), testHandler)
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	m.ServeHTTP(rr, r)
+
+	if c := rr.Header().Get("Set-Cookie"); !strings.Contains(c, "SameSite=Strict") {
+		t.Fatalf("cookie does not have SameSite=Strict: got %q", c)
+	}
+}
+
+// TestCookieMaxAge tests the Max-Age and Expires attributes of the cookie for
+// positive, zero (session) and negative MaxAge values.
+func TestCookieMaxAge(t *testing.T) {
+	var maxAgeTests = []struct {
+		age     int
+		maxAge  string
+		expires bool
+	}{
+		{3600, "Max-Age=3600", true},
+		{0, "", false},
+		{-1, "Max-Age=0", true},
+	}
+
+	for _, v := range maxAgeTests {
+		r, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The JavaScript-readable cookie must share the session cookie's lifetime.
+		rr := httptest.NewRecorder()
+		Protect(testKey, MaxAge(v.age), AngularCompat())(testHandler).ServeHTTPC(context.Background(), rr, r)
+
+		cookies := rr.Header()["Set-Cookie"]
+		if len(cookies) != 2 {
+			t.Fatalf("MaxAge(%d): cookies not set: got %q", v.age, cookies)
+		}
+
+		for _, c := range cookies {
+			if v.maxAge == "" && strings.Contains(c, "Max-Age") {
+				t.Errorf("MaxAge(%d): session cookie has a Max-Age: got %q", v.age, c)
+			} else if v.maxAge != "" && !strings.Contains(c, v.maxAge) {
+				t.Errorf("MaxAge(%d): cookie does not have %s: got %q", v.age, v.maxAge, c)
+			}
+
+			if strings.Contains(c, "Expires") != v.expires {
+				t.Errorf("MaxAge(%d): Expires attribute mismatch: got %q", v.age, c)
+			}
+		}
+	}
+
+	// Session cookies must still validate.
+	var token string
+	s := Protect(testKey, MaxAge(0))(goji.HandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		token = Token(ctx, r)
+	}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTPC(context.Background(), rr, r)
+
+	r, err = http.NewRequest("POST", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setCookie(rr, r)
+	r.Header.Set("X-CSRF-Token", token)
+
+	rr = httptest.NewRecorder()
+	s.ServeHTTPC(context.Background(), rr, r)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("session cookie token failed validation: got %v want %v", rr.Code, http.StatusOK)
+	}
+}
+
+// TestCookieMaxAgeDuration tests that MaxAgeDuration sets the cookie Max-Age in
+// whole seconds, and rejects negative durations.
+func TestCookieMaxAgeDuration(t *testing.T) {
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	Protect(testKey, MaxAgeDuration(2*time.Hour+1500*time.Millisecond))(testHandler).ServeHTTPC(context.Background(), rr, r)
+
+	cookies := readSetCookies(rr)
+	if len(cookies) != 1 || cookies[0].MaxAge != 7201 {
+		t.Fatalf("MaxAgeDuration not applied: got %q want Max-Age=7201", rr.Header()["Set-Cookie"])
+	}
+
+	if err := MaxAgeDuration(-time.Second)(&csrf{}); err == nil {
+		t.Fatal("MaxAgeDuration accepted a negative duration")
+	}
+}
+
+// TestSlidingExpiry tests that the session cookie is re-issued with a fresh
+// Max-Age on each request, and that the token remains valid.
+func TestSlidingExpiry(t *testing.T) {
+	for _, sliding := range []bool{true, false} {
+		var token string
+		s := Protect(testKey, MaxAge(3600), SlidingExpiry(sliding))(goji.HandlerFunc(
+			func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+				token = Token(ctx, r)
+			}))
+
+		r, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		s.ServeHTTPC(context.Background(), rr, r)
+		first := readSetCookies(rr)
+
+		for _, method := range []string{"GET", "POST"} {
+			r, err := http.NewRequest(method, "/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			setCookie(rr, r)
+			r.Header.Set("X-CSRF-Token", token)
+
+			rr2 := httptest.NewRecorder()
+			s.ServeHTTPC(context.Background(), rr2, r)
+
+			if rr2.Code != http.StatusOK {
+				t.Fatalf("SlidingExpiry(%v) %s: got %v want %v", sliding, method, rr2.Code, http.StatusOK)
+			}
+
+			refreshed := readSetCookies(rr2)
+			if !sliding {
+				if len(refreshed) != 0 {
+					t.Errorf("SlidingExpiry(false) %s: cookie re-issued: %q", method, rr2.Header()["Set-Cookie"])
+				}
+				continue
+			}
+
+			if len(refreshed) != 1 || refreshed[0].MaxAge != 3600 || refreshed[0].Expires.Before(first[0].Expires) {
+				t.Errorf("SlidingExpiry(true) %s: Max-Age not refreshed: got %q", method, rr2.Header()["Set-Cookie"])
+			}
+		}
+	}
+}
+
+// TestCookieTooLarge tests that the cookie store refuses to issue a cookie
+// that browsers would drop.
+func TestCookieTooLarge(t *testing.T) {
+	var reason error
+	s := Protect(testKey, TokenLength(3072), ErrorHandlerFunc(func(w http.ResponseWriter, r *http.Request, err error) {
+		reason = err
+		http.Error(w, "", http.StatusInternalServerError)
+	}))(testHandler)
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTPC(context.Background(), rr, r)
+
+	if !errors.Is(reason, ErrCookieTooLarge) {
+		t.Fatalf("oversized cookie not refused: got %v want %v", reason, ErrCookieTooLarge)
+	}
+
+	if c := rr.Header().Get("Set-Cookie"); c != "" {
+		t.Fatalf("oversized cookie was set: got %d bytes", len(c))
+	}
+}
+
+// TestCookiePartitioned tests that a partitioned cookie is issued with both the
+// Partitioned and Secure attributes.
+func TestCookiePartitioned(t *testing.T) {
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	Protect(testKey, Partitioned(true), SameSite(SameSiteNoneMode))(testHandler).ServeHTTPC(context.Background(), rr, r)
+
+	c := rr.Header().Get("Set-Cookie")
+	if !strings.Contains(c, "; Partitioned") || !strings.Contains(c, "; Secure") {
+		t.Fatalf("cookie is not partitioned and secure: got %q", c)
+	}
+
+	rr = httptest.NewRecorder()
+	Protect(testKey)(testHandler).ServeHTTPC(context.Background(), rr, r)
+
+	if c := rr.Header().Get("Set-Cookie"); strings.Contains(c, "Partitioned") {
+		t.Fatalf("cookie partitioned by default: got %q", c)
+	}
+}
+
+// TestHttpOnlyServerStoreWarning tests that a warning is logged when HttpOnly
+// is disabled with a server-side store, and not otherwise.
+func TestHttpOnlyServerStoreWarning(t *testing.T) {
+	ms := NewMemoryStore()
+	defer ms.Close()
+
+	readable := NewMemoryStore(HttpOnly(false))
+	defer readable.Close()
+
+	var warningTests = []struct {
+		name string
+		opts []Option
+		warn bool
+	}{
+		{"server store", []Option{Store(ms), HttpOnly(false)}, true},
+		{"readable server store", []Option{Store(readable)}, true},
+		{"HttpOnly server store", []Option{Store(ms)}, false},
+		{"cookie store", []Option{HttpOnly(false)}, false},
+		{"double submit", []Option{DoubleSubmit(), HttpOnly(false)}, false},
+	}
+
+	for _, v := range warningTests {
+		var warnings []string
+		logger := Logger(LoggerFunc(func(format string, args ...interface{}) {
+			warnings = append(warnings, fmt.Sprintf(format, args...))
+		}))
+
+		Protect(testKey, append(v.opts, logger)...)(testHandler)
+
+		if v.warn != (len(warnings) == 1 && strings.Contains(warnings[0], "HttpOnly")) {
+			t.Errorf("%s: got warnings %q, want warning %v", v.name, warnings, v.warn)
+		}
+	}
+}
+
+// TestDefaultStore tests that the cookie store is used when no Store option is
+// supplied.
+func TestDefaultStore(t *testing.T) {
+	cs := Protect(testKey)(testHandler).(*csrf)
+	if _, ok := cs.st.(*CookieStore); !ok {
+		t.Fatalf("default store is not a cookie store: got %T", cs.st)
+	}
+
+	bs := &brokenSaveStore{}
+	cs = Protect(testKey, Store(bs))(testHandler).(*csrf)
+	if cs.st != bs {
+		t.Fatalf("Store option not applied: got %T want %T", cs.st, bs)
+	}
+}
+
+// countingStore wraps a CookieStore, counting the tokens it saves.
+type countingStore struct {
+	*CookieStore
+	saves int
+}
+
+func (cs *countingStore) Save(token []byte, w http.ResponseWriter) error {
+	cs.saves++
+	return cs.CookieStore.Save(token, w)
+}
+
+// TestNewCookieStore tests that an explicitly created (and wrapped) CookieStore
+// behaves as the default store does.
+func TestNewCookieStore(t *testing.T) {
+	opts := []Option{CookieName("_csrf"), MaxAge(3600), SameSite(SameSiteStrictMode),
+		ResponseHeader("X-CSRF-Token")}
+	st := &countingStore{CookieStore: NewCookieStore(testKey, opts...)}
+
+	explicit := Protect(testKey, append(opts, Store(st))...)(testHandler)
+	implicit := Protect(testKey, opts...)(testHandler)
+
+	get := func(s goji.Handler) *httptest.ResponseRecorder {
+		r, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		s.ServeHTTPC(context.Background(), rr, r)
+		return rr
+	}
+
+	issued, want := get(explicit), get(implicit)
+	if st.saves != 1 {
+		t.Fatalf("wrapped store not used: got %d saves want 1", st.saves)
+	}
+
+	got, exp := readSetCookies(issued), readSetCookies(want)
+	if len(got) != 1 || len(exp) != 1 {
+		t.Fatalf("unexpected cookies: got %q want %q", issued.Header()["Set-Cookie"], want.Header()["Set-Cookie"])
+	}
+
+	got[0].Value, exp[0].Value = "", ""
+	got[0].Raw, exp[0].Raw = "", ""
+	got[0].Expires, exp[0].Expires = time.Time{}, time.Time{}
+	if !reflect.DeepEqual(got[0], exp[0]) {
+		t.Errorf("cookie attributes differ from the default store: got %+v want %+v", got[0], exp[0])
+	}
+
+	// Cookies issued by either store are accepted by the other.
+	for _, v := range []struct {
+		name   string
+		issued *httptest.ResponseRecorder
+		s      goji.Handler
+	}{
+		{"explicit to implicit", issued, implicit},
+		{"implicit to explicit", want, explicit},
+	} {
+		r, err := http.NewRequest("POST", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		setCookie(v.issued, r)
+		r.Header.Set("X-CSRF-Token", v.issued.Header().Get("X-CSRF-Token"))
+
+		rr := httptest.NewRecorder()
+		v.s.ServeHTTPC(context.Background(), rr, r)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("%s: got %v want %v", v.name, rr.Code, http.StatusOK)
+		}
+	}
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("NewCookieStore accepted DoubleSubmit")
+		}
+	}()
+	NewCookieStore(testKey, DoubleSubmit())
+}
+
+// TestVerificationKeys tests that cookies issued under a previous key are
+// still accepted after the primary key is rotated.
+func TestVerificationKeys(t *testing.T) {
+	oldKey := testKey
+	newKey := []byte("a-completely-new-32-byte-authkey")
+
+	var token string
+	tokenHandler := goji.HandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		token = Token(ctx, r)
+	})
+
+	// Issue a cookie and token under the old key.
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	Protect(oldKey)(tokenHandler).ServeHTTPC(context.Background(), rr, r)
+
+	var rotationTests = []struct {
+		opts     []Option
+		expected int
+	}{
+		{[]Option{VerificationKeys(oldKey)}, http.StatusOK},
+		{nil, http.StatusForbidden},
+	}
+
+	for _, v := range rotationTests {
+		r, err := http.NewRequest("POST", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		setCookie(rr, r)
+		r.Header.Set("X-CSRF-Token", token)
+
+		rr2 := httptest.NewRecorder()
+		Protect(newKey, v.opts...)(testHandler).ServeHTTPC(context.Background(), rr2, r)
+
+		if rr2.Code != v.expected {
+			t.Errorf("rotated key check failed: got %v want %v", rr2.Code, v.expected)
+		}
+	}
+}
+
+// TestCookieEncryption tests that EncryptCookie encrypts the token within the
+// cookie, and that a corrupted ciphertext is rejected.
+func TestCookieEncryption(t *testing.T) {
+	if _, err := newCSRF(testKey, EncryptCookie([]byte("short"))); err == nil {
+		t.Fatal("invalid encryption key was accepted")
+	}
+
+	cs, err := newCSRF(testKey, EncryptCookie([]byte("an-aes-256-key-of-32-bytes-long!")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := generateRandomBytes(tokenLength)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	if err := cs.st.Save(token, rr); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setCookie(rr, r)
+
+	got, err := cs.st.Get(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !compareTokens(got, token) {
+		t.Fatalf("tokens do not match: got %x want %x", got, token)
+	}
+
+	// The signed value should be the ciphertext, not the token.
+	cookie, err := r.Cookie(cookieName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sealed []byte
+	if err := cs.sc.Decode(cookieName, cookie.Value, &sealed); err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(sealed), string(token)) {
+		t.Fatal("cookie contains the unencrypted token")
+	}
+
+	// Corrupt the ciphertext, and sign it again so that only decryption fails.
+	sealed[len(sealed)-1] ^= 0xff
+	encoded, err := cs.sc.Encode(cookieName, sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.Header.Set("Cookie", fmt.Sprintf("%s=%s", cookieName, encoded))
+	if _, err := cs.st.Get(r); err != ErrBadToken {
+		t.Fatalf("corrupted ciphertext not rejected: got %v want %v", err, ErrBadToken)
+	}
+}
+
+// prefixCodec is a CookieCodec that prefixes the hex-encoded value.
+type prefixCodec struct {
+	prefix string
+}
+
+func (pc prefixCodec) Encode(name string, value []byte) (string, error) {
+	return pc.prefix + hex.EncodeToString(value), nil
+}
+
+func (pc prefixCodec) Decode(name, encoded string) ([]byte, error) {
+	if !strings.HasPrefix(encoded, pc.prefix) {
+		return nil, errors.New("missing prefix")
+	}
+
+	return hex.DecodeString(strings.TrimPrefix(encoded, pc.prefix))
+}
+
+// TestCookieCodec tests that the cookie store uses a custom codec.
+func TestCookieCodec(t *testing.T) {
+	var token string
+	s := Protect(testKey, Codec(prefixCodec{"v1."}))(goji.HandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		token = Token(ctx, r)
+	}))
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTPC(context.Background(), rr, r)
+
+	cookies := readSetCookies(rr)
+	if len(cookies) != 1 || !strings.HasPrefix(cookies[0].Value, "v1.") {
+		t.Fatalf("cookie not encoded by the codec: got %v", rr.Header()["Set-Cookie"])
+	}
+
+	var codecTests = []struct {
+		value    string
+		expected int
+	}{
+		{cookies[0].Value, http.StatusOK},
+		{"v2." + strings.TrimPrefix(cookies[0].Value, "v1."), http.StatusForbidden},
+	}
+
+	for _, v := range codecTests {
+		r, err := http.NewRequest("POST", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r.AddCookie(&http.Cookie{Name: cookieName, Value: v.value})
+		r.Header.Set("X-CSRF-Token", token)
+
+		rr2 := httptest.NewRecorder()
+		s.ServeHTTPC(context.Background(), rr2, r)
+
+		if rr2.Code != v.expected {
+			t.Errorf("cookie %q: got %v want %v", v.value, rr2.Code, v.expected)
+		}
+	}
+}
+
+// TestForgedCookie tests that a session cookie that wasn't issued by the
+// server - e.g. one injected by an attacker controlling a subdomain, along with
+// a matching token - is rejected.
+func TestForgedCookie(t *testing.T) {
+	cs, err := newCSRF(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	realToken, err := generateRandomBytes(tokenLength)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var forgeryTests = []struct {
+		name  string
+		value string
+	}{
+		{"unsigned", base64.StdEncoding.EncodeToString(realToken)},
+		{"wrong key", func() string {
+			sc := newSecureCookie([]byte("an-attackers-own-32-byte-authkey"), defaultMaxAge)
+			v, err := sc.Encode(cookieName, realToken)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return v
+		}()},
+	}
+
+	for _, v := range forgeryTests {
+		var reason error
+		s := Protect(testKey, ErrorHandlerFunc(func(w http.ResponseWriter, r *http.Request, err error) {
+			reason = err
+			w.WriteHeader(http.StatusForbidden)
+		}))(testHandler)
+
+		r, err := http.NewRequest("POST", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r.AddCookie(&http.Cookie{Name: cookieName, Value: v.value})
+		r.Header.Set("X-CSRF-Token", cs.issueToken(realToken, r))
+
+		rr := httptest.NewRecorder()
+		s.ServeHTTPC(context.Background(), rr, r)
+
+		if rr.Code != http.StatusForbidden || reason != ErrBadToken {
+			t.Errorf("%s cookie not rejected: got %v (%v) want %v (%v)",
+				v.name, rr.Code, reason, http.StatusForbidden, ErrBadToken)
+		}
+	}
+}
+
+// TestCookiePresets tests the cookie attributes set by each preset.
+func TestCookiePresets(t *testing.T) {
+	var presetTests = []struct {
+		name     string
+		opts     []Option
+		sameSite http.SameSite
+	}{
+		{"strict", PresetStrict(), http.SameSiteStrictMode},
+		{"relaxed", PresetRelaxed(), http.SameSiteLaxMode},
+	}
+
+	for _, v := range presetTests {
+		r, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		Protect(testKey, v.opts...)(testHandler).ServeHTTPC(context.Background(), rr, r)
+
+		cookies := readSetCookies(rr)
+		if len(cookies) != 1 {
+			t.Fatalf("%s: got %d cookies want 1", v.name, len(cookies))
+		}
+
+		c := cookies[0]
+		if c.SameSite != v.sameSite || !c.Secure || !c.HttpOnly {
+			t.Errorf("%s: got SameSite %v, Secure %v, HttpOnly %v want %v, true, true",
+				v.name, c.SameSite, c.Secure, c.HttpOnly, v.sameSite)
+		}
+	}
+
+	// Options following a preset override it.
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	opts := append(PresetStrict(), SameSite(SameSiteLaxMode))
+	Protect(testKey, opts...)(testHandler).ServeHTTPC(context.Background(), rr, r)
+
+	if c := readSetCookies(rr); len(c) != 1 || c[0].SameSite != http.SameSiteLaxMode {
+		t.Errorf("preset not overridden: got %v", rr.Header()["Set-Cookie"])
+	}
+}
+
+// TestCookieFirstIssuance tests that each store only writes its cookie, with
+// all of its attributes, when a token is minted - and not on later requests
+// with a valid cookie.
+func TestCookieFirstIssuance(t *testing.T) {
+	attrs := []Option{Domain("example.com"), Path("/app"), SameSite(SameSiteLaxMode)}
+
+	ms := NewMemoryStore(attrs...)
+	defer ms.Close()
+
+	var issuanceTests = []struct {
+		name string
+		opts []Option
+	}{
+		{"cookie", nil},
+		{"double submit", []Option{DoubleSubmit()}},
+		{"memory", []Option{Store(ms)}},
+		{"angular", []Option{AngularCompat(), NoReissueIfPresent(true)}},
+	}
+
+	for _, v := range issuanceTests {
+		s := Protect(testKey, append(attrs, v.opts...)...)(testHandler)
+
+		r, err := http.NewRequest("GET", "http://example.com/app", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		s.ServeHTTPC(context.Background(), rr, r)
+
+		minted := readSetCookies(rr)
+		if len(minted) == 0 {
+			t.Fatalf("%s: no cookie set when minting", v.name)
+		}
+
+		for _, c := range minted {
+			if c.Domain != "example.com" || c.Path != "/app" || c.SameSite != http.SameSiteLaxMode {
+				t.Errorf("%s: attributes not set on %s: %q", v.name, c.Name, c.Raw)
+			}
+		}
+
+		r, err = http.NewRequest("GET", "http://example.com/app", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, c := range minted {
+			r.AddCookie(c)
+		}
+
+		rr = httptest.NewRecorder()
+		s.ServeHTTPC(context.Background(), rr, r)
+
+		if c := rr.Header()["Set-Cookie"]; len(c) != 0 {
+			t.Errorf("%s: cookie rewritten for a valid cookie: %q", v.name, c)
+		}
+	}
+}
+
+// TestFallbackCookieNames tests that a cookie issued under a previous name
+// still validates, and that the current name is written.
+func TestFallbackCookieNames(t *testing.T) {
+	old := Protect(testKey, CookieName("_csrf"))(testHandler)
+
+	r, err := http.NewRequest("GET", "http://www.gorillatoolkit.org/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	var token string
+	old.ServeHTTPC(context.Background(), rr, r)
+
+	for _, v := range []struct {
+		name  string
+		opts  []Option
+		valid bool
+	}{
+		{"fallback", []Option{HostPrefix(), FallbackCookieNames("_csrf")}, true},
+		{"no fallback", []Option{HostPrefix()}, false},
+	} {
+		s := Protect(testKey, v.opts...)(goji.HandlerFunc(
+			func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+				token = Token(ctx, r)
+			}))
+
+		r, err := http.NewRequest("GET", "http://www.gorillatoolkit.org/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		setCookie(rr, r)
+
+		getRR := httptest.NewRecorder()
+		s.ServeHTTPC(context.Background(), getRR, r)
+
+		r, err = http.NewRequest("POST", "http://www.gorillatoolkit.org/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		setCookie(rr, r)
+		r.Header.Set("X-CSRF-Token", token)
+		r.Header.Set("Referer", "https://www.gorillatoolkit.org/")
+
+		postRR := httptest.NewRecorder()
+		s.ServeHTTPC(context.Background(), postRR, r)
+
+		if (postRR.Code == http.StatusOK) != v.valid {
+			t.Errorf("%s: got status %v, want valid %v", v.name, postRR.Code, v.valid)
+		}
+
+		// Only the current name should be written.
+		for _, c := range readSetCookies(getRR) {
+			if c.Name != hostPrefix+cookieName {
+				t.Errorf("%s: cookie written under %q", v.name, c.Name)
+			}
+		}
+	}
+
+	s := Protect(testKey, HostPrefix(), FallbackCookieNames("_csrf"))(testHandler)
+	rr = httptest.NewRecorder()
+	if err := s.(*csrf).st.(TokenClearer).Clear(rr, r); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(readSetCookies(rr)); n != 2 {
+		t.Errorf("Clear did not expire the fallback cookie: got %d cookies want 2", n)
+	}
+
+	if err := FallbackCookieNames("bad name")(&csrf{}); err == nil {
+		t.Error("FallbackCookieNames accepted an invalid cookie name")
+	}
+}
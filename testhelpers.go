@@ -0,0 +1,80 @@
+package csrf
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/context"
+
+	"goji.io"
+)
+
+// NewTestRequest returns a request for use in tests of handlers protected by
+// this package. The request carries a session cookie and a matching token in
+// the request header, and passes validation by middleware created with the
+// same authKey and options.
+//
+// The token is issued by running a GET request for the target through the
+// middleware, exactly as a browser would obtain one, so no checks are
+// bypassed. For HTTPS targets the Referer header is also set to the target.
+//
+// Example:
+//
+//	r, err := csrf.NewTestRequest(key, "POST", "https://example.com/signup", body)
+//	if err != nil {
+//	    t.Fatal(err)
+//	}
+//	rr := httptest.NewRecorder()
+//	router.ServeHTTP(rr, r)
+func NewTestRequest(authKey []byte, method, target string, body io.Reader, opts ...Option) (*http.Request, error) {
+	var token string
+	cs := Protect(authKey, opts...)(goji.HandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		token = Token(ctx, r)
+	})).(*csrf)
+
+	issue, err := http.NewRequest("GET", target, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &headerRecorder{header: make(http.Header)}
+	cs.ServeHTTPC(context.Background(), w, issue)
+
+	if token == "" {
+		return nil, errors.New(errorPrefix + "failed to issue a test token")
+	}
+
+	r, err := http.NewRequest(method, target, body)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range (&http.Response{Header: w.header}).Cookies() {
+		r.AddCookie(c)
+	}
+	r.Header.Set(cs.opts.RequestHeaders[0], token)
+
+	if u, err := url.Parse(target); err == nil && u.Scheme == "https" {
+		r.Header.Set("Referer", target)
+	}
+
+	return r, nil
+}
+
+// headerRecorder is a minimal http.ResponseWriter that records the response
+// headers and discards the body.
+type headerRecorder struct {
+	header http.Header
+}
+
+func (hr *headerRecorder) Header() http.Header {
+	return hr.header
+}
+
+func (hr *headerRecorder) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (hr *headerRecorder) WriteHeader(int) {}
@@ -0,0 +1,60 @@
+package csrf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"goji.io"
+	"goji.io/pat"
+)
+
+// TestNewTestRequest tests that test requests pass the real validation path.
+func TestNewTestRequest(t *testing.T) {
+	var requestTests = []struct {
+		target string
+		opts   []Option
+	}{
+		{"/signup", nil},
+		{"https://www.gorillatoolkit.org/signup", nil},
+		{"/signup", []Option{RequestHeader("X-Custom-Token"), CookieName("_custom")}},
+	}
+
+	for _, v := range requestTests {
+		m := goji.NewMux()
+		m.UseC(Protect(testKey, v.opts...))
+		m.HandleFuncC(pat.Post("/signup"), testHandler)
+
+		r, err := NewTestRequest(testKey, "POST", v.target, strings.NewReader("name=goji"), v.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		m.ServeHTTP(rr, r)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("test request for %q failed validation: got %v want %v",
+				v.target, rr.Code, http.StatusOK)
+		}
+	}
+
+	// A test request for a different key must fail.
+	m := goji.NewMux()
+	m.UseC(Protect(testKey))
+	m.HandleFuncC(pat.Post("/signup"), testHandler)
+
+	r, err := NewTestRequest([]byte("a-different-32-byte-long-authkey"), "POST", "/signup", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	m.ServeHTTP(rr, r)
+
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("test request for another key passed validation: got %v want %v",
+			rr.Code, http.StatusForbidden)
+	}
+}